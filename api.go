@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultAPIListen = "127.0.0.1:9091"
+
+// APIConfig controls the local control API.
+type APIConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen,omitempty"` // Loopback address; defaults to defaultAPIListen
+	Token   string `json:"token,omitempty"`  // Bearer token; generated when the API is first enabled
+}
+
+// apiCall is an API request handed to the main event loop, so that API
+// actions never race with menu actions.
+type apiCall struct {
+	run   func() (any, error)
+	reply chan apiResult
+}
+
+type apiResult struct {
+	value any
+	err   error
+}
+
+// apiCalls is consumed by the main event loop.
+var apiCalls = make(chan apiCall)
+
+// apiError is an error with the HTTP status to report it with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+
+var errTunnelRunning = &apiError{http.StatusConflict, errors.New("stop the tunnel first")}
+
+// apiServer is the running control API, or nil.
+var apiServer *http.Server
+
+// startAPI starts the control API if it is enabled, generating a token on
+// first use.
+func startAPI() {
+	mu.Lock()
+	config := appConfig.API
+	addr := config.Listen
+	if addr == "" {
+		addr = defaultAPIListen
+	}
+	if config.Enabled && config.Token == "" {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			mu.Unlock()
+			logWarn(GetText("api_listen_fail"), addr, err)
+			return
+		}
+		appConfig.API.Token = hex.EncodeToString(token)
+		config.Token = appConfig.API.Token
+		saveConfig()
+	}
+	mu.Unlock()
+	if !config.Enabled || apiServer != nil {
+		return
+	}
+
+	// The API may start and stop the tunnel, so it must not be reachable
+	// from the network.
+	if host, _, err := net.SplitHostPort(addr); err != nil || !net.ParseIP(host).IsLoopback() {
+		logWarn(GetText("api_listen_fail"), addr, GetText("api_loopback_only"))
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logWarn(GetText("api_listen_fail"), addr, err)
+		return
+	}
+
+	apiServer = &http.Server{
+		Handler:           apiAuth(config.Token, newAPIHandler()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go apiServer.Serve(listener)
+	log.Printf(GetText("log_api_listening")+"\n", listener.Addr())
+}
+
+// stopAPI shuts the control API down.
+func stopAPI() {
+	if apiServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	apiServer.Shutdown(ctx)
+	apiServer = nil
+	log.Println(GetText("log_api_stopped"))
+}
+
+// apiAuth rejects requests without the bearer token.
+func apiAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newAPIHandler routes the API endpoints to the functions behind the menu.
+func newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, currentStatus())
+	})
+	mux.HandleFunc("POST /api/start", apiAction(func(r *http.Request) (any, error) {
+		if tunnelRunning() && activeOp == nil {
+			return currentStatus(), nil
+		}
+		return handleStart(), nil
+	}))
+	mux.HandleFunc("POST /api/stop", apiAction(func(r *http.Request) (any, error) {
+		if !tunnelRunning() {
+			return currentStatus(), nil
+		}
+		if op := handleStop(); op != nil {
+			return op, nil
+		}
+		return currentStatus(), nil
+	}))
+
+	mux.HandleFunc("GET /api/connections", func(w http.ResponseWriter, r *http.Request) {
+		conns, err := activeConnections(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, conns)
+	})
+	mux.HandleFunc("DELETE /api/connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := closeConnection(r.PathValue("id")); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /api/proxies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, proxyList())
+	})
+	mux.HandleFunc("POST /api/proxies", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ URL string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		if tunnelRunning() {
+			return nil, errTunnelRunning
+		}
+		mu.Lock()
+		err := validateProxy(strings.TrimSpace(body.URL))
+		if err == nil {
+			addProxyLocked(strings.TrimSpace(body.URL))
+		}
+		mu.Unlock()
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, err}
+		}
+		return proxyList(), nil
+	}))
+	mux.HandleFunc("DELETE /api/proxies", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ URL string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		if tunnelRunning() {
+			return nil, errTunnelRunning
+		}
+		if !hasProxy(body.URL) {
+			return nil, &apiError{http.StatusNotFound, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), body.URL)}
+		}
+		deleteProxy(body.URL)
+		return proxyList(), nil
+	}))
+	mux.HandleFunc("POST /api/proxies/select", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ URL string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		if tunnelRunning() {
+			return nil, errTunnelRunning
+		}
+		if !hasProxy(body.URL) {
+			return nil, &apiError{http.StatusNotFound, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), body.URL)}
+		}
+		setProxy(body.URL)
+		return proxyList(), nil
+	}))
+
+	mux.HandleFunc("GET /api/profiles", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, profileList())
+	})
+	mux.HandleFunc("POST /api/profiles/select", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ Name string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		if tunnelRunning() {
+			return nil, errTunnelRunning
+		}
+		mu.RLock()
+		found := findProfileLocked(body.Name) != nil
+		mu.RUnlock()
+		if !found {
+			return nil, &apiError{http.StatusNotFound, fmt.Errorf("unknown profile %q", body.Name)}
+		}
+		setProfile(body.Name)
+		return profileList(), nil
+	}))
+
+	mux.HandleFunc("POST /api/launch", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ Args []string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		launch, err := parseLaunchArgs(body.Args)
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, err}
+		}
+		op, err := applyLaunchArgs(launch)
+		if err != nil {
+			return nil, err
+		}
+		if op != nil {
+			return op, nil
+		}
+		return currentStatus(), nil
+	}))
+
+	mux.HandleFunc("POST /api/language", apiAction(func(r *http.Request) (any, error) {
+		var body struct{ Language string }
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+		var lang Language
+		switch strings.ToLower(body.Language) {
+		case "zh", "chinese":
+			lang = Chinese
+		case "en", "english":
+			lang = English
+		default:
+			return nil, &apiError{http.StatusBadRequest, fmt.Errorf("unknown language %q", body.Language)}
+		}
+		switchLanguage(lang)
+		return currentStatus(), nil
+	}))
+	return mux
+}
+
+// apiAction runs fn on the main event loop and writes its result.
+func apiAction(fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		call := apiCall{
+			run:   func() (any, error) { return fn(r) },
+			reply: make(chan apiResult, 1),
+		}
+		select {
+		case apiCalls <- call:
+		case <-r.Context().Done():
+			return
+		}
+		result := <-call.reply
+		// A start or stop finishes in the background; wait for it here
+		// rather than on the main event loop.
+		if op, ok := result.value.(*tunnelOp); ok {
+			<-op.done
+			result = apiResult{currentStatus(), op.err}
+		}
+		if result.err != nil {
+			status := http.StatusInternalServerError
+			var apiErr *apiError
+			if errors.As(result.err, &apiErr) {
+				status = apiErr.status
+			}
+			writeJSON(w, status, map[string]string{"error": result.err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result.value)
+	}
+}
+
+// handleAPICall runs call on the main event loop.
+func handleAPICall(call apiCall) {
+	value, err := call.run()
+	call.reply <- apiResult{value, err}
+}
+
+func decodeBody(r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 64*1024)).Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, err}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiStatus is the tunnel state reported by the API and the CLI.
+type apiStatus struct {
+	Running           bool          `json:"running"`
+	State             string        `json:"state"`
+	Error             string        `json:"error,omitempty"`
+	UptimeSeconds     int64         `json:"uptime_seconds,omitempty"`
+	Profile           string        `json:"profile"`
+	Proxy             string        `json:"proxy"`
+	Language          string        `json:"language"`
+	KillSwitchEngaged bool          `json:"kill_switch_engaged"`
+	Traffic           *trafficStats `json:"traffic,omitempty"`
+	Exit              *exitInfo     `json:"exit,omitempty"`
+}
+
+func currentStatus() apiStatus {
+	s, err := currentState()
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	traffic := currentTraffic()
+	exit := currentExit()
+	mu.RLock()
+	defer mu.RUnlock()
+	return apiStatus{
+		Traffic:           traffic,
+		Exit:              exit,
+		Running:           s.active(),
+		State:             s.String(),
+		Error:             errText,
+		UptimeSeconds:     int64(uptime().Seconds()),
+		Profile:           appConfig.ActiveProfile,
+		Proxy:             currentProxy,
+		Language:          appConfig.Language.String(),
+		KillSwitchEngaged: appConfig.KillSwitchEngaged,
+	}
+}
+
+type apiProxyList struct {
+	Proxies  []string `json:"proxies"`
+	Selected string   `json:"selected"`
+}
+
+func proxyList() apiProxyList {
+	mu.RLock()
+	defer mu.RUnlock()
+	return apiProxyList{Proxies: append([]string{}, appConfig.Proxies...), Selected: currentProxy}
+}
+
+func hasProxy(proxy string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range appConfig.Proxies {
+		if p == proxy {
+			return true
+		}
+	}
+	return false
+}
+
+type apiProfileList struct {
+	Profiles []string `json:"profiles"`
+	Active   string   `json:"active"`
+}
+
+func profileList() apiProfileList {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := apiProfileList{Profiles: []string{}, Active: appConfig.ActiveProfile}
+	for _, p := range appConfig.Profiles {
+		list.Profiles = append(list.Profiles, p.Name)
+	}
+	return list
+}
+
+// toggleAPI turns the control API on or off from the Settings menu.
+func toggleAPI() {
+	toggleSetting(mAPI, &appConfig.API.Enabled)
+	if mAPI.Checked() {
+		startAPI()
+	} else {
+		stopAPI()
+	}
+}
+
+// copyAPIToken puts the API token on the clipboard.
+func copyAPIToken() {
+	mu.RLock()
+	token := appConfig.API.Token
+	mu.RUnlock()
+	if token == "" {
+		return
+	}
+	if err := writeClipboard(token); err != nil {
+		logWarn(GetText("api_copy_token_fail"), err)
+		return
+	}
+	log.Println(GetText("log_api_token_copied"))
+}
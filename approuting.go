@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+)
+
+// Windows has no user-mode way to route by process, so per-app routing is
+// best-effort: the router watches the TCP connections of matching programs,
+// adds a host route into the tunnel for every remote address they use, and
+// resets connections that were opened before the route existed so the
+// program reconnects through the tunnel. UDP is not tracked, and other
+// programs talking to the same addresses are tunnelled as well.
+
+const appRouterInterval = 2 * time.Second
+
+var (
+	iphlpapi                       = syscall.NewLazyDLL("iphlpapi.dll")
+	procGetExtendedTcpTable        = iphlpapi.NewProc("GetExtendedTcpTable")
+	procSetTcpEntry                = iphlpapi.NewProc("SetTcpEntry")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+const (
+	tcpTableOwnerPIDAll        = 5
+	tcpStateSynSent            = 3
+	tcpStateEstablished        = 5
+	tcpStateDeleteTCB          = 12
+	errorInsufficientBuffer    = 122
+	processQueryLimitedInfo    = 0x1000
+	maxTunnelledAppsMenuLength = 20
+)
+
+// AppRule selects programs whose traffic goes through the tunnel when
+// per-app routing is on. Process matches the executable name, Path the full
+// path or a folder containing it; either may be left empty.
+type AppRule struct {
+	Name    string `json:"name"`
+	Process string `json:"process,omitempty"` // e.g. "chrome.exe"
+	Path    string `json:"path,omitempty"`    // e.g. "C:\Program Files\Git"
+}
+
+// Matches reports whether the executable at image is selected by the rule.
+func (r AppRule) Matches(image string) bool {
+	if r.Process != "" && !strings.EqualFold(filepath.Base(image), r.Process) {
+		return false
+	}
+	if r.Path != "" {
+		path := strings.ToLower(filepath.Clean(r.Path))
+		lower := strings.ToLower(image)
+		if lower != path && !strings.HasPrefix(lower, strings.TrimSuffix(path, `\`)+`\`) {
+			return false
+		}
+	}
+	return r.Process != "" || r.Path != ""
+}
+
+// tcpRowOwnerPID mirrors MIB_TCPROW_OWNER_PID. Addresses and ports are in
+// network byte order.
+type tcpRowOwnerPID struct {
+	State      uint32
+	LocalAddr  uint32
+	LocalPort  uint32
+	RemoteAddr uint32
+	RemotePort uint32
+	OwningPID  uint32
+}
+
+func (r tcpRowOwnerPID) localIP() net.IP   { return rowIP(r.LocalAddr) }
+func (r tcpRowOwnerPID) remoteIP() net.IP  { return rowIP(r.RemoteAddr) }
+func (r tcpRowOwnerPID) localPort() uint16 { return uint16(r.LocalPort>>8&0xff | r.LocalPort&0xff<<8) }
+
+func rowIP(v uint32) net.IP {
+	return net.IPv4(byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// tcpConnections returns the IPv4 TCP table with the owning process IDs.
+func tcpConnections() ([]tcpRowOwnerPID, error) {
+	size := uint32(16 * 1024)
+	for {
+		buf := make([]byte, size)
+		ret, _, _ := procGetExtendedTcpTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)),
+			0, syscall.AF_INET, tcpTableOwnerPIDAll, 0)
+		if ret == errorInsufficientBuffer {
+			continue
+		}
+		if ret != 0 {
+			return nil, syscall.Errno(ret)
+		}
+		n := *(*uint32)(unsafe.Pointer(&buf[0]))
+		if n == 0 {
+			return nil, nil
+		}
+		rows := unsafe.Slice((*tcpRowOwnerPID)(unsafe.Pointer(&buf[4])), n)
+		return append([]tcpRowOwnerPID(nil), rows...), nil
+	}
+}
+
+// resetTCPConnection drops a connection so its program has to reconnect.
+func resetTCPConnection(r tcpRowOwnerPID) error {
+	// SetTcpEntry takes a MIB_TCPROW, which is the same row without the PID.
+	r.State = tcpStateDeleteTCB
+	if ret, _, _ := procSetTcpEntry.Call(uintptr(unsafe.Pointer(&r))); ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
+
+// processImage returns the full path of the executable running as pid.
+func processImage(pid uint32) (string, error) {
+	h, err := syscall.OpenProcess(processQueryLimitedInfo, false, pid)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if ret, _, err := procQueryFullProcessImageNameW.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); ret == 0 {
+		return "", err
+	}
+	return syscall.UTF16ToString(buf[:size]), nil
+}
+
+// appRouter keeps the host routes of per-app routing up to date.
+type appRouter struct {
+	profile  Profile
+	rules    []AppRule
+	excluded map[string]bool // Proxy servers, which must never be routed into the tunnel
+	routes   map[string]bool // Host routes added so far
+	images   map[uint32]string
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// appRouterInstance is the router of the running tunnel, or nil.
+var appRouterInstance *appRouter
+
+// startAppRouter starts routing the programs selected by rules through the
+// tunnel of profile.
+func startAppRouter(profile Profile, rules []AppRule) {
+	r := &appRouter{
+		profile:  profile,
+		rules:    rules,
+		excluded: proxyServerIPs(profile),
+		routes:   make(map[string]bool),
+		images:   make(map[uint32]string),
+		stop:     make(chan struct{}),
+	}
+	appRouterInstance = r
+	log.Printf(GetText("log_app_routing_started")+"\n", len(rules))
+	r.wg.Add(1)
+	go r.run()
+}
+
+// stopAppRouter stops the router and removes the host routes it added.
+func stopAppRouter() {
+	r := appRouterInstance
+	if r == nil {
+		return
+	}
+	appRouterInstance = nil
+	close(r.stop)
+	r.wg.Wait()
+	for route := range r.routes {
+		exec.Command("cmd", "/C", fmt.Sprintf("netsh interface ipv4 delete route %s %s", route, tunAlias)).Run()
+	}
+	updateTunnelledAppsMenu(nil)
+}
+
+func (r *appRouter) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(appRouterInterval)
+	defer ticker.Stop()
+	for {
+		r.poll()
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll routes the destinations of matching programs into the tunnel and
+// updates the menu of tunnelled programs.
+func (r *appRouter) poll() {
+	rows, err := tcpConnections()
+	if err != nil {
+		logWarn(GetText("log_app_routing_fail"), err)
+		return
+	}
+
+	tunIP := net.ParseIP(r.profile.TunIP)
+	tunnelled := make(map[string]int)
+	seen := make(map[uint32]bool)
+	for _, row := range rows {
+		if row.State != tcpStateEstablished && row.State != tcpStateSynSent {
+			continue
+		}
+		remote := row.remoteIP()
+		if remote.IsLoopback() || remote.IsUnspecified() || remote.IsPrivate() || remote.IsLinkLocalUnicast() || r.excluded[remote.String()] {
+			continue
+		}
+		seen[row.OwningPID] = true
+		image, ok := r.images[row.OwningPID]
+		if !ok {
+			image, _ = processImage(row.OwningPID) // Empty for processes we may not open
+			r.images[row.OwningPID] = image
+		}
+		if image == "" || !r.matches(image) {
+			continue
+		}
+
+		if row.localIP().Equal(tunIP) {
+			tunnelled[filepath.Base(image)]++
+			continue
+		}
+		route := remote.String() + "/32"
+		if !r.routes[route] {
+			cmdStr := fmt.Sprintf("netsh interface ipv4 add route %s %s %s metric=1", route, tunAlias, r.profile.TunIP)
+			if output, err := exec.Command("cmd", "/C", cmdStr).CombinedOutput(); err != nil {
+				logWarn(GetText("log_app_routing_fail"), fmt.Errorf(GetTextWithFormat("command_exec_fail"), cmdStr, string(output), err))
+				continue
+			}
+			r.routes[route] = true
+			log.Printf(GetText("log_app_route_added")+"\n", filepath.Base(image), remote)
+		}
+		// The connection was opened before the route existed.
+		if err := resetTCPConnection(row); err != nil {
+			logWarn(GetText("log_app_routing_fail"), err)
+		}
+	}
+
+	// Forget processes that have gone, as their IDs may be reused.
+	for pid := range r.images {
+		if !seen[pid] {
+			delete(r.images, pid)
+		}
+	}
+	updateTunnelledAppsMenu(tunnelled)
+}
+
+func (r *appRouter) matches(image string) bool {
+	for _, rule := range r.rules {
+		if rule.Matches(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyServerIPs returns the addresses of the proxy (or first chain hop) of
+// profile.
+func proxyServerIPs(profile Profile) map[string]bool {
+	ips := make(map[string]bool)
+	for _, server := range append([]string{profile.Proxy}, profile.Chain...) {
+		u, err := url.Parse(server)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			ips[ip.String()] = true
+			continue
+		}
+		addrs, _ := net.LookupIP(u.Hostname())
+		for _, ip := range addrs {
+			ips[ip.String()] = true
+		}
+	}
+	return ips
+}
+
+// --- Tray ---
+
+var tunnelledAppItems []*systray.MenuItem
+
+// updateTunnelledAppsMenu lists the programs with connections through the
+// tunnel, with their connection counts.
+func updateTunnelledAppsMenu(apps map[string]int) {
+	if mTunnelledApps == nil {
+		return
+	}
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > maxTunnelledAppsMenuLength {
+		names = names[:maxTunnelledAppsMenuLength]
+	}
+
+	if len(names) == 0 {
+		mNoTunnelledApps.Show()
+	} else {
+		mNoTunnelledApps.Hide()
+	}
+	for i, name := range names {
+		title := fmt.Sprintf("%s (%d)", name, apps[name])
+		if i == len(tunnelledAppItems) {
+			item := mTunnelledApps.AddSubMenuItem(title, name)
+			item.Disable()
+			tunnelledAppItems = append(tunnelledAppItems, item)
+		}
+		tunnelledAppItems[i].SetTitle(title)
+		tunnelledAppItems[i].Show()
+	}
+	for _, item := range tunnelledAppItems[len(names):] {
+		item.Hide()
+	}
+}
+
+// addAppRule asks for a program to route through the tunnel.
+func addAppRule() {
+	path, err := zenity.SelectFile(zenity.Title(GetText("add_app_rule")),
+		zenity.FileFilters{{Name: GetText("app_rule_programs"), Patterns: []string{"*.exe"}, CaseFold: true}})
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	rule := AppRule{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), Path: path}
+
+	mu.Lock()
+	for _, existing := range appConfig.AppRules {
+		if existing.Matches(path) {
+			mu.Unlock()
+			zenity.Info(fmt.Sprintf(GetText("app_rule_exists"), existing.Name), zenity.Title(GetText("add_app_rule")))
+			return
+		}
+	}
+	appConfig.AppRules = append(appConfig.AppRules, rule)
+	saveConfig()
+	mu.Unlock()
+
+	log.Printf(GetText("log_app_rule_added")+"\n", rule.Name, rule.Path)
+	if tunnelRunning() {
+		zenity.Info(GetText("app_rules_next_start"), zenity.Title(GetText("add_app_rule")))
+	}
+}
+
+// removeAppRules lets the user pick rules to delete.
+func removeAppRules() {
+	mu.RLock()
+	var labels []string
+	for _, r := range appConfig.AppRules {
+		labels = append(labels, appRuleLabel(r))
+	}
+	mu.RUnlock()
+	if len(labels) == 0 {
+		zenity.Info(GetText("app_rules_empty"), zenity.Title(GetText("remove_app_rules")))
+		return
+	}
+
+	selected, err := zenity.ListMultiple(GetText("remove_app_rules_prompt"), labels,
+		zenity.Title(GetText("remove_app_rules")),
+		zenity.CheckList())
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	remove := make(map[string]bool)
+	for _, s := range selected {
+		remove[s] = true
+	}
+
+	mu.Lock()
+	var kept []AppRule
+	for _, r := range appConfig.AppRules {
+		if remove[appRuleLabel(r)] {
+			log.Printf(GetText("log_app_rule_removed")+"\n", r.Name)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	appConfig.AppRules = kept
+	saveConfig()
+	mu.Unlock()
+}
+
+func appRuleLabel(r AppRule) string {
+	target := r.Path
+	if target == "" {
+		target = r.Process
+	}
+	return fmt.Sprintf("%s: %s", r.Name, target)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncruces/zenity"
+)
+
+// chainHopSchemes lists the proxy protocols TUNTray can dial itself, and so
+// can use as hops in a proxy chain.
+var chainHopSchemes = map[string]bool{
+	"socks5": true,
+	"http":   true,
+}
+
+// proxyDialer opens TCP connections, possibly through other proxies.
+type proxyDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// chainDialer reaches its destination through an ordered list of proxies,
+// asking each hop to connect to the next one.
+type chainDialer struct {
+	hops    []*url.URL
+	forward proxyDialer // Dials the first hop
+}
+
+// newChainDialer parses hops and returns a dialer that uses forward to reach
+// the first of them.
+func newChainDialer(hops []string, forward proxyDialer) (*chainDialer, error) {
+	d := &chainDialer{forward: forward}
+	for _, hop := range hops {
+		u, err := url.Parse(hop)
+		if err != nil || u.Hostname() == "" || u.Port() == "" {
+			return nil, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), redactSecrets(hop))
+		}
+		if !chainHopSchemes[strings.ToLower(u.Scheme)] {
+			return nil, fmt.Errorf(GetTextWithFormat("chain_hop_unsupported"), redactSecrets(hop))
+		}
+		d.hops = append(d.hops, u)
+	}
+	return d, nil
+}
+
+func (d *chainDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.hops) == 0 {
+		return d.forward.DialContext(ctx, network, address)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.hops[0].Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	for i, hop := range d.hops {
+		target := address
+		if i+1 < len(d.hops) {
+			target = d.hops[i+1].Host
+		}
+		if err := proxyHandshake(conn, hop, target); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf(GetTextWithFormat("chain_hop_fail"), redactProxyURL(hop), err)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyHandshake asks the proxy at the other end of conn to connect to target.
+func proxyHandshake(conn net.Conn, hop *url.URL, target string) error {
+	switch strings.ToLower(hop.Scheme) {
+	case "socks5":
+		return socks5Connect(conn, hop.User, target)
+	case "http":
+		return httpConnect(conn, hop.User, target)
+	}
+	return fmt.Errorf(GetTextWithFormat("proxy_scheme_error"), hop.Scheme)
+}
+
+// socks5Connect performs a SOCKS5 CONNECT (RFC 1928), authenticating with
+// user name and password (RFC 1929) when user is set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, target string) error {
+	addr, err := encodeSocksAddr(target)
+	if err != nil {
+		return err
+	}
+	method := byte(0x00)
+	var username, password string
+	if user != nil {
+		method = 0x02
+		username = user.Username()
+		password, _ = user.Password()
+		// RFC 1929 has a single length byte for each.
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5: user name or password too long")
+		}
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if method == 0x02 {
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, 0x01, 0x00}, addr...)); err != nil {
+		return err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5: connect failed with code %d", header[1])
+	}
+	_, err = readSocksAddr(conn)
+	return err
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, user *url.Userinfo, target string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Read byte by byte so nothing past the response header is buffered away.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http: CONNECT returned %s", resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader limits every read to a single byte.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+// encodeSocksAddr encodes host:port as a SOCKS5 address (ATYP, address, port).
+func encodeSocksAddr(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append([]byte{0x01}, ip4...)
+		} else {
+			b = append([]byte{0x04}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads a SOCKS5 address (ATYP, address, port) as host:port.
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if atyp[0] == 0x04 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksServer is a minimal local SOCKS5 server (no authentication, CONNECT
+// only) that opens every requested connection through its dialer.
+type socksServer struct {
+	listener net.Listener
+	dialer   proxyDialer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// startSocksServer listens on addr and serves SOCKS5 clients until Close.
+func startSocksServer(addr string, dialer proxyDialer) (*socksServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &socksServer{listener: listener, dialer: dialer}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *socksServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting clients, drops open connections and waits for them.
+func (s *socksServer) Close() error {
+	s.cancel()
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *socksServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// Greeting: accept "no authentication" only.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0x05 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !strings.ContainsRune(string(methods), 0x00) {
+		conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	conn.Write([]byte{0x05, 0x00})
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+	if request[1] != 0x01 {
+		// Only CONNECT is supported; UDP is not relayed through the chain.
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 15*time.Second)
+	upstream, err := s.dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		logWarn(GetText("log_chain_dial_fail"), target, err)
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	conn.SetDeadline(time.Time{})
+
+	// Tear both sides down when the server is closed.
+	stop := context.AfterFunc(s.ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+	relay(conn, upstream)
+}
+
+// relay copies data in both directions until either side is done.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
+
+// redactProxyURL hides the credentials in a proxy URL for logs and dialogs.
+func redactProxyURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	c := *u
+	c.User = url.User("***")
+	return c.String()
+}
+
+// detectDirectIP returns the local address of the interface currently used
+// for the default route. It must be called before the TUN route is added.
+func detectDirectIP() net.IP {
+	// No packets are sent for UDP "connections".
+	conn, err := net.Dial("udp4", "8.8.8.8:53")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// newDirectDialer returns a dialer bound to localIP so its connections leave
+// through the physical interface instead of looping back into the TUN.
+func newDirectDialer(localIP net.IP) *net.Dialer {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if localIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	return d
+}
+
+// configureChain lets the user pick the chain hops in order.
+func configureChain() {
+	mu.RLock()
+	var candidates []string
+	for _, p := range appConfig.Proxies {
+		if u, err := url.Parse(p); err == nil && chainHopSchemes[strings.ToLower(u.Scheme)] {
+			candidates = append(candidates, p)
+		}
+	}
+	mu.RUnlock()
+
+	if len(candidates) == 0 {
+		zenity.Info(GetText("chain_no_candidates"), zenity.Title(GetText("proxy_chain")))
+		return
+	}
+
+	var chain []string
+	for len(candidates) > 0 {
+		hop, err := zenity.List(fmt.Sprintf(GetText("chain_hop_prompt"), len(chain)+1), candidates,
+			zenity.Title(GetText("proxy_chain")),
+			zenity.ExtraButton(GetText("chain_done")),
+			zenity.DisallowEmpty())
+		if errors.Is(err, zenity.ErrExtraButton) {
+			break
+		}
+		if err != nil {
+			logDialogError(err)
+			return
+		}
+		chain = append(chain, hop)
+		for i, c := range candidates {
+			if c == hop {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(chain) == 0 {
+		return
+	}
+
+	mu.Lock()
+	activeProfileLocked().Chain = chain
+	saveConfig()
+	updateChainMenuLocked()
+	mu.Unlock()
+
+	log.Printf(GetText("log_chain_set")+"\n", proxyNames(chain))
+	zenity.Info(fmt.Sprintf(GetText("chain_set_success"), strings.Join(chain, "\n-> ")),
+		zenity.Title(GetText("operation_success")))
+}
+
+// clearChain turns chaining off so tun2socks uses the selected proxy directly.
+func clearChain() {
+	mu.Lock()
+	defer mu.Unlock()
+	activeProfileLocked().Chain = nil
+	saveConfig()
+	updateChainMenuLocked()
+	log.Println(GetText("log_chain_cleared"))
+}
+
+// removeFromChainLocked drops proxyAddr from every profile's chain, or
+// replaces it when replacement is not empty. Callers must hold mu.
+func removeFromChainLocked(proxyAddr, replacement string) {
+	for i := range appConfig.Profiles {
+		p := &appConfig.Profiles[i]
+		var chain []string
+		for _, hop := range p.Chain {
+			switch {
+			case hop != proxyAddr:
+				chain = append(chain, hop)
+			case replacement != "":
+				chain = append(chain, replacement)
+			}
+		}
+		p.Chain = chain
+		if p.Proxy == proxyAddr && replacement != "" {
+			p.Proxy = replacement
+		}
+	}
+	updateChainMenuLocked()
+}
+
+// updateChainMenuLocked reflects the configured chain in the tray menu.
+// Callers must hold mu.
+func updateChainMenuLocked() {
+	if mChain == nil {
+		return
+	}
+	if chain := activeProfileLocked().Chain; len(chain) > 0 {
+		mChain.Check()
+		mChain.SetTooltip(proxyNames(chain))
+		mClearChain.Enable()
+	} else {
+		mChain.Uncheck()
+		mChain.SetTooltip(GetText("chain_tooltip"))
+		mClearChain.Disable()
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveStub accepts connections on a random local port and passes each to
+// handle until the test ends.
+func serveStub(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startEchoServer returns the address of a server that sends back whatever
+// it receives.
+func startEchoServer(t *testing.T) string {
+	return serveStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+}
+
+// startStubSocks5 returns the address of a SOCKS5 proxy that requires user
+// and password when user is set, and connects directly to the target.
+func startStubSocks5(t *testing.T, user, password string) string {
+	return serveStub(t, func(conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		if user == "" {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+			var auth [2]byte
+			if _, err := io.ReadFull(conn, auth[:]); err != nil {
+				return
+			}
+			gotUser := make([]byte, auth[1])
+			io.ReadFull(conn, gotUser)
+			var n [1]byte
+			io.ReadFull(conn, n[:])
+			gotPassword := make([]byte, n[0])
+			if _, err := io.ReadFull(conn, gotPassword); err != nil {
+				return
+			}
+			if string(gotUser) != user || string(gotPassword) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		request := make([]byte, 3)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		target, err := readSocksAddr(conn)
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		relay(conn, upstream)
+	})
+}
+
+// startStubHTTPConnect returns the address of an HTTP proxy that only
+// answers CONNECT.
+func startStubHTTPConnect(t *testing.T) string {
+	return serveStub(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer upstream.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(conn, upstream)
+	})
+}
+
+// startChainListener runs the local SOCKS5 listener over hops.
+func startChainListener(t *testing.T, hops ...string) *socksServer {
+	t.Helper()
+	dialer, err := newChainDialer(hops, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := startSocksServer("127.0.0.1:0", dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// dialThrough connects to target through the SOCKS5 server at addr.
+func dialThrough(t *testing.T, addr, target string) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := socks5Connect(conn, nil, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestChainRelays(t *testing.T) {
+	echo := startEchoServer(t)
+	socks := startStubSocks5(t, "", "")
+	socksAuth := startStubSocks5(t, "user", "secret")
+	httpProxy := startStubHTTPConnect(t)
+
+	tests := []struct {
+		name string
+		hops []string
+	}{
+		{"no hops", nil},
+		{"socks5", []string{"socks5://" + socks}},
+		{"http", []string{"http://" + httpProxy}},
+		{"socks5 with auth then http", []string{"socks5://user:secret@" + socksAuth, "http://" + httpProxy}},
+		{"http then socks5", []string{"http://" + httpProxy, "socks5://" + socks}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startChainListener(t, tt.hops...)
+			conn, err := dialThrough(t, server.Addr(), echo)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer conn.Close()
+
+			want := "hello through " + tt.name
+			if _, err := io.WriteString(conn, want); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestChainRejectedCredentials(t *testing.T) {
+	echo := startEchoServer(t)
+	socksAuth := startStubSocks5(t, "user", "secret")
+	hops := []string{"socks5://user:wrong@" + socksAuth}
+
+	dialer, err := newChainDialer(hops, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if conn, err := dialer.DialContext(ctx, "tcp", echo); err == nil {
+		conn.Close()
+		t.Fatal("dial with a wrong password succeeded")
+	} else if !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("got %v, want an authentication failure", err)
+	}
+
+	server := startChainListener(t, hops...)
+	if conn, err := dialThrough(t, server.Addr(), echo); err == nil {
+		conn.Close()
+		t.Fatal("listener connected through a hop that rejected its credentials")
+	}
+}
+
+func TestSocks5ConnectTooLong(t *testing.T) {
+	long := strings.Repeat("a", 256)
+	tests := []struct {
+		name   string
+		user   *url.Userinfo
+		target string
+	}{
+		{"user name", url.UserPassword(long, "secret"), "127.0.0.1:80"},
+		{"password", url.UserPassword("user", long), "127.0.0.1:80"},
+		{"host name", nil, long + ".example:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			if err := socks5Connect(client, tt.user, tt.target); err == nil {
+				t.Error("socks5Connect accepted an over-long value")
+			}
+		})
+	}
+}
+
+// failDialer fails the test if the listener tries to connect anywhere.
+type failDialer struct{ t *testing.T }
+
+func (d failDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.t.Errorf("unexpected dial to %s", address)
+	return nil, io.EOF
+}
+
+func TestSocksServerRefusesUDPAssociate(t *testing.T) {
+	server, err := startSocksServer("127.0.0.1:0", failDialer{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("method %#x, want no authentication", reply[1])
+	}
+	conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // UDP ASSOCIATE 0.0.0.0:0
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x07 {
+		t.Errorf("reply code %#x, want 0x07 (command not supported)", reply[1])
+	}
+}
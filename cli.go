@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cliCommands lists the first arguments that run TUNTray without the tray.
+var cliCommands = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"status":  true,
+	"proxies": true,
+	"select":  true,
+	"help":    true,
+}
+
+const cliUsage = `Usage: TUNTray <command> [--json]
+
+Commands:
+  start [--proxy URL] [--profile NAME]   Start the tunnel
+  stop                                   Stop the tunnel
+  status                                 Show the tunnel state
+  proxies list                           List proxies
+  proxies add URL                        Add a proxy
+  proxies rm URL                         Delete a proxy
+  select URL                             Select the proxy to use
+
+Commands go to the running TUNTray when there is one; otherwise they act on
+config.json directly, and "start" keeps running in the foreground until
+stopped with Ctrl+C or "TUNTray stop".
+`
+
+// runCLI runs a command line invocation and returns the exit code.
+func runCLI(args []string) int {
+	attachConsole()
+
+	asJSON := false
+	var rest []string
+	for _, a := range args {
+		if a == "--json" || a == "-json" {
+			asJSON = true
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	out := cliOutput{json: asJSON}
+	if len(rest) == 0 {
+		rest = []string{"help"}
+	}
+
+	configLoaded, _ := loadConfig()
+	initializeLanguage(configLoaded)
+
+	client := newInstanceClient()
+	var err error
+	switch rest[0] {
+	case "start":
+		err = cliStart(client, rest[1:], out)
+	case "stop":
+		err = cliStop(client, out)
+	case "status":
+		err = cliStatus(client, out)
+	case "proxies":
+		err = cliProxies(client, rest[1:], out)
+	case "select":
+		if len(rest) != 2 {
+			err = errors.New(cliUsage)
+			break
+		}
+		err = cliSelect(client, rest[1], out)
+	default:
+		fmt.Print(cliUsage)
+	}
+	if err != nil {
+		out.error(err)
+		return 1
+	}
+	return 0
+}
+
+// cliOutput prints results as text or JSON.
+type cliOutput struct {
+	json bool
+}
+
+func (o cliOutput) print(v any, text string) {
+	if o.json {
+		json.NewEncoder(os.Stdout).Encode(v)
+	} else {
+		fmt.Println(text)
+	}
+}
+
+func (o cliOutput) error(err error) {
+	if o.json {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (o cliOutput) status(s apiStatus) {
+	state := GetText("state_" + s.State)
+	if s.Error != "" {
+		state += ": " + s.Error
+	}
+	o.print(s, fmt.Sprintf(GetText("cli_status"), state, s.Profile, s.Proxy))
+}
+
+func (o cliOutput) proxies(list apiProxyList) {
+	var lines []string
+	for _, p := range list.Proxies {
+		marker := "  "
+		if p == list.Selected {
+			marker = "* "
+		}
+		lines = append(lines, marker+p)
+	}
+	o.print(list, strings.Join(lines, "\n"))
+}
+
+func cliStart(client *apiClient, args []string, out cliOutput) error {
+	flags := flag.NewFlagSet("start", flag.ContinueOnError)
+	proxy := flags.String("proxy", "", "proxy URL to use")
+	profile := flags.String("profile", "", "profile to use")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	launch := launchArgs{Start: true, Proxy: *proxy, Profile: *profile}
+	if client != nil {
+		var status apiStatus
+		if err := client.do(http.MethodPost, "/api/launch", map[string][]string{"args": launch.args()}, &status); err != nil {
+			return err
+		}
+		out.status(status)
+		return nil
+	}
+
+	// Standalone: run the tunnel in this process until told to stop.
+	if !isElevated() {
+		return errors.New(GetText("permission_error_msg"))
+	}
+	if !acquireInstanceLock() {
+		return errors.New(GetText("instance_unreachable"))
+	}
+	mu.Lock()
+	applyActiveProfileLocked()
+	mu.Unlock()
+	unblockOtherDNS()
+
+	op, err := applyLaunchArgs(launch)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-op.done
+		if op.err == nil {
+			out.status(currentStatus())
+		}
+	}()
+	runHeadless()
+	return op.err
+}
+
+// runHeadless stands in for the tray's event loop while a standalone
+// "start" keeps the tunnel up.
+func runHeadless() {
+	startInstanceEndpoint()
+	defer stopInstanceEndpoint()
+	startAPI()
+	defer stopAPI()
+	go watchNetwork()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for tunnelRunning() {
+		select {
+		case op := <-opFinished:
+			finishOp(op)
+		case result := <-selfTestFinished:
+			finishSelfTest(result)
+		case change := <-networkChanges:
+			handleNetworkChange(change)
+		case call := <-apiCalls:
+			handleAPICall(call)
+		case <-interrupt:
+			handleStop()
+		}
+	}
+	signal.Stop(interrupt)
+}
+
+func cliStop(client *apiClient, out cliOutput) error {
+	if client != nil {
+		var status apiStatus
+		if err := client.do(http.MethodPost, "/api/stop", nil, &status); err != nil {
+			return err
+		}
+		out.status(status)
+		return nil
+	}
+
+	// An instance that cannot be reached still owns its tunnel.
+	if !acquireInstanceLock() {
+		return errors.New(GetText("instance_unreachable"))
+	}
+	// No instance is running, but one may have died with the tunnel up:
+	// end the tun2socks it started and undo the active profile's settings.
+	if !isElevated() {
+		return errors.New(GetText("permission_error_msg"))
+	}
+	if pid, ok := recordedTun2socks(); ok {
+		hiddenCommand("taskkill", "/F", "/PID", strconv.Itoa(pid)).Run()
+	}
+	mu.Lock()
+	runningProfile = *activeProfileLocked()
+	appConfig.Tun2socksPID = 0
+	saveConfig()
+	mu.Unlock()
+	if op := handleStop(); op != nil {
+		waitForOp()
+		if op.err != nil {
+			return op.err
+		}
+	}
+	out.status(currentStatus())
+	return nil
+}
+
+func cliStatus(client *apiClient, out cliOutput) error {
+	if client != nil {
+		var status apiStatus
+		if err := client.do(http.MethodGet, "/api/status", nil, &status); err != nil {
+			return err
+		}
+		out.status(status)
+		return nil
+	}
+	status := currentStatus()
+	if _, ok := recordedTun2socks(); ok {
+		status.Running = true
+		status.State = stateConnected.String()
+	}
+	out.status(status)
+	return nil
+}
+
+// recordedTun2socks returns the PID of the tun2socks process TUNTray last
+// started and whether it is still running, for commands that cannot ask the
+// instance that started it. Other tun2socks processes are not TUNTray's.
+func recordedTun2socks() (int, bool) {
+	mu.RLock()
+	pid := appConfig.Tun2socksPID
+	mu.RUnlock()
+	if pid == 0 {
+		return 0, false
+	}
+	// The PID may have been reused since, so the image must match too.
+	output, err := hiddenCommand("tasklist", "/NH", "/FI", fmt.Sprintf("PID eq %d", pid), "/FI", "IMAGENAME eq tun2socks.exe").Output()
+	return pid, err == nil && strings.Contains(strings.ToLower(string(output)), "tun2socks.exe")
+}
+
+func cliProxies(client *apiClient, args []string, out cliOutput) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		if client != nil {
+			var list apiProxyList
+			if err := client.do(http.MethodGet, "/api/proxies", nil, &list); err != nil {
+				return err
+			}
+			out.proxies(list)
+			return nil
+		}
+		out.proxies(proxyList())
+		return nil
+
+	case args[0] == "add" && len(args) == 2:
+		if client != nil {
+			var list apiProxyList
+			if err := client.do(http.MethodPost, "/api/proxies", map[string]string{"url": args[1]}, &list); err != nil {
+				return err
+			}
+			out.proxies(list)
+			return nil
+		}
+		mu.Lock()
+		err := validateProxy(args[1])
+		if err == nil {
+			addProxyLocked(args[1])
+		}
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		out.proxies(proxyList())
+		return nil
+
+	case args[0] == "rm" && len(args) == 2:
+		if client != nil {
+			var list apiProxyList
+			if err := client.do(http.MethodDelete, "/api/proxies", map[string]string{"url": args[1]}, &list); err != nil {
+				return err
+			}
+			out.proxies(list)
+			return nil
+		}
+		if !hasProxy(args[1]) {
+			return fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), args[1])
+		}
+		deleteProxy(args[1])
+		out.proxies(proxyList())
+		return nil
+	}
+	return errors.New(cliUsage)
+}
+
+func cliSelect(client *apiClient, proxy string, out cliOutput) error {
+	if client != nil {
+		var list apiProxyList
+		if err := client.do(http.MethodPost, "/api/proxies/select", map[string]string{"url": proxy}, &list); err != nil {
+			return err
+		}
+		out.proxies(list)
+		return nil
+	}
+	if !hasProxy(proxy) {
+		return fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), proxy)
+	}
+	setProxy(proxy)
+	out.proxies(proxyList())
+	return nil
+}
+
+// --- API client ---
+
+// apiClient talks to the control API of the running instance.
+type apiClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// newInstanceClient returns a client for the running instance, or nil when
+// there is none.
+func newInstanceClient() *apiClient {
+	info, ok := readInstanceInfo()
+	if !ok {
+		return nil
+	}
+	c := &apiClient{
+		base:  "http://" + info.Addr,
+		token: info.Token,
+		// Starting the tunnel waits for the adapter, which can take a while.
+		http: &http.Client{Timeout: 60 * time.Second},
+	}
+	if err := c.do(http.MethodGet, "/api/status", nil, nil); err != nil {
+		return nil // Left behind by an instance that did not exit cleanly
+	}
+	return c
+}
+
+// do sends a request and decodes the JSON response into v, if not nil.
+func (c *apiClient) do(method, path string, body, v any) error {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &apiError{resp.StatusCode, errors.New(e.Error)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// --- Console ---
+
+var procAttachConsole = kernel32.NewProc("AttachConsole")
+
+// attachConsole connects stdout and stderr to the console TUNTray was
+// started from. The executable is built as a GUI program, so it has none
+// of its own; redirected output (pipes, SSH sessions) is left alone.
+func attachConsole() {
+	if _, err := os.Stdout.Stat(); err == nil {
+		return
+	}
+	const attachParentProcess = ^uint32(0)
+	if ret, _, _ := procAttachConsole.Call(uintptr(attachParentProcess)); ret == 0 {
+		return
+	}
+	if console, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout = console
+		os.Stderr = console
+	}
+}
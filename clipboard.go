@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/ncruces/zenity"
+)
+
+// proxyURLPattern finds proxy links embedded in arbitrary text, such as a chat
+// message containing several "socks5://..." strings.
+var proxyURLPattern = regexp.MustCompile(`(?i)\b(?:http|socks4|socks5|ss|relay)://[^\s"'<>` + "`" + `]+`)
+
+// readClipboard returns the current text content of the system clipboard.
+func readClipboard() (string, error) {
+	output, err := hiddenCommand("powershell", "-NoProfile", "-Command",
+		"[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw").Output()
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// writeClipboard replaces the content of the system clipboard with text.
+func writeClipboard(text string) error {
+	// Passed as Base64 so that no text needs quoting or re-encoding.
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	return hiddenCommand("powershell", "-NoProfile", "-Command",
+		"Set-Clipboard -Value ([Text.Encoding]::UTF8.GetString([Convert]::FromBase64String('"+encoded+"')))").Run()
+}
+
+// extractProxyURLs returns every distinct proxy link found in text, in the
+// order they appear.
+func extractProxyURLs(text string) []string {
+	var found []string
+	seen := make(map[string]bool)
+	for _, match := range proxyURLPattern.FindAllString(text, -1) {
+		// Links pasted into prose often pick up trailing punctuation.
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		if seen[match] {
+			continue
+		}
+		seen[match] = true
+		found = append(found, match)
+	}
+	return found
+}
+
+// importProxiesFromClipboard reads proxy links from the clipboard, asks the
+// user which ones to keep and adds them like addNewProxy does.
+func importProxiesFromClipboard() {
+	text, err := readClipboard()
+	if err != nil {
+		logWarn(GetText("clipboard_read_fail"), err)
+		zenity.Warning(fmt.Sprintf(GetText("clipboard_read_fail"), err), zenity.Title(GetText("add_proxy_failed")))
+		return
+	}
+
+	// Only offer links that would pass validation right now.
+	var candidates []string
+	mu.RLock()
+	for _, p := range extractProxyURLs(text) {
+		if err := validateProxy(p); err != nil {
+			log.Printf(GetText("log_proxy_rejected")+"\n", p, err)
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	mu.RUnlock()
+
+	if len(candidates) == 0 {
+		zenity.Info(GetText("clipboard_no_proxies"), zenity.Title(GetText("add_from_clipboard")))
+		return
+	}
+
+	selected, err := zenity.ListMultiple(GetText("clipboard_confirm_prompt"), candidates,
+		zenity.Title(GetText("add_from_clipboard")),
+		zenity.CheckList(),
+		zenity.DefaultItems(candidates...))
+	if err != nil {
+		if err == zenity.ErrCanceled {
+			log.Println(GetText("user_cancelled"))
+		} else {
+			log.Printf(GetText("cannot_open_input")+"\n", err)
+		}
+		return
+	}
+
+	mu.Lock()
+	added := 0
+	for _, p := range selected {
+		// The list may have changed while the dialog was open.
+		if err := validateProxy(p); err != nil {
+			log.Printf(GetText("log_proxy_rejected")+"\n", p, err)
+			continue
+		}
+		addProxyLocked(p)
+		added++
+	}
+	mu.Unlock()
+
+	zenity.Info(fmt.Sprintf(GetText("clipboard_import_success"), added), zenity.Title(GetText("operation_success")))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+)
+
+const maxConnectionMenuItems = 15
+
+// restAPI talks to the running tun2socks, or is nil. It is guarded by mu.
+var restAPI *restAPIClient
+
+// hasRestAPIFlag reports whether args already configure tun2socks' API, in
+// which case the profile's own settings are left alone.
+func hasRestAPIFlag(args []string) bool {
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == "restapi" || strings.HasPrefix(name, "restapi=") {
+			return true
+		}
+	}
+	return false
+}
+
+// activeConnections lists the flows through the tunnel, newest first, with
+// the programs that opened them where they can be found.
+func activeConnections(ctx context.Context) ([]connection, error) {
+	mu.RLock()
+	client := restAPI
+	mu.RUnlock()
+	if client == nil {
+		return nil, errors.New(GetText("connections_unavailable"))
+	}
+	snapshot, err := client.connections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conns := snapshot.Connections
+	if conns == nil {
+		conns = []connection{}
+	}
+	addProcessNames(conns)
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Start.After(conns[j].Start) })
+	return conns, nil
+}
+
+// addProcessNames fills in the program behind each TCP flow by matching
+// its source address with the system's TCP table. tun2socks sees the
+// connections from the TUN side, where the source is the program's socket.
+func addProcessNames(conns []connection) {
+	rows, err := tcpConnections()
+	if err != nil {
+		return
+	}
+	owners := make(map[string]uint32)
+	for _, row := range rows {
+		owners[net.JoinHostPort(row.localIP().String(), fmt.Sprint(row.localPort()))] = row.OwningPID
+	}
+	images := make(map[uint32]string)
+	for i, c := range conns {
+		if c.Metadata.Network != "tcp" {
+			continue
+		}
+		pid, ok := owners[net.JoinHostPort(c.Metadata.SourceIP, fmt.Sprint(c.Metadata.SourcePort))]
+		if !ok {
+			continue
+		}
+		image, seen := images[pid]
+		if !seen {
+			image, _ = processImage(pid) // Empty for processes we may not open
+			images[pid] = image
+		}
+		if image != "" {
+			conns[i].Process = filepath.Base(image)
+		}
+	}
+}
+
+// closeConnection closes the flow with the given ID.
+func closeConnection(id string) error {
+	mu.RLock()
+	client := restAPI
+	mu.RUnlock()
+	if client == nil {
+		return errors.New(GetText("connections_unavailable"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.closeConnection(ctx, id); err != nil {
+		return err
+	}
+	log.Printf(GetText("log_connection_closed")+"\n", id)
+	return nil
+}
+
+// --- Tray ---
+
+var (
+	mConnections      *systray.MenuItem
+	mNoConnections    *systray.MenuItem
+	connectionItems   []*systray.MenuItem
+	connectionsMu     sync.Mutex
+	shownConnections  []connection   // What connectionItems show, by index
+	connectionsFailed *restAPIClient // The API client whose failure was last logged
+)
+
+// addConnectionsMenu adds the Connections submenu.
+func addConnectionsMenu() {
+	mConnections = systray.AddMenuItem(GetText("connections"), GetText("connections_tooltip"))
+	mNoConnections = mConnections.AddSubMenuItem(GetText("no_connections"), GetText("no_connections"))
+	mNoConnections.Disable()
+}
+
+// refreshConnectionsMenuTexts relabels the submenu after a language switch.
+func refreshConnectionsMenuTexts() {
+	if mConnections == nil {
+		return
+	}
+	mConnections.SetTitle(GetText("connections"))
+	mConnections.SetTooltip(GetText("connections_tooltip"))
+	mNoConnections.SetTitle(GetText("no_connections"))
+}
+
+// updateConnectionsMenu lists the most recent flows. Clicking one offers to
+// close it.
+func updateConnectionsMenu() {
+	if mConnections == nil {
+		return
+	}
+	mu.RLock()
+	client := restAPI
+	mu.RUnlock()
+	// Without the API, e.g. when the profile configures its own, there is
+	// nothing to list.
+	var conns []connection
+	if client != nil && tunnelRunning() {
+		ctx, cancel := context.WithTimeout(context.Background(), statsInterval)
+		var err error
+		conns, err = activeConnections(ctx)
+		cancel()
+		// This runs on every stats tick, so a failure is logged once until
+		// the API answers again.
+		connectionsMu.Lock()
+		if err == nil {
+			connectionsFailed = nil
+		} else if connectionsFailed != client {
+			connectionsFailed = client
+			logWarn(GetText("log_connections_fail"), err)
+		}
+		connectionsMu.Unlock()
+	}
+	if len(conns) > maxConnectionMenuItems {
+		conns = conns[:maxConnectionMenuItems]
+	}
+
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	shownConnections = conns
+	if len(conns) == 0 {
+		mNoConnections.Show()
+	} else {
+		mNoConnections.Hide()
+	}
+	for i, c := range conns {
+		title := connectionLabel(c)
+		tooltip := fmt.Sprintf(GetText("connection_tooltip"), c.Metadata.Network)
+		if i == len(connectionItems) {
+			item := mConnections.AddSubMenuItem(title, tooltip)
+			connectionItems = append(connectionItems, item)
+			go func(index int, menuItem *systray.MenuItem) {
+				for {
+					<-menuItem.ClickedCh
+					confirmCloseConnection(index)
+				}
+			}(i, item)
+		}
+		connectionItems[i].SetTitle(title)
+		connectionItems[i].SetTooltip(tooltip)
+		connectionItems[i].Show()
+	}
+	for _, item := range connectionItems[len(conns):] {
+		item.Hide()
+	}
+}
+
+// connectionLabel describes c for the menu, e.g.
+// "chrome.exe → 93.184.216.34:443  ↑ 1.2 KB ↓ 30.5 KB  2m10s".
+func connectionLabel(c connection) string {
+	process := c.Process
+	if process == "" {
+		process = strings.ToUpper(c.Metadata.Network)
+	}
+	return fmt.Sprintf(GetText("connection_entry"), process, c.Metadata.destination(),
+		formatBytes(uint64(c.Upload)), formatBytes(uint64(c.Download)), time.Since(c.Start).Round(time.Second))
+}
+
+// confirmCloseConnection asks before closing the flow shown at index.
+func confirmCloseConnection(index int) {
+	connectionsMu.Lock()
+	if index >= len(shownConnections) {
+		connectionsMu.Unlock()
+		return
+	}
+	c := shownConnections[index]
+	connectionsMu.Unlock()
+
+	if err := zenity.Question(fmt.Sprintf(GetText("close_connection_confirm"), connectionLabel(c)),
+		zenity.Title(GetText("close_connection"))); err != nil {
+		return
+	}
+	if err := closeConnection(c.ID); err != nil {
+		logWarn(GetText("close_connection_fail"), err)
+		zenity.Error(fmt.Sprintf(GetText("close_connection_fail"), err), zenity.Title(GetText("close_connection")))
+		return
+	}
+	updateConnectionsMenu()
+}
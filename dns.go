@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncruces/zenity"
+)
+
+// Ways the DNS forwarder can reach its upstream resolver.
+const (
+	dnsModeProxy = "proxy" // Plain DNS over TCP, through the proxy
+	dnsModeDoH   = "doh"   // DNS over HTTPS (RFC 8484)
+	dnsModeDoT   = "dot"   // DNS over TLS (RFC 7858)
+)
+
+// dnsBlockGroup groups the firewall rules that stop other adapters from
+// sending DNS queries while the forwarder is in use.
+const dnsBlockGroup = "TUNTray DNS Leak Protection"
+
+// dnsDefaultUpstreams is used when no upstream is configured for a mode.
+var dnsDefaultUpstreams = map[string]string{
+	dnsModeProxy: "8.8.8.8:53",
+	dnsModeDoH:   "https://1.1.1.1/dns-query",
+	dnsModeDoT:   "1.1.1.1:853",
+}
+
+// DNSForwarderConfig controls the built-in DNS forwarder. When enabled, the
+// TUN adapter's DNS server is TUNTray itself, listening on the TUN address.
+type DNSForwarderConfig struct {
+	Enabled          bool   `json:"enabled"`
+	Mode             string `json:"mode"`                      // dnsModeProxy, dnsModeDoH or dnsModeDoT
+	Upstream         string `json:"upstream"`                  // host:port, or a URL for DoH
+	TLSServerName    string `json:"tls_server_name,omitempty"` // DoT certificate name; defaults to the upstream host
+	SuppressOtherDNS bool   `json:"suppress_other_dns"`        // Block DNS on every other adapter while connected
+}
+
+// withDefaults fills in the mode and upstream when they are not set.
+func (c DNSForwarderConfig) withDefaults() DNSForwarderConfig {
+	if c.Mode == "" {
+		c.Mode = dnsModeProxy
+	}
+	if c.Upstream == "" {
+		c.Upstream = dnsDefaultUpstreams[c.Mode]
+	}
+	return c
+}
+
+// dnsExchanger sends one DNS query in wire format and returns the response.
+type dnsExchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// newDNSExchanger returns the exchanger for the configured mode, opening its
+// connections with dialer.
+func newDNSExchanger(c DNSForwarderConfig, dialer proxyDialer) (dnsExchanger, error) {
+	c = c.withDefaults()
+	switch c.Mode {
+	case dnsModeProxy, dnsModeDoT:
+		host, _, err := net.SplitHostPort(c.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf(GetTextWithFormat("dns_upstream_invalid"), c.Upstream)
+		}
+		if c.Mode == dnsModeProxy {
+			return &tcpExchanger{addr: c.Upstream, dialer: dialer}, nil
+		}
+		serverName := c.TLSServerName
+		if serverName == "" {
+			serverName = host
+		}
+		return &tlsExchanger{addr: c.Upstream, serverName: serverName, dialer: dialer}, nil
+	case dnsModeDoH:
+		u, err := url.Parse(c.Upstream)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf(GetTextWithFormat("dns_upstream_invalid"), c.Upstream)
+		}
+		return newDoHExchanger(c.Upstream, dialer), nil
+	}
+	return nil, fmt.Errorf(GetTextWithFormat("dns_mode_invalid"), c.Mode)
+}
+
+// tcpExchanger speaks plain DNS over TCP, one connection per query.
+type tcpExchanger struct {
+	addr   string
+	dialer proxyDialer
+}
+
+func (e *tcpExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := e.dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, query)
+}
+
+// tlsExchanger speaks DNS over TLS, one connection per query.
+type tlsExchanger struct {
+	addr       string
+	serverName string
+	dialer     proxyDialer
+}
+
+func (e *tlsExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	raw, err := e.dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: e.serverName})
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return exchangeStream(ctx, conn, query)
+}
+
+// exchangeStream writes a length-prefixed query to conn and reads the
+// length-prefixed response, as DNS over TCP and TLS do.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writeDNSStream(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSStream(conn)
+}
+
+// dohExchanger speaks DNS over HTTPS using POST requests.
+type dohExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHExchanger(endpoint string, dialer proxyDialer) *dohExchanger {
+	return &dohExchanger{
+		url: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		},
+	}
+}
+
+func (e *dohExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// --- DNS messages ---
+//
+// The forwarder passes messages through untouched; it only reads enough of
+// them to answer locally, report errors and respect the client's UDP size.
+
+var errDNSMalformed = errors.New("dns: malformed message")
+
+const (
+	dnsHeaderLen  = 12
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsTypeOPT    = 41
+	dnsRcodeOK    = 0
+	dnsRcodeForm  = 1
+	dnsRcodeFail  = 2
+	dnsDefaultUDP = 512
+)
+
+// dnsQuestion is the single question of a query.
+type dnsQuestion struct {
+	Name string // Lower case, without the trailing dot
+	Type uint16
+}
+
+// parseDNSMessage reads the question of msg and returns it with the offset
+// where the question ends and the largest UDP response the sender accepts.
+func parseDNSMessage(msg []byte) (q dnsQuestion, questionEnd, udpSize int, err error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return q, 0, 0, errDNSMalformed
+	}
+	name, off, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil || off+4 > len(msg) {
+		return q, 0, 0, errDNSMalformed
+	}
+	q = dnsQuestion{Name: strings.ToLower(name), Type: binary.BigEndian.Uint16(msg[off:])}
+	questionEnd = off + 4
+
+	// An OPT record in the additional section advertises a larger UDP size.
+	udpSize = dnsDefaultUDP
+	answers := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:]))
+	records := answers + int(binary.BigEndian.Uint16(msg[10:]))
+	off = questionEnd
+	for i := 0; i < records; i++ {
+		_, o, err := readDNSName(msg, off)
+		if err != nil || o+10 > len(msg) {
+			break
+		}
+		class := int(binary.BigEndian.Uint16(msg[o+2:]))
+		if i >= answers && binary.BigEndian.Uint16(msg[o:]) == dnsTypeOPT && class > udpSize {
+			udpSize = class
+		}
+		off = o + 10 + int(binary.BigEndian.Uint16(msg[o+8:]))
+	}
+	return q, questionEnd, udpSize, nil
+}
+
+// readDNSName reads the possibly compressed name at off and returns it with
+// the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 32; {
+		if off >= len(msg) {
+			break
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case l&0xC0 != 0 || off+1+l > len(msg):
+			return "", 0, errDNSMalformed
+		default:
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errDNSMalformed
+}
+
+// dnsReply builds a response to query from its header and question, with
+// the given response code and answer records.
+func dnsReply(query []byte, questionEnd int, rcode byte, answers [][]byte) []byte {
+	reply := append([]byte(nil), query[:questionEnd]...)
+	reply[2] = 0x80 | query[2]&0x79 // QR, keeping the opcode and RD
+	reply[3] = 0x80 | rcode         // RA
+	questions := uint16(0)
+	if questionEnd > dnsHeaderLen {
+		questions = 1
+	}
+	binary.BigEndian.PutUint16(reply[4:], questions)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	for _, a := range answers {
+		reply = append(reply, a...)
+	}
+	return reply
+}
+
+// dnsARecord returns an A record for ip that refers to the question's name.
+func dnsARecord(ip net.IP, ttl uint32) []byte {
+	record := []byte{0xC0, dnsHeaderLen, 0, dnsTypeA, 0, 1, 0, 0, 0, 0, 0, 4}
+	binary.BigEndian.PutUint32(record[6:], ttl)
+	return append(record, ip.To4()...)
+}
+
+// truncateDNS cuts a response that does not fit in limit bytes down to its
+// question and sets the TC bit, so the client retries over TCP.
+func truncateDNS(resp []byte, limit int) []byte {
+	if len(resp) <= limit {
+		return resp
+	}
+	end := dnsHeaderLen
+	if _, questionEnd, _, err := parseDNSMessage(resp); err == nil {
+		end = questionEnd
+	}
+	t := append([]byte(nil), resp[:end]...)
+	t[2] |= 0x02
+	if end == dnsHeaderLen {
+		binary.BigEndian.PutUint16(t[4:], 0)
+	}
+	binary.BigEndian.PutUint16(t[6:], 0)
+	binary.BigEndian.PutUint16(t[8:], 0)
+	binary.BigEndian.PutUint16(t[10:], 0)
+	return t
+}
+
+func writeDNSStream(w io.Writer, msg []byte) error {
+	framed := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	_, err := w.Write(append(framed, msg...))
+	return err
+}
+
+func readDNSStream(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// --- Forwarder ---
+
+// dnsForwarder answers DNS queries over UDP and TCP by passing them to its
+// exchanger. Names in hosts are answered locally; these are the proxy and
+// upstream host names, which must not depend on the tunnel to resolve.
+// Domains matched by fakeIP, if set, get fake addresses.
+type dnsForwarder struct {
+	exchanger dnsExchanger
+	hosts     map[string][]net.IP
+	fakeIP    *fakeIPResolver
+	udp       net.PacketConn
+	tcp       net.Listener
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// startDNSForwarder listens on addr for UDP and TCP queries until Close.
+func startDNSForwarder(addr string, exchanger dnsExchanger, hosts map[string][]net.IP, fakeIP *fakeIPResolver) (*dnsForwarder, error) {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Use the port actually bound, in case addr asked for any free one.
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	f := &dnsForwarder{exchanger: exchanger, hosts: hosts, fakeIP: fakeIP, udp: udp, tcp: tcp}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.wg.Add(2)
+	go f.serveUDP()
+	go f.serveTCP()
+	return f, nil
+}
+
+// Addr returns the address the forwarder is listening on.
+func (f *dnsForwarder) Addr() string {
+	return f.udp.LocalAddr().String()
+}
+
+// Close stops the forwarder and waits for queries in flight.
+func (f *dnsForwarder) Close() error {
+	f.cancel()
+	f.udp.Close()
+	err := f.tcp.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *dnsForwarder) serveUDP() {
+	defer f.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := f.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			if resp, limit := f.resolve(query); resp != nil {
+				f.udp.WriteTo(truncateDNS(resp, limit), client)
+			}
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.tcp.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			stop := context.AfterFunc(f.ctx, func() { conn.Close() })
+			defer stop()
+			for {
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+				query, err := readDNSStream(conn)
+				if err != nil {
+					return
+				}
+				resp, _ := f.resolve(query)
+				if resp == nil || writeDNSStream(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve answers one query and returns the client's UDP size limit. It
+// returns nil when the query is too broken to answer at all.
+func (f *dnsForwarder) resolve(query []byte) ([]byte, int) {
+	q, questionEnd, udpSize, err := parseDNSMessage(query)
+	if err != nil {
+		if len(query) < dnsHeaderLen {
+			return nil, 0
+		}
+		return dnsReply(query, dnsHeaderLen, dnsRcodeForm, nil), dnsDefaultUDP
+	}
+
+	ips, local := f.hosts[q.Name]
+	local = local && (q.Type == dnsTypeA || q.Type == dnsTypeAAAA)
+	if !local && f.fakeIP != nil {
+		ips, local = f.fakeIP.Resolve(q)
+	}
+	if local {
+		var answers [][]byte
+		if q.Type == dnsTypeA {
+			for _, ip := range ips {
+				answers = append(answers, dnsARecord(ip, 60))
+			}
+		}
+		return dnsReply(query, questionEnd, dnsRcodeOK, answers), udpSize
+	}
+
+	ctx, cancel := context.WithTimeout(f.ctx, 10*time.Second)
+	defer cancel()
+	resp, err := f.exchanger.Exchange(ctx, query)
+	if err != nil || len(resp) < dnsHeaderLen {
+		if f.ctx.Err() == nil {
+			logWarn(GetText("log_dns_upstream_fail"), q.Name, err)
+		}
+		return dnsReply(query, questionEnd, dnsRcodeFail, nil), udpSize
+	}
+	recordDNSAnswers(q.Name, resp)
+	return resp, udpSize
+}
+
+// --- Tunnel integration ---
+
+// startDNSForwarderFor starts the forwarder on the TUN address of profile
+// and, if configured, blocks DNS on the other adapters. startTun calls it
+// after the address is set and before any route points into the tunnel.
+func startDNSForwarderFor(profile Profile) error {
+	mu.RLock()
+	config := appConfig.DNSForwarder.withDefaults()
+	mu.RUnlock()
+
+	exchanger, err := newDNSExchanger(config, dnsUpstreamDialer(profile))
+	if err != nil {
+		return err
+	}
+	hosts := bootstrapHosts(append([]string{profile.Proxy, config.Upstream}, profile.Chain...))
+	var fakeIP *fakeIPResolver
+	if profile.FakeIP.Enabled {
+		matcher, err := newDomainMatcher(profile.FakeIP)
+		if err != nil {
+			return err
+		}
+		pool, err := fakeIPPoolFor(profile)
+		if err != nil {
+			return err
+		}
+		fakeIP = &fakeIPResolver{pool: pool, matcher: matcher}
+	}
+
+	// The new TUN address may not accept binds for a moment.
+	addr := net.JoinHostPort(profile.TunIP, "53")
+	var forwarder *dnsForwarder
+	for attempt := 0; ; attempt++ {
+		if forwarder, err = startDNSForwarder(addr, exchanger, hosts, fakeIP); err == nil {
+			break
+		}
+		if attempt == 10 {
+			return fmt.Errorf(GetTextWithFormat("dns_listen_fail"), addr, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	dnsServer = forwarder
+	log.Printf(GetText("log_dns_listening")+"\n", addr, config.Upstream, config.Mode)
+
+	if config.SuppressOtherDNS {
+		if err := blockOtherDNS(); err != nil {
+			return fmt.Errorf(GetTextWithFormat("dns_block_fail"), err)
+		}
+	}
+	return nil
+}
+
+// dnsUpstreamDialer returns how the forwarder reaches its upstream: through
+// the proxy or chain when TUNTray can dial it itself, otherwise through the
+// tunnel like any other application. It must be called before the TUN
+// routes are added.
+func dnsUpstreamDialer(profile Profile) proxyDialer {
+	hops := profile.Chain
+	if len(hops) == 0 {
+		if u, err := url.Parse(profile.Proxy); err == nil && chainHopSchemes[strings.ToLower(u.Scheme)] {
+			hops = []string{profile.Proxy}
+		}
+	}
+	if len(hops) > 0 {
+		if d, err := newChainDialer(hops, newDirectDialer(detectDirectIP())); err == nil {
+			return d
+		}
+	}
+	log.Println(GetText("log_dns_via_tunnel"))
+	return &net.Dialer{Timeout: 10 * time.Second}
+}
+
+// bootstrapHosts resolves the host names in addresses (URLs or host:port)
+// while the system resolver still works, so the forwarder can answer them
+// without needing the tunnel, which may itself depend on them.
+func bootstrapHosts(addresses []string) map[string][]net.IP {
+	hosts := make(map[string][]net.IP)
+	for _, address := range addresses {
+		host := address
+		if u, err := url.Parse(address); err == nil && u.Host != "" {
+			host = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(address); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == "" || net.ParseIP(host) != nil || hosts[host] != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			logWarn(GetText("log_dns_bootstrap_fail"), host, err)
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				hosts[host] = append(hosts[host], ip)
+			}
+		}
+	}
+	return hosts
+}
+
+// blockOtherDNS adds firewall rules that stop DNS queries (port 53) on every
+// interface but the TUN adapter, so Windows cannot fall back to the ISP's
+// resolver. The state is persisted so the rules are removed after a crash.
+func blockOtherDNS() error {
+	interfaces := outsideInterfaceAliases()
+	if len(interfaces) == 0 {
+		return nil
+	}
+	var script []string
+	script = append(script, "$ErrorActionPreference = 'Stop'",
+		fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue", psQuote(dnsBlockGroup)))
+	for _, protocol := range []string{"UDP", "TCP"} {
+		script = append(script, fmt.Sprintf("New-NetFirewallRule -DisplayName %s -Group %s -Direction Outbound -Action Block -InterfaceAlias %s -Protocol %s -RemotePort 53 | Out-Null",
+			psQuote(dnsBlockGroup+" - "+protocol), psQuote(dnsBlockGroup), strings.Join(interfaces, ","), protocol))
+	}
+
+	mu.Lock()
+	appConfig.DNSBlocked = true
+	saveConfig()
+	mu.Unlock()
+	output, err := hiddenCommand("powershell", "-NoProfile", "-Command", strings.Join(script, "\n")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(GetTextWithFormat("command_exec_fail"), "New-NetFirewallRule", string(output), err)
+	}
+	log.Println(GetText("log_dns_blocked"))
+	return nil
+}
+
+// unblockOtherDNS removes the rules added by blockOtherDNS, if any.
+func unblockOtherDNS() {
+	mu.RLock()
+	blocked := appConfig.DNSBlocked
+	mu.RUnlock()
+	if !blocked {
+		return
+	}
+
+	script := fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue", psQuote(dnsBlockGroup))
+	if output, err := hiddenCommand("powershell", "-NoProfile", "-Command", script).CombinedOutput(); err != nil {
+		logWarn(GetText("dns_unblock_fail"), fmt.Errorf(GetTextWithFormat("command_exec_fail"), "Remove-NetFirewallRule", string(output), err))
+		return
+	}
+	mu.Lock()
+	appConfig.DNSBlocked = false
+	saveConfig()
+	mu.Unlock()
+	log.Println(GetText("log_dns_unblocked"))
+}
+
+// closeDNSForwarder stops the forwarder and lifts the DNS block.
+func closeDNSForwarder() {
+	if dnsServer != nil {
+		dnsServer.Close()
+		dnsServer = nil
+	}
+	unblockOtherDNS()
+}
+
+// configureDNSForwarder asks for the forwarder's mode and upstream.
+func configureDNSForwarder() {
+	mu.RLock()
+	config := appConfig.DNSForwarder.withDefaults()
+	mu.RUnlock()
+
+	modes := []string{dnsModeProxy, dnsModeDoH, dnsModeDoT}
+	labels := make([]string, len(modes))
+	current := ""
+	for i, m := range modes {
+		labels[i] = GetText("dns_mode_" + m)
+		if m == config.Mode {
+			current = labels[i]
+		}
+	}
+	label, err := zenity.List(GetText("dns_mode_prompt"), labels,
+		zenity.Title(GetText("configure_dns")),
+		zenity.DefaultItems(current),
+		zenity.DisallowEmpty())
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	mode := config.Mode
+	for i, l := range labels {
+		if l == label {
+			mode = modes[i]
+		}
+	}
+	upstream := config.Upstream
+	if mode != config.Mode {
+		upstream = dnsDefaultUpstreams[mode]
+	}
+
+	upstream, err = zenity.Entry(fmt.Sprintf(GetText("dns_upstream_prompt"), label),
+		zenity.Title(GetText("configure_dns")),
+		zenity.EntryText(upstream))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	config.Mode, config.Upstream = mode, strings.TrimSpace(upstream)
+	if _, err := newDNSExchanger(config, &net.Dialer{}); err != nil {
+		zenity.Warning(err.Error(), zenity.Title(GetText("input_invalid")))
+		return
+	}
+
+	mu.Lock()
+	if mode != appConfig.DNSForwarder.Mode {
+		appConfig.DNSForwarder.TLSServerName = ""
+	}
+	appConfig.DNSForwarder.Mode, appConfig.DNSForwarder.Upstream = config.Mode, config.Upstream
+	saveConfig()
+	mu.Unlock()
+
+	log.Printf(GetText("log_dns_updated")+"\n", config.Upstream, config.Mode)
+	if tunnelRunning() {
+		zenity.Info(GetText("dns_next_start"), zenity.Title(GetText("configure_dns")))
+	}
+}
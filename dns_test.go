@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubExchanger stands in for the upstream resolver, answering every query
+// with answers A records starting at 192.0.2.1.
+type stubExchanger struct {
+	answers int
+	err     error
+	queries atomic.Int32
+}
+
+func (e *stubExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	e.queries.Add(1)
+	if e.err != nil {
+		return nil, e.err
+	}
+	_, questionEnd, _, err := parseDNSMessage(query)
+	if err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	for i := 0; i < e.answers; i++ {
+		records = append(records, dnsARecord(net.IPv4(192, 0, 2, byte(1+i)), 300))
+	}
+	return dnsReply(query, questionEnd, dnsRcodeOK, records), nil
+}
+
+// dnsQuery builds a query for name. A udpSize above 512 adds an OPT record
+// advertising it.
+func dnsQuery(id uint16, name string, qtype uint16, udpSize int) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+	if udpSize > dnsDefaultUDP {
+		binary.BigEndian.PutUint16(msg[10:], 1)
+		msg = append(msg, 0) // Root name
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(udpSize))
+		msg = append(msg, 0, 0, 0, 0, 0, 0) // TTL and RDLENGTH
+	}
+	return msg
+}
+
+// dnsResponse is the part of a response the tests check.
+type dnsResponse struct {
+	ID        uint16
+	Truncated bool
+	Rcode     byte
+	Answers   []net.IP
+}
+
+func parseDNSResponse(t *testing.T, msg []byte) dnsResponse {
+	t.Helper()
+	_, off, _, err := parseDNSMessage(msg)
+	if err != nil {
+		t.Fatalf("malformed response: %v", err)
+	}
+	r := dnsResponse{
+		ID:        binary.BigEndian.Uint16(msg[0:]),
+		Truncated: msg[2]&0x02 != 0,
+		Rcode:     msg[3] & 0x0F,
+	}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		_, o, err := readDNSName(msg, off)
+		if err != nil || o+10 > len(msg) {
+			t.Fatalf("malformed answer %d", i)
+		}
+		length := int(binary.BigEndian.Uint16(msg[o+8:]))
+		if binary.BigEndian.Uint16(msg[o:]) == dnsTypeA && length == 4 {
+			r.Answers = append(r.Answers, net.IP(msg[o+10:o+14]))
+		}
+		off = o + 10 + length
+	}
+	return r
+}
+
+func startTestForwarder(t *testing.T, exchanger dnsExchanger, hosts map[string][]net.IP) *dnsForwarder {
+	t.Helper()
+	f, err := startDNSForwarder("127.0.0.1:0", exchanger, hosts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func queryUDP(t *testing.T, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestDNSForwarderUDP(t *testing.T) {
+	upstream := &stubExchanger{answers: 1}
+	f := startTestForwarder(t, upstream, nil)
+
+	r := parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(0x1234, "example.com", dnsTypeA, 0)))
+	if r.ID != 0x1234 {
+		t.Errorf("ID %#x, want 0x1234", r.ID)
+	}
+	if r.Rcode != dnsRcodeOK || len(r.Answers) != 1 || !r.Answers[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got rcode %d, answers %v; want 192.0.2.1", r.Rcode, r.Answers)
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want once", n)
+	}
+}
+
+func TestDNSForwarderTCP(t *testing.T) {
+	f := startTestForwarder(t, &stubExchanger{answers: 2}, nil)
+
+	conn, err := net.Dial("tcp", f.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Several queries may share a connection.
+	for id := uint16(1); id <= 2; id++ {
+		if err := writeDNSStream(conn, dnsQuery(id, "example.com", dnsTypeA, 0)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readDNSStream(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := parseDNSResponse(t, resp)
+		if r.ID != id || len(r.Answers) != 2 {
+			t.Errorf("query %d: got ID %d with %d answers, want 2", id, r.ID, len(r.Answers))
+		}
+	}
+}
+
+func TestDNSForwarderTruncates(t *testing.T) {
+	// 64 A records take over 1000 bytes.
+	f := startTestForwarder(t, &stubExchanger{answers: 64}, nil)
+
+	r := parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(1, "big.example", dnsTypeA, 0)))
+	if !r.Truncated || len(r.Answers) != 0 {
+		t.Errorf("plain UDP: truncated %v with %d answers, want the TC bit and none", r.Truncated, len(r.Answers))
+	}
+
+	r = parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(2, "big.example", dnsTypeA, 4096)))
+	if r.Truncated || len(r.Answers) != 64 {
+		t.Errorf("EDNS0 UDP: truncated %v with %d answers, want all 64", r.Truncated, len(r.Answers))
+	}
+
+	conn, err := net.Dial("tcp", f.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeDNSStream(conn, dnsQuery(3, "big.example", dnsTypeA, 0))
+	resp, err := readDNSStream(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := parseDNSResponse(t, resp); r.Truncated || len(r.Answers) != 64 {
+		t.Errorf("TCP: truncated %v with %d answers, want all 64", r.Truncated, len(r.Answers))
+	}
+}
+
+func TestDNSForwarderHosts(t *testing.T) {
+	upstream := &stubExchanger{answers: 1}
+	proxyIP := net.IPv4(203, 0, 113, 5)
+	f := startTestForwarder(t, upstream, map[string][]net.IP{"proxy.example": {proxyIP}})
+
+	r := parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(1, "Proxy.Example", dnsTypeA, 0)))
+	if r.Rcode != dnsRcodeOK || len(r.Answers) != 1 || !r.Answers[0].Equal(proxyIP) {
+		t.Errorf("A: got rcode %d, answers %v; want %v", r.Rcode, r.Answers, proxyIP)
+	}
+	// Without an IPv6 address the name still exists, with no AAAA records.
+	r = parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(2, "proxy.example", dnsTypeAAAA, 0)))
+	if r.Rcode != dnsRcodeOK || len(r.Answers) != 0 {
+		t.Errorf("AAAA: got rcode %d, answers %v; want an empty answer", r.Rcode, r.Answers)
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Errorf("upstream asked %d times for a hosts name, want never", n)
+	}
+}
+
+func TestDNSForwarderUpstreamFailure(t *testing.T) {
+	f := startTestForwarder(t, &stubExchanger{err: errors.New("unreachable")}, nil)
+
+	r := parseDNSResponse(t, queryUDP(t, f.Addr(), dnsQuery(1, "example.com", dnsTypeA, 0)))
+	if r.Rcode != dnsRcodeFail {
+		t.Errorf("rcode %d, want SERVFAIL", r.Rcode)
+	}
+}
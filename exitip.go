@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/getlantern/systray"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// While connected, the tray shows the external address the tunnel exits
+// from, looked up through the tunnel, with its country when a GeoIP
+// database is at hand.
+
+const defaultExternalIPURL = "https://api.ipify.org"
+
+// ExternalIPConfig controls the external IP lookup.
+type ExternalIPConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url,omitempty"`            // Answers with a bare address; defaults to defaultExternalIPURL
+	GeoIP   string `json:"geoip_database,omitempty"` // MMDB file for the country; defaults to GeoIPDatabase
+}
+
+// defaultExternalIP is used for configs written before the lookup existed.
+var defaultExternalIP = ExternalIPConfig{Enabled: true}
+
+// externalIPEndpointLocked returns the configured lookup URL. Callers must
+// hold mu.
+func externalIPEndpointLocked() string {
+	if appConfig.ExternalIP.URL != "" {
+		return appConfig.ExternalIP.URL
+	}
+	return defaultExternalIPURL
+}
+
+// exitInfo is the tunnel's external address.
+type exitInfo struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"` // ISO code, if a GeoIP database is available
+}
+
+var (
+	exitMu     sync.Mutex
+	exitAddr   *exitInfo // Nil until looked up
+	exitErr    error     // Why the last lookup failed
+	exitLookup int       // Incremented per lookup, so stale answers are dropped
+	exitBusy   bool
+)
+
+// currentExit returns the tunnel's external address, if known.
+func currentExit() *exitInfo {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	if exitAddr == nil {
+		return nil
+	}
+	info := *exitAddr
+	return &info
+}
+
+// exitStateChanged looks the address up when the tunnel comes up and
+// forgets it when the tunnel goes down. It is called by setState. A proxy
+// selected while connected only takes effect when the tunnel next comes
+// up, so this also refreshes the address after a switch.
+func exitStateChanged(prev, s tunnelState) {
+	if s.connected() && !prev.connected() {
+		refreshExit()
+	} else if prev.connected() && !s.connected() {
+		exitMu.Lock()
+		exitAddr, exitErr, exitBusy = nil, nil, false
+		exitLookup++
+		exitMu.Unlock()
+		updateExitMenu()
+	}
+}
+
+// refreshExit looks the external address up in the background. It must
+// run on the main event loop.
+func refreshExit() {
+	mu.RLock()
+	config := appConfig.ExternalIP
+	endpoint := externalIPEndpointLocked()
+	geoipPath := config.GeoIP
+	if geoipPath == "" {
+		geoipPath = appConfig.GeoIPDatabase
+	}
+	profile := runningProfile
+	mu.RUnlock()
+	// An operation in progress may be tearing the tunnel down.
+	if !config.Enabled || activeOp != nil {
+		return
+	}
+	if geoipPath == "" {
+		geoipPath = defaultGeoIPDatabase
+	}
+
+	dns := configuredDNS(profile)
+
+	exitMu.Lock()
+	exitLookup++
+	lookup := exitLookup
+	exitBusy = true
+	exitMu.Unlock()
+	updateExitMenu()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestStepTimeout)
+		defer cancel()
+		dialer, resolver := tunnelNet(profile, dns)
+		addr, err := lookupExternalIP(ctx, tunnelHTTPClient(dialer, resolver), endpoint)
+		var info *exitInfo
+		if err == nil {
+			info = &exitInfo{IP: addr, Country: lookupCountry(geoipPath, net.ParseIP(addr))}
+			log.Printf(GetText("log_exit_ip")+"\n", info.label())
+		} else {
+			logWarn(GetText("log_exit_ip_fail"), err)
+		}
+
+		exitMu.Lock()
+		if lookup != exitLookup {
+			exitMu.Unlock()
+			return // The tunnel went down or a newer lookup started
+		}
+		exitAddr, exitErr, exitBusy = info, err, false
+		exitMu.Unlock()
+		updateTooltip()
+		updateExitMenu()
+	}()
+}
+
+// lookupCountry returns the country of ip from the MMDB file at path, or
+// "" if the file is missing or does not know ip.
+func lookupCountry(path string, ip net.IP) string {
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		logWarn(GetText("geoip_open_fail"), path, err)
+		return ""
+	}
+	defer db.Close()
+	return countryOf(db, ip)
+}
+
+// label renders the address for display, e.g. "203.0.113.7 (DE)".
+func (e *exitInfo) label() string {
+	if e.Country == "" {
+		return e.IP
+	}
+	return fmt.Sprintf("%s (%s)", e.IP, e.Country)
+}
+
+// exitTooltip is the tooltip line for the external address, if known.
+func exitTooltip() string {
+	if info := currentExit(); info != nil {
+		return fmt.Sprintf(GetText("exit_ip"), info.label())
+	}
+	return ""
+}
+
+// --- Tray ---
+
+var mExitIP *systray.MenuItem
+
+// addExitMenu adds the external IP status item. Clicking it looks the
+// address up again.
+func addExitMenu() {
+	mExitIP = systray.AddMenuItem("", GetText("exit_ip_tooltip"))
+	updateExitMenu()
+}
+
+// refreshExitMenuTexts relabels the item after a language switch.
+func refreshExitMenuTexts() {
+	if mExitIP == nil {
+		return
+	}
+	mExitIP.SetTooltip(GetText("exit_ip_tooltip"))
+	updateExitMenu()
+}
+
+// updateExitMenu shows the address, or why it is not known.
+func updateExitMenu() {
+	if mExitIP == nil {
+		return
+	}
+	exitMu.Lock()
+	info, err, busy := exitAddr, exitErr, exitBusy
+	exitMu.Unlock()
+	s, _ := currentState()
+	var status string
+	switch {
+	case !s.connected():
+		status = GetText("stats_not_connected")
+	case busy:
+		status = GetText("exit_ip_checking")
+	case info != nil:
+		status = info.label()
+	case err != nil:
+		status = GetText("exit_ip_unknown")
+	default:
+		status = GetText("exit_ip_disabled")
+	}
+	mExitIP.SetTitle(fmt.Sprintf(GetText("exit_ip"), status))
+	if s.connected() {
+		mExitIP.Enable()
+	} else {
+		mExitIP.Disable()
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultFakeIPRange is reserved for benchmarking (RFC 2544), so it never
+// collides with real destinations.
+const defaultFakeIPRange = "198.18.0.0/15"
+
+// FakeIPConfig turns on fake-IP DNS for a profile: matched domains resolve to
+// addresses from Range, and only that range (plus any explicit profile
+// routes) is sent into the tunnel. Everything else goes direct.
+type FakeIPConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Range         string   `json:"range,omitempty"`          // Defaults to defaultFakeIPRange
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`  // "github.com" matches it and all subdomains
+	DomainKeyword []string `json:"domain_keyword,omitempty"` // Substring of the domain
+	DomainRegex   []string `json:"domain_regex,omitempty"`   // Go regular expression for the whole domain
+}
+
+// FakeRange returns the configured range or the default one.
+func (c FakeIPConfig) FakeRange() string {
+	if c.Range == "" {
+		return defaultFakeIPRange
+	}
+	return c.Range
+}
+
+// domainMatcher decides which domains get fake IPs.
+type domainMatcher struct {
+	suffixes []string
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func newDomainMatcher(c FakeIPConfig) (*domainMatcher, error) {
+	m := &domainMatcher{}
+	for _, s := range c.DomainSuffix {
+		if s = strings.ToLower(strings.Trim(strings.TrimSpace(s), ".")); s != "" {
+			m.suffixes = append(m.suffixes, s)
+		}
+	}
+	for _, k := range c.DomainKeyword {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			m.keywords = append(m.keywords, k)
+		}
+	}
+	for _, expr := range c.DomainRegex {
+		// The expression must match the whole domain, not just part of it.
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf(GetTextWithFormat("fake_ip_regex_invalid"), expr, err)
+		}
+		m.regexps = append(m.regexps, re)
+	}
+	return m, nil
+}
+
+// Match reports whether domain (lower case, no trailing dot) is matched.
+func (m *domainMatcher) Match(domain string) bool {
+	for _, s := range m.suffixes {
+		if domain == s || strings.HasSuffix(domain, "."+s) {
+			return true
+		}
+	}
+	for _, k := range m.keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeIPPool hands out addresses from a range and remembers which domain
+// each one stands for. Addresses are allocated in a ring; once the range is
+// exhausted, the oldest mapping is reused.
+type fakeIPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	first    uint32 // First usable address
+	size     uint32 // Number of usable addresses
+	next     uint32 // Offset of the next address to hand out
+	byDomain map[string]uint32
+	byIP     map[uint32]string
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil || network.IP.To4() == nil {
+		return nil, fmt.Errorf(GetTextWithFormat("fake_ip_range_invalid"), cidr)
+	}
+	ones, _ := network.Mask.Size()
+	if ones > 30 {
+		return nil, fmt.Errorf(GetTextWithFormat("fake_ip_range_invalid"), cidr)
+	}
+	// Skip the network and broadcast addresses.
+	return &fakeIPPool{
+		network:  network,
+		first:    binary.BigEndian.Uint32(network.IP.To4()) + 1,
+		size:     uint32(1)<<(32-ones) - 2,
+		byDomain: make(map[string]uint32),
+		byIP:     make(map[uint32]string),
+	}, nil
+}
+
+// String returns the pool's range in CIDR notation.
+func (p *fakeIPPool) String() string {
+	return p.network.String()
+}
+
+// Lookup returns the fake IP for domain, allocating one if needed.
+func (p *fakeIPPool) Lookup(domain string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip, ok := p.byDomain[domain]; ok {
+		return uint32ToIP(ip)
+	}
+	ip := p.first + p.next
+	p.next = (p.next + 1) % p.size
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byDomain[domain] = ip
+	p.byIP[ip] = domain
+	return uint32ToIP(ip)
+}
+
+// Domain returns the domain a fake IP was handed out for.
+func (p *fakeIPPool) Domain(ip net.IP) (string, bool) {
+	v4 := ip.To4()
+	if v4 == nil || !p.network.Contains(v4) {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[binary.BigEndian.Uint32(v4)]
+	return domain, ok
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// fakeIPResolver answers the DNS forwarder's queries for matched domains.
+type fakeIPResolver struct {
+	pool    *fakeIPPool
+	matcher *domainMatcher
+}
+
+// Resolve returns the fake addresses for q, and false if q is not matched.
+// AAAA queries for matched domains get an empty answer so clients use IPv4.
+func (r *fakeIPResolver) Resolve(q dnsQuestion) ([]net.IP, bool) {
+	if (q.Type != dnsTypeA && q.Type != dnsTypeAAAA) || !r.matcher.Match(q.Name) {
+		return nil, false
+	}
+	if q.Type == dnsTypeAAAA {
+		return nil, true
+	}
+	return []net.IP{r.pool.Lookup(q.Name)}, true
+}
+
+// fakeIPDialer turns connections to fake IPs back into connections to the
+// domain they stand for, so the proxy resolves the real name.
+type fakeIPDialer struct {
+	pool    *fakeIPPool
+	forward proxyDialer
+}
+
+func (d *fakeIPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && d.pool.network.Contains(ip) {
+		domain, ok := d.pool.Domain(ip)
+		if !ok {
+			return nil, fmt.Errorf(GetTextWithFormat("fake_ip_unknown"), host)
+		}
+		address = net.JoinHostPort(domain, port)
+	}
+	return d.forward.DialContext(ctx, network, address)
+}
+
+// fakeIPs is the pool of the running tunnel, or nil when fake-IP mode is
+// off. It is kept across restarts of the tunnel with the same range, since
+// applications may still hold addresses from it.
+var fakeIPs *fakeIPPool
+
+// fakeIPPoolFor returns the pool for profile, reusing the current one when
+// the range has not changed.
+func fakeIPPoolFor(profile Profile) (*fakeIPPool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if fakeIPs != nil && fakeIPs.String() == profile.FakeIP.FakeRange() {
+		return fakeIPs, nil
+	}
+	pool, err := newFakeIPPool(profile.FakeIP.FakeRange())
+	if err != nil {
+		return nil, err
+	}
+	fakeIPs = pool
+	return pool, nil
+}
+
+var ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+
+// annotateFakeIPs appends the domain to every fake IP in line, for logs.
+func annotateFakeIPs(line string) string {
+	mu.RLock()
+	pool := fakeIPs
+	mu.RUnlock()
+	if pool == nil {
+		return line
+	}
+	return ipv4Pattern.ReplaceAllStringFunc(line, func(s string) string {
+		if domain, ok := pool.Domain(net.ParseIP(s)); ok {
+			return s + "(" + domain + ")"
+		}
+		return s
+	})
+}
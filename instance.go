@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Only one TUNTray may own the adapter, tun2socks and config.json. The
+// first instance holds a named mutex and serves the control API on a
+// private loopback port recorded in instanceFile; later launches forward
+// their arguments there and exit.
+const (
+	instanceMutexName = `Global\TUNTray`
+	instanceFile      = "TUNTray.instance"
+)
+
+var procCreateMutexW = kernel32.NewProc("CreateMutexW")
+
+var (
+	instanceMutex  uintptr      // Held for the life of the process
+	instanceServer *http.Server // Private endpoint for other instances, or nil
+	pendingLaunch  launchArgs   // Arguments the tray was started with
+)
+
+// acquireInstanceLock reports whether this is the only running instance.
+// If the mutex cannot be created at all, the instance is allowed to run.
+func acquireInstanceLock() bool {
+	name, _ := syscall.UTF16PtrFromString(instanceMutexName)
+	handle, _, err := procCreateMutexW.Call(0, 0, uintptr(unsafe.Pointer(name)))
+	if handle == 0 {
+		logWarn(GetText("instance_lock_fail"), err)
+		return true
+	}
+	if errors.Is(err, syscall.ERROR_ALREADY_EXISTS) {
+		syscall.CloseHandle(syscall.Handle(handle))
+		return false
+	}
+	instanceMutex = handle
+	return true
+}
+
+// instanceInfo is the content of instanceFile.
+type instanceInfo struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+// instanceFilePath returns where instanceFile lives: next to the
+// executable, whatever directory TUNTray was started from.
+func instanceFilePath() string {
+	if exe, err := os.Executable(); err == nil {
+		return filepath.Join(filepath.Dir(exe), instanceFile)
+	}
+	return instanceFile
+}
+
+// startInstanceEndpoint serves the control API to other instances on a
+// random loopback port with a fresh token, whether or not the user enabled
+// the API.
+func startInstanceEndpoint() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logWarn(GetText("instance_listen_fail"), err)
+		return
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		logWarn(GetText("instance_listen_fail"), err)
+		listener.Close()
+		return
+	}
+	info := instanceInfo{Addr: listener.Addr().String(), Token: hex.EncodeToString(token)}
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(instanceFilePath(), data, 0600); err != nil {
+		logWarn(GetText("instance_listen_fail"), err)
+		listener.Close()
+		return
+	}
+
+	instanceServer = &http.Server{
+		Handler:           apiAuth(info.Token, newAPIHandler()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go instanceServer.Serve(listener)
+}
+
+// stopInstanceEndpoint shuts the endpoint down and removes instanceFile.
+func stopInstanceEndpoint() {
+	if instanceServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	instanceServer.Shutdown(ctx)
+	instanceServer = nil
+	os.Remove(instanceFilePath())
+}
+
+// readInstanceInfo returns the endpoint of the running instance, if any.
+func readInstanceInfo() (instanceInfo, bool) {
+	var info instanceInfo
+	data, err := os.ReadFile(instanceFilePath())
+	if err != nil || json.Unmarshal(data, &info) != nil || info.Addr == "" {
+		return info, false
+	}
+	return info, true
+}
+
+// --- Launch arguments ---
+
+// launchArgs are the options accepted when starting the tray, e.g.
+// "TUNTray --start --proxy socks5://127.0.0.1:1080".
+type launchArgs struct {
+	Start   bool
+	Stop    bool
+	Proxy   string
+	Profile string
+}
+
+func (a launchArgs) empty() bool {
+	return a == launchArgs{}
+}
+
+// args turns a back into command line arguments.
+func (a launchArgs) args() []string {
+	var args []string
+	if a.Start {
+		args = append(args, "--start")
+	}
+	if a.Stop {
+		args = append(args, "--stop")
+	}
+	if a.Proxy != "" {
+		args = append(args, "--proxy", a.Proxy)
+	}
+	if a.Profile != "" {
+		args = append(args, "--profile", a.Profile)
+	}
+	return args
+}
+
+func parseLaunchArgs(args []string) (launchArgs, error) {
+	var a launchArgs
+	flags := flag.NewFlagSet("TUNTray", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&a.Start, "start", false, "start the tunnel")
+	flags.BoolVar(&a.Stop, "stop", false, "stop the tunnel")
+	flags.StringVar(&a.Proxy, "proxy", "", "proxy URL to select, added if new")
+	flags.StringVar(&a.Profile, "profile", "", "profile to select")
+	if err := flags.Parse(args); err != nil {
+		return launchArgs{}, err
+	}
+	return a, nil
+}
+
+// applyLaunchArgs carries out launch options on the main event loop. It
+// returns the start or stop operation, if it began one.
+func applyLaunchArgs(a launchArgs) (*tunnelOp, error) {
+	if a.Stop {
+		if !tunnelRunning() {
+			return nil, nil
+		}
+		return handleStop(), nil
+	}
+	if (a.Profile != "" || a.Proxy != "") && tunnelRunning() {
+		return nil, errTunnelRunning
+	}
+	if a.Profile != "" {
+		mu.RLock()
+		found := findProfileLocked(a.Profile) != nil
+		mu.RUnlock()
+		if !found {
+			return nil, &apiError{http.StatusNotFound, fmt.Errorf(GetTextWithFormat("cli_unknown_profile"), a.Profile)}
+		}
+		setProfile(a.Profile)
+	}
+	if a.Proxy != "" {
+		if !hasProxy(a.Proxy) {
+			mu.Lock()
+			err := validateProxy(a.Proxy)
+			if err == nil {
+				addProxyLocked(a.Proxy)
+			}
+			mu.Unlock()
+			if err != nil {
+				return nil, &apiError{http.StatusBadRequest, err}
+			}
+		}
+		setProxy(a.Proxy)
+	}
+	if a.Start && (!tunnelRunning() || activeOp != nil) {
+		return handleStart(), nil
+	}
+	return nil, nil
+}
+
+// forwardLaunch hands this launch's arguments to the running instance.
+func forwardLaunch(args []string) error {
+	client := newInstanceClient()
+	if client == nil {
+		return errors.New(GetText("instance_unreachable"))
+	}
+	return client.do(http.MethodPost, "/api/launch", map[string][]string{"args": args}, nil)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ncruces/zenity"
+)
+
+// killSwitchGroup groups the Windows Firewall rules owned by the kill switch
+// so they can be removed in one go, even after a crash.
+const killSwitchGroup = "TUNTray Kill Switch"
+
+// killSwitchLAN lists the destinations that stay reachable outside the tunnel
+// while the kill switch is engaged.
+var killSwitchLAN = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+}
+
+// engageKillSwitch blocks outbound traffic meant for the tunnel on the
+// physical interfaces, except to the LAN, the proxy servers and what the
+// routing rules send DIRECT, so that nothing falls back to the real
+// connection if the tunnel drops. With a full tunnel that is all traffic;
+// with split routes only the routed ranges. Traffic routed into the TUN
+// adapter is unaffected. Engaging again refreshes the rules.
+func engageKillSwitch(profile Profile) error {
+	mu.RLock()
+	rules := routingRulesLocked()
+	mu.RUnlock()
+	if err := killSwitchConflict(profile.AppRouting, rules); err != nil {
+		return err
+	}
+	allowed, err := killSwitchExceptions(profile, rules)
+	if err != nil {
+		return err
+	}
+
+	interfaces := outsideInterfaceAliases()
+	if len(interfaces) == 0 {
+		return errors.New(GetText("kill_switch_no_interfaces"))
+	}
+
+	routes := profile.TunnelRoutes()
+	var blocked []string
+	for _, r := range subtractIPv4(routes, allowed) {
+		blocked = append(blocked, psQuote(r))
+	}
+	// Block rules win over allow rules in Windows Firewall, so listing the
+	// blocked ranges explicitly also covers applications with their own
+	// outbound allow rules. For IPv6, which is only tunnelled with a full
+	// tunnel, only global unicast is blocked; that leaves link-local and
+	// multicast for the LAN.
+	lines := []string{
+		"$ErrorActionPreference = 'Stop'",
+		fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue", psQuote(killSwitchGroup)),
+	}
+	if len(blocked) > 0 {
+		lines = append(lines, fmt.Sprintf("New-NetFirewallRule -DisplayName %s -Group %s -Direction Outbound -Action Block -InterfaceAlias %s -RemoteAddress %s | Out-Null",
+			psQuote(killSwitchGroup+" - IPv4"), psQuote(killSwitchGroup), strings.Join(interfaces, ","), strings.Join(blocked, ",")))
+	}
+	if slices.Contains(routes, "0.0.0.0/0") {
+		lines = append(lines, fmt.Sprintf("New-NetFirewallRule -DisplayName %s -Group %s -Direction Outbound -Action Block -InterfaceAlias %s -RemoteAddress '2000::/3' | Out-Null",
+			psQuote(killSwitchGroup+" - IPv6"), psQuote(killSwitchGroup), strings.Join(interfaces, ",")))
+	}
+	lines = append(lines, "if (Get-NetFirewallProfile | Where-Object { -not $_.Enabled }) { Write-Output 'disabled' }")
+	script := strings.Join(lines, "\n")
+	output, err := hiddenCommand("powershell", "-NoProfile", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(GetTextWithFormat("command_exec_fail"), "New-NetFirewallRule", string(output), err)
+	}
+	if strings.Contains(string(output), "disabled") {
+		log.Println(GetText("kill_switch_firewall_off"))
+	}
+
+	mu.Lock()
+	if !appConfig.KillSwitchEngaged {
+		appConfig.KillSwitchEngaged = true
+		saveConfig()
+	}
+	updateKillSwitchMenuLocked()
+	mu.Unlock()
+
+	log.Printf(GetText("log_kill_switch_engaged")+"\n", strings.Join(allowed, ", "))
+	return nil
+}
+
+// liftKillSwitch removes the kill switch rules. Only explicit user actions
+// (Stop, Quit, Release Kill Switch) may call it.
+func liftKillSwitch() error {
+	mu.RLock()
+	engaged := appConfig.KillSwitchEngaged
+	mu.RUnlock()
+	if !engaged {
+		return nil
+	}
+
+	script := fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue", psQuote(killSwitchGroup))
+	if output, err := hiddenCommand("powershell", "-NoProfile", "-Command", script).CombinedOutput(); err != nil {
+		return fmt.Errorf(GetTextWithFormat("command_exec_fail"), "Remove-NetFirewallRule", string(output), err)
+	}
+
+	mu.Lock()
+	appConfig.KillSwitchEngaged = false
+	saveConfig()
+	updateKillSwitchMenuLocked()
+	mu.Unlock()
+
+	log.Println(GetText("log_kill_switch_lifted"))
+	return nil
+}
+
+// routingRulesLocked returns the routing rules in effect, or nil without
+// rule routing. Callers must hold mu.
+func routingRulesLocked() []routingRule {
+	if !appConfig.RuleRouting {
+		return nil
+	}
+	var rules []routingRule
+	for _, line := range appConfig.RoutingRules {
+		// startTun refuses invalid rules, so they cannot be in effect.
+		if r, ok, err := parseRoutingRule(line); ok && err == nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// killSwitchConflict explains why the kill switch cannot be used together
+// with per-app routing or rules, or returns nil. Both send traffic outside
+// the tunnel by design to destinations that are not known in advance: with
+// per-app routing every program not selected, and with DIRECT rules for
+// domains, countries or MATCH, TUNTray itself, which the firewall cannot
+// exempt from a block rule.
+func killSwitchConflict(appRouting bool, rules []routingRule) error {
+	if appRouting {
+		return errors.New(GetText("kill_switch_app_routing"))
+	}
+	for _, r := range rules {
+		if r.Target == ruleTargetDirect && r.Type != "IP-CIDR" && r.Type != "IP-CIDR6" {
+			return fmt.Errorf(GetTextWithFormat("kill_switch_rule_direct"), r.Line)
+		}
+	}
+	return nil
+}
+
+// killSwitchExceptions returns the IPv4 networks that stay reachable: the
+// LAN, any user-configured exceptions, the addresses of the server
+// tun2socks (or the chain) dials first, the networks rules send DIRECT and
+// the servers of the proxies rules name.
+func killSwitchExceptions(profile Profile, rules []routingRule) ([]string, error) {
+	allowed := append([]string(nil), killSwitchLAN...)
+	server := profile.Proxy
+	if len(profile.Chain) > 0 {
+		server = profile.Chain[0]
+	}
+	servers := []string{server}
+	mu.RLock()
+	allowed = append(allowed, appConfig.KillSwitchAllow...)
+	for _, r := range rules {
+		switch r.Target {
+		case ruleTargetDirect:
+			if r.cidr != nil && r.cidr.IP.To4() != nil {
+				allowed = append(allowed, r.cidr.String())
+			}
+		case ruleTargetReject, ruleTargetProxy:
+		default:
+			if addr, ok := findNamedProxyLocked(r.Target); ok {
+				servers = append(servers, addr)
+			}
+		}
+	}
+	mu.RUnlock()
+
+	for _, server := range servers {
+		cidrs, err := proxyServerCIDRs(server)
+		if err != nil {
+			return nil, err
+		}
+		allowed = append(allowed, cidrs...)
+	}
+	return allowed, nil
+}
+
+// proxyServerCIDRs returns the IPv4 addresses of the server of proxy URL
+// server, as /32 networks.
+func proxyServerCIDRs(server string) ([]string, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), server)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if ip.IsLoopback() {
+			// A local proxy client reaches its own servers over the physical
+			// interface; those must be listed in kill_switch_allow.
+			log.Println(GetText("kill_switch_local_proxy"))
+		} else if ip.To4() != nil {
+			return []string{ip.String() + "/32"}, nil
+		}
+		return nil, nil
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf(GetTextWithFormat("kill_switch_resolve_fail"), u.Hostname(), err)
+	}
+	var cidrs []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			cidrs = append(cidrs, ip.String()+"/32")
+		}
+	}
+	return cidrs, nil
+}
+
+// ipv4Span is a range of IPv4 addresses, inclusive.
+type ipv4Span struct{ start, end uint64 }
+
+// ipv4Spans returns the IPv4 networks among cidrs as spans, sorted by start.
+func ipv4Spans(cidrs []string) []ipv4Span {
+	var spans []ipv4Span
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+		start := uint64(binary.BigEndian.Uint32(ipNet.IP.To4()))
+		ones, _ := ipNet.Mask.Size()
+		spans = append(spans, ipv4Span{start, start + 1<<(32-ones) - 1})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	return spans
+}
+
+// subtractIPv4 returns the IPv4 ranges ("a-b") covered by include but not
+// by exclude.
+func subtractIPv4(include, exclude []string) []string {
+	ipString := func(v uint64) string {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return net.IP(b).String()
+	}
+	excluded := ipv4Spans(exclude)
+	var ranges []string
+	next := uint64(0)
+	for _, in := range ipv4Spans(include) {
+		if in.start > next {
+			next = in.start
+		}
+		for _, ex := range excluded {
+			if ex.end < next || ex.start > in.end {
+				continue
+			}
+			if ex.start > next {
+				ranges = append(ranges, ipString(next)+"-"+ipString(ex.start-1))
+			}
+			next = ex.end + 1
+		}
+		if next <= in.end {
+			ranges = append(ranges, ipString(next)+"-"+ipString(in.end))
+			next = in.end + 1
+		}
+	}
+	return ranges
+}
+
+// outsideInterfaceAliases returns the quoted aliases of every interface
+// except the TUN adapter and loopback, for use in firewall rules.
+func outsideInterfaceAliases() []string {
+	var aliases []string
+	if list, err := net.Interfaces(); err == nil {
+		for _, i := range list {
+			if i.Name != tunAlias && i.Flags&net.FlagLoopback == 0 {
+				aliases = append(aliases, psQuote(i.Name))
+			}
+		}
+	}
+	return aliases
+}
+
+// psQuote quotes s as a PowerShell single-quoted string.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// toggleKillSwitch flips the Kill Switch option, engaging or lifting it
+// right away while connected. Turning it on is refused, with the reason,
+// while a routing mode sends traffic outside the tunnel by design.
+func toggleKillSwitch() {
+	if !mKillSwitch.Checked() {
+		running := tunnelRunning()
+		mu.RLock()
+		appRouting := appConfig.AppRouting && len(appConfig.AppRules) > 0
+		if running {
+			appRouting = runningProfile.AppRouting
+		}
+		err := killSwitchConflict(appRouting, routingRulesLocked())
+		mu.RUnlock()
+		if err != nil {
+			zenity.Warning(err.Error(), zenity.Title(GetText("kill_switch")))
+			return
+		}
+	}
+
+	toggleSetting(mKillSwitch, &appConfig.KillSwitch)
+	if s, _ := currentState(); mKillSwitch.Checked() && s.connected() {
+		mu.RLock()
+		profile := runningProfile
+		mu.RUnlock()
+		if err := engageKillSwitch(profile); err != nil {
+			logWarn(GetText("kill_switch_engage_fail"), err)
+		}
+	} else if !mKillSwitch.Checked() {
+		releaseKillSwitch()
+	}
+}
+
+// releaseKillSwitch lifts the kill switch on request while the tunnel is down,
+// e.g. after TUNTray exited without disconnecting.
+func releaseKillSwitch() {
+	if err := liftKillSwitch(); err != nil {
+		logWarn(GetText("kill_switch_lift_fail"), err)
+	}
+}
+
+// updateKillSwitchMenuLocked shows whether the kill switch is currently
+// blocking traffic. Callers must hold mu.
+func updateKillSwitchMenuLocked() {
+	if mReleaseKillSwitch == nil {
+		return
+	}
+	if appConfig.KillSwitchEngaged && !tunnelRunning() {
+		mReleaseKillSwitch.Show()
+	} else {
+		mReleaseKillSwitch.Hide()
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 // Windows API constants for language detection
 var (
-	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	kernel32                   = syscall.NewLazyDLL("kernel32.dll")
 	getSystemDefaultUILanguage = kernel32.NewProc("GetSystemDefaultUILanguage")
 )
 
@@ -46,153 +46,793 @@ type LanguageMap map[Language]map[string]string
 var Translations = LanguageMap{
 	Chinese: {
 		// Menu items
-		"start":            "启动",
-		"stop":             "停止",
-		"select_proxy":     "选择代理",
-		"manage_proxies":   "管理代理",
-		"add_new_proxy":    "添加新代理...",
-		"delete_proxy":     "删除代理",
-		"language":         "语言",
-		"chinese":          "中文",
-		"english":          "English",
-		"quit":             "退出",
+		"start":               "启动",
+		"stop":                "停止",
+		"release_kill_switch": "解除断网保护",
+		"select_proxy":        "选择代理",
+		"manage_proxies":      "管理代理",
+		"add_new_proxy":       "添加新代理...",
+		"add_from_clipboard":  "从剪贴板添加...",
+		"add_typed_proxy":     "按类型添加代理...",
+		"edit_proxy":          "编辑代理...",
+		"proxy_chain":         "代理链",
+		"app_routing":         "按应用分流",
+		"enable_app_routing":  "启用按应用分流",
+		"add_app_rule":        "添加应用...",
+		"remove_app_rules":    "移除应用...",
+		"tunnelled_apps":      "当前经隧道的应用",
+		"no_tunnelled_apps":   "(无)",
+		"configure_chain":     "配置代理链...",
+		"clear_chain":         "停用代理链",
+		"profiles":            "配置方案",
+		"new_profile":         "新建方案...",
+		"edit_profile":        "编辑当前方案...",
+		"delete_profile":      "删除当前方案",
+		"settings":            "设置",
+		"auto_connect":        "启动时自动连接",
+		"auto_reconnect":      "网络变化时自动重连",
+		"pause_rules":         "暂停网络规则",
+		"add_network_rule":    "为当前网络添加规则...",
+		"kill_switch":         "断网保护 (Kill Switch)",
+		"dns_forwarder":       "DNS 转发 (防泄漏)",
+		"block_other_dns":     "阻止其他网卡的 DNS",
+		"configure_dns":       "DNS 上游...",
+		"rule_routing":        "规则分流",
+		"test_rules":          "测试 URL/IP 匹配的规则...",
+		"control_api":         "本地控制 API",
+		"copy_api_token":      "复制 API 令牌",
+		"delete_proxy":        "删除代理",
+		"language":            "语言",
+		"chinese":             "中文",
+		"english":             "English",
+		"quit":                "退出",
 
 		// Tooltips and titles
-		"app_title":        "TUNTray",
-		"app_tooltip":     "TUN 流量转发管理",
-		"start_tooltip":   "启动 TUN",
-		"stop_tooltip":    "停止 TUN",
-		"select_tooltip":  "选择一个代理服务器",
-		"add_tooltip":     "添加一个新的代理地址",
-		"delete_tooltip":  "删除一个现有的代理地址",
-		"manage_tooltip":  "添加或删除代理",
+		"app_title":                   "TUNTray",
+		"app_tooltip":                 "TUN 流量转发管理",
+		"start_tooltip":               "启动 TUN",
+		"stop_tooltip":                "停止 TUN",
+		"cancel":                      "取消连接",
+		"cancel_tooltip":              "中止正在进行的连接并撤销已做的更改",
+		"release_kill_switch_tooltip": "断网保护仍在阻止非隧道流量，点击解除",
+		"select_tooltip":              "选择一个代理服务器",
+		"add_tooltip":                 "添加一个新的代理地址",
+		"delete_tooltip":              "删除一个现有的代理地址",
+		"manage_tooltip":              "添加或删除代理",
+		"clipboard_tooltip":           "从剪贴板导入一个或多个代理链接",
+		"add_typed_tooltip":           "按协议填写表单添加代理 (SOCKS5、HTTP、Shadowsocks 等)",
+		"edit_tooltip":                "在表单中编辑现有代理",
+		"chain_tooltip":               "通过多个代理依次转发流量",
+		"app_routing_tooltip":         "仅让选定的程序经隧道，其余直连",
+		"enable_app_routing_tooltip":  "启用后仅将规则匹配程序的 TCP 连接路由进隧道",
+		"add_app_rule_tooltip":        "选择要经隧道的程序",
+		"remove_app_rules_tooltip":    "移除按应用分流规则",
+		"tunnelled_apps_tooltip":      "当前有连接经过隧道的程序",
+		"configure_chain_tooltip":     "按顺序选择代理链中的各跳",
+		"clear_chain_tooltip":         "直接使用所选代理",
+		"profiles_tooltip":            "切换代理、路由和 DNS 的组合方案",
+		"new_profile_tooltip":         "以当前方案为模板新建方案",
+		"edit_profile_tooltip":        "编辑 TUN 地址、路由、DNS 和 tun2socks 参数",
+		"delete_profile_tooltip":      "删除当前方案",
+		"settings_tooltip":            "连接行为选项",
+		"auto_connect_tooltip":        "TUNTray 启动后立即启动 TUN",
+		"auto_reconnect_tooltip":      "网络切换、睡眠唤醒或 tun2socks 退出后重新应用路由或重启隧道",
+		"pause_rules_tooltip":         "暂时不根据所在网络自动启动或停止隧道",
+		"add_network_rule_tooltip":    "在当前网络上自动启动或停止隧道",
+		"kill_switch_tooltip":         "连接期间阻止除代理服务器和局域网以外的非隧道流量，直到手动断开",
+		"dns_forwarder_tooltip":       "由 TUNTray 在 TUN 地址上应答 DNS，并经代理或 DoH/DoT 转发",
+		"block_other_dns_tooltip":     "连接期间阻止其他网卡发送 DNS 查询，防止回落到运营商的 DNS",
+		"configure_dns_tooltip":       "选择 DNS 转发方式和上游服务器",
+		"rule_routing_tooltip":        "按 config.json 中的 routing_rules 将连接分发到直连、拒绝或指定代理",
+		"test_rules_tooltip":          "查看某个地址会匹配哪条规则",
+		"control_api_tooltip":         "允许本机脚本通过带令牌的 HTTP API 控制 TUNTray",
+		"copy_api_token_tooltip":      "将控制 API 的访问令牌复制到剪贴板",
+		"notifications":               "通知",
+		"notifications_tooltip":       "选择哪些事件显示桌面通知",
+		"notify_connected":            "已连接",
+		"notify_disconnected":         "已断开",
+		"notify_reconnected":          "自动重连",
+		"notify_errors":               "错误",
 
 		// Error messages
-		"permission_error_title":  "权限不足",
+		"permission_error_title": "权限不足",
 		"permission_error_msg":   "本程序需要管理员权限才能正常运行。\n请右键点击程序并选择\"以管理员身份运行\"。",
 
 		// Operation messages
-		"start_success":   "启动成功",
-		"start_fail":      "启动失败",
-		"stop_success":    "停止成功",
-		"stop_fail":       "停止失败",
+		"start_success": "启动成功",
+		"start_fail":    "启动失败",
+		"stop_success":  "停止成功",
+		"stop_fail":     "停止失败",
 
 		// Log messages
-		"log_starting":    "启动 TUN...",
-		"log_stopping":    "停止 TUN...",
-		"log_proxy_switch": "切换代理到: %s",
-		"log_proxy_added":  "代理 '%s' 已添加, 菜单已更新。",
-		"log_proxy_deleted": "代理 '%s' 已删除, 菜单已更新。",
+		"log_starting":            "启动 TUN...",
+		"log_stopping":            "停止 TUN...",
+		"log_proxy_switch":        "切换代理到: %s",
+		"log_proxy_added":         "代理 '%s' 已添加, 菜单已更新。",
+		"log_proxy_deleted":       "代理 '%s' 已删除, 菜单已更新。",
 		"log_all_proxies_deleted": "所有代理均已删除。",
 
 		// Dialog messages
-		"add_proxy_title":      "添加新代理",
-		"add_proxy_prompt":     "请输入新的代理地址:",
-		"proxy_empty_error":    "代理地址不能为空。",
-		"proxy_exists_error":    "该代理地址已存在。",
-		"add_proxy_failed":      "添加失败",
-		"input_invalid":         "输入无效",
-		"add_proxy_success":     "代理已成功添加。",
-		"operation_success":    "操作成功",
-		"user_cancelled":        "用户取消了添加代理。",
-		"cannot_open_input":     "无法打开输入框: %v",
+		"add_proxy_title":          "添加新代理",
+		"add_proxy_prompt":         "请输入新的代理地址:",
+		"proxy_empty_error":        "代理地址不能为空。",
+		"proxy_exists_error":       "该代理地址已存在。",
+		"add_proxy_failed":         "添加失败",
+		"input_invalid":            "输入无效",
+		"add_proxy_success":        "代理已成功添加。",
+		"operation_success":        "操作成功",
+		"user_cancelled":           "用户取消了添加代理。",
+		"cannot_open_input":        "无法打开输入框: %v",
+		"proxy_invalid_error":      "无效的代理地址: %s",
+		"proxy_scheme_error":       "不支持的代理协议: %s",
+		"log_proxy_rejected":       "代理 '%s' 未通过校验: %v",
+		"clipboard_read_fail":      "无法读取剪贴板: %v",
+		"clipboard_no_proxies":     "剪贴板中没有可添加的代理链接。",
+		"clipboard_confirm_prompt": "请选择要添加的代理:",
+		"clipboard_import_success": "已添加 %d 个代理。",
+		"proxy_protocol_prompt":    "请选择代理协议:",
+		"proxy_server_prompt":      "服务器地址:",
+		"proxy_port_prompt":        "端口:",
+		"proxy_port_invalid":       "无效的端口: %s",
+		"proxy_cipher_prompt":      "加密方式:",
+		"proxy_plugin_prompt":      "插件 (可选, 例如 obfs-local;obfs=http;obfs-host=example.com):",
+		"proxy_userid_prompt":      "用户 ID (可选):",
+		"proxy_username_prompt":    "用户名 (可选, 留空表示无需认证):",
+		"edit_proxy_prompt":        "请选择要编辑的代理:",
+		"edit_proxy_success":       "代理已成功更新。",
+		"log_proxy_edited":         "代理 '%s' 已更新为 '%s'。",
+		"log_dialog_error":         "对话框操作失败: %v",
+		"chain_no_candidates":      "代理链仅支持 SOCKS5 和 HTTP 代理，请先添加此类代理。",
+		"chain_hop_prompt":         "请选择第 %d 跳 (点击\"完成\"结束):",
+		"chain_done":               "完成",
+		"chain_set_success":        "代理链已设置:\n%s",
+		"log_chain_set":            "代理链已设置: %s",
+		"log_chain_cleared":        "代理链已停用。",
+		"profile_name_prompt":      "方案名称:",
+		"profile_name_empty":       "方案名称不能为空。",
+		"profile_exists_error":     "同名方案已存在。",
+		"edit_profile_title":       "编辑方案 - %s",
+		"profile_tun_prompt":       "TUN 地址/掩码 (例如 192.168.123.1/255.255.255.0):",
+		"profile_dns_prompt":       "DNS 服务器 (以逗号分隔):",
+		"profile_routes_prompt":    "经过隧道的路由 (CIDR, 以逗号分隔; 留空表示全部流量):",
+		"profile_args_prompt":      "额外的 tun2socks 参数 (可选, 例如 -mtu 1400):",
+		"profile_value_invalid":    "无效的值: %s",
+		"delete_profile_confirm":   "确定要删除方案 '%s' 吗?",
+		"log_profile_switch":       "切换方案到: %s",
+		"log_profile_added":        "方案 '%s' 已创建。",
+		"log_profile_updated":      "方案 '%s' 已更新。",
+		"log_profile_deleted":      "方案 '%s' 已删除。",
 
 		// Config messages
-		"config_load_success":  "已成功加载 config.json。",
-		"config_parse_fail":    "解析 config.json 失败: %v。将尝试迁移或创建默认配置。",
-		"migration_start":      "找到旧的 proxies.json，正在迁移...",
-		"migration_success":     "迁移成功，旧的 proxies.json 已删除。",
-		"no_valid_config":      "未找到有效配置, 创建默认配置...",
-		"config_encode_fail":    "无法编码 config.json: %v",
-		"config_write_fail":    "无法写入 config.json: %v",
+		"config_load_success": "已成功加载 config.json。",
+		"config_parse_fail":   "解析 config.json 失败: %v。将尝试迁移或创建默认配置。",
+		"migration_start":     "找到旧的 proxies.json，正在迁移...",
+		"migration_success":   "迁移成功，旧的 proxies.json 已删除。",
+		"no_valid_config":     "未找到有效配置, 创建默认配置...",
+		"config_encode_fail":  "无法编码 config.json: %v",
+		"config_write_fail":   "无法写入 config.json: %v",
 
 		// Core logic messages
-		"prepare_wintun_fail":  "准备 wintun.dll 失败: %w",
-		"no_proxy_selected":    "未选择代理服务器",
-		"start_tun2socks_fail": "启动 tun2socks.exe 失败: %w",
-		"stop_tun2socks_fail":  "停止 tun2socks.exe 失败: %w",
-		"wait_adapter_timeout": "等待网络适配器 '%s' 超时",
-		"adapter_found":        "网络适配器 '%s' 已找到",
-		"get_interfaces_fail":  "获取网络接口失败: %w",
-		"copy_wintun_success":  "已从开发目录复制 wintun.dll。",
-		"copy_wintun_fail":     "复制 wintun.dll 失败 (%s): %w",
-		"wintun_not_found":     "wintun.dll 不存在于当前目录，也无法从 %s 复制: %w",
-		"command_exec_fail":    "执行命令 '%s' 失败: %s, %w",
+		"prepare_wintun_fail":        "准备 wintun.dll 失败: %w",
+		"no_proxy_selected":          "未选择代理服务器",
+		"start_tun2socks_fail":       "启动 tun2socks.exe 失败: %w",
+		"stop_tun2socks_fail":        "停止 tun2socks.exe 失败: %w",
+		"wait_adapter_timeout":       "等待网络适配器 '%s' 超时",
+		"adapter_found":              "网络适配器 '%s' 已找到",
+		"get_interfaces_fail":        "获取网络接口失败: %w",
+		"copy_wintun_success":        "已从开发目录复制 wintun.dll。",
+		"copy_wintun_fail":           "复制 wintun.dll 失败 (%s): %w",
+		"wintun_not_found":           "wintun.dll 不存在于当前目录，也无法从 %s 复制: %w",
+		"command_exec_fail":          "执行命令 '%s' 失败: %s, %w",
+		"chain_hop_unsupported":      "代理链不支持该代理: %s",
+		"chain_hop_fail":             "通过 %s 连接失败: %w",
+		"chain_listen_fail":          "启动本地代理链监听失败: %w",
+		"log_chain_listening":        "本地代理链监听于 %s: %s",
+		"log_chain_dial_fail":        "代理链连接 %s 失败: %v",
+		"log_profile_starting":       "使用方案 '%s' 启动",
+		"log_auto_connect":           "已启用启动时自动连接。",
+		"log_tun2socks_exited":       "tun2socks 已退出: %v",
+		"log_network_change":         "检测到网络变化: %s",
+		"log_reapply_routes":         "重新应用隧道路由...",
+		"reapply_routes_fail":        "重新应用路由失败: %v",
+		"log_restarting":             "正在重启隧道...",
+		"kill_switch_no_interfaces":  "未找到可保护的网络接口",
+		"kill_switch_resolve_fail":   "无法解析代理服务器 %s: %w",
+		"reason_resumed":             "从睡眠中唤醒",
+		"reason_link_changed":        "网络接口或默认网关已变化",
+		"reason_tunnel_exited":       "tun2socks 已退出",
+		"log_network_info":           "当前网络: %s",
+		"log_rule_applied":           "应用网络规则 '%s': %s",
+		"rule_action_invalid":        "网络规则 '%s' 的动作无效: %s",
+		"rule_default":               "默认",
+		"rule_no_network":            "未检测到已连接的网络。",
+		"rule_action_prompt":         "当前网络:\n%s\n\n在此网络上:",
+		"rule_action_connect":        "启动隧道",
+		"rule_action_disconnect":     "停止隧道 (受信任网络)",
+		"rule_profile_prompt":        "使用的方案:",
+		"rule_name_prompt":           "规则名称:",
+		"rule_added_success":         "网络规则已添加。",
+		"log_rule_added":             "网络规则 '%s' 已添加: %s",
+		"kill_switch_firewall_off":   "警告: Windows 防火墙的部分配置文件已关闭，断网保护在这些网络上不生效。",
+		"log_kill_switch_engaged":    "断网保护已启用，允许的目标: %s",
+		"log_kill_switch_lifted":     "断网保护已解除。",
+		"kill_switch_engage_fail":    "启用断网保护失败: %v",
+		"kill_switch_lift_fail":      "解除断网保护失败: %v",
+		"kill_switch_local_proxy":    "代理位于本机，请在 config.json 的 kill_switch_allow 中添加本地代理客户端所连接的服务器地址，否则断网保护会阻断其连接。",
+		"kill_switch_app_routing":    "断网保护不能与按应用分流同时使用: 未选中的程序本就直接连接，防火墙无法区分这些连接与隧道断开后的泄漏。",
+		"kill_switch_rule_direct":    "断网保护不能与按域名、国家或 MATCH 直连的分流规则同时使用 (%s): 这些连接由 TUNTray 自身在隧道外建立，防火墙无法为其放行。请改用 IP-CIDR 直连规则。",
+		"dns_mode_proxy":             "经代理的 TCP DNS",
+		"dns_mode_doh":               "DNS over HTTPS (DoH)",
+		"dns_mode_dot":               "DNS over TLS (DoT)",
+		"dns_mode_prompt":            "DNS 查询的转发方式:",
+		"dns_upstream_prompt":        "%s 上游服务器 (DoH 为 URL，其他为 主机:端口):",
+		"dns_upstream_invalid":       "无效的 DNS 上游: %s",
+		"dns_mode_invalid":           "未知的 DNS 转发方式: %s",
+		"dns_listen_fail":            "无法在 %s 上启动 DNS 转发: %w",
+		"dns_block_fail":             "阻止其他网卡的 DNS 失败: %w",
+		"dns_unblock_fail":           "恢复其他网卡的 DNS 失败: %v",
+		"dns_next_start":             "DNS 设置将在下次启动隧道时生效。",
+		"log_dns_listening":          "DNS 转发已在 %s 上监听，上游 %s (%s)",
+		"log_dns_via_tunnel":         "无法直接通过此类代理连接，DNS 查询将经隧道发送。",
+		"log_dns_upstream_fail":      "DNS 查询 %s 失败: %v",
+		"log_dns_bootstrap_fail":     "连接前无法解析 %s: %v",
+		"log_dns_blocked":            "已阻止其他网卡的 DNS。",
+		"log_dns_unblocked":          "已恢复其他网卡的 DNS。",
+		"log_dns_updated":            "DNS 上游已设为 %s (%s)",
+		"fake_ip_regex_invalid":      "无效的 Fake-IP 域名正则 %s: %v",
+		"fake_ip_range_invalid":      "无效的 Fake-IP 地址段: %s",
+		"fake_ip_unknown":            "%s 不在 Fake-IP 映射表中 (可能已过期)",
+		"dispatch_proxy_unsupported": "Fake-IP 模式和规则分流需要 SOCKS5/HTTP 代理或代理链: %s",
+		"app_rule_programs":          "程序",
+		"app_rule_exists":            "该程序已被规则 '%s' 匹配。",
+		"app_rules_next_start":       "按应用分流设置将在下次启动隧道时生效。",
+		"app_rules_empty":            "还没有按应用分流规则。",
+		"remove_app_rules_prompt":    "选择要移除的规则:",
+		"log_app_rule_added":         "已添加应用规则 '%s': %s",
+		"log_app_rule_removed":       "已移除应用规则 '%s'",
+		"log_app_routing_started":    "按应用分流已启动，规则数: %d",
+		"log_app_route_added":        "%s 连接 %s，已添加隧道路由",
+		"log_app_routing_fail":       "按应用分流出错: %v",
+		"rule_invalid":               "无效的规则: %s",
+		"rule_target_unknown":        "规则目标 '%s' 不是 DIRECT、REJECT、PROXY，也不是已知代理的标签",
+		"geoip_open_fail":            "无法打开 GeoIP 数据库 %s: %w",
+		"rules_next_start":           "规则分流设置将在下次启动隧道时生效。",
+		"test_rules_prompt":          "输入 URL、域名或 IP:",
+		"test_rules_subject":         "地址: %s\n规则看到的域名: %s\nIP: %s\n国家/地区: %s",
+		"test_rules_matched":         "匹配规则: %s\n结果: %s",
+		"test_rules_default":         "没有匹配的规则，默认使用 %s",
+		"log_rule_test":              "规则测试 %s: %s",
+		"log_rule_routing":           "规则分流已启用，规则数: %d",
+		"log_direct_routes":          "已为 %d 条直连规则添加经网关 %s 的路由",
+		"log_direct_route_fail":      "添加直连路由 %s 失败: %s",
+		"api_listen_fail":            "无法在 %s 上启动控制 API: %v",
+		"api_loopback_only":          "只能监听本机回环地址",
+		"log_api_listening":          "控制 API 监听于 %s",
+		"log_api_stopped":            "控制 API 已停止。",
+		"api_copy_token_fail":        "复制 API 令牌失败: %v",
+		"log_api_token_copied":       "API 令牌已复制到剪贴板。",
+		"cli_status":                 "状态: %s\n配置: %s\n代理: %s",
+		"cli_unknown_profile":        "未找到配置 %q",
+		"instance_lock_fail":         "无法创建单实例锁: %v",
+		"instance_listen_fail":       "无法启动实例间通信端点: %v",
+		"instance_unreachable":       "TUNTray 已在运行，但无法与其通信。",
+		"instance_already_running":   "TUNTray 已在运行，请使用系统托盘中的图标。",
+		"instance_forward_fail":      "转发启动参数失败: %v",
+		"log_instance_forward":       "TUNTray 已在运行，将启动参数转发给它。",
+		"log_launch_args_invalid":    "忽略无效的启动参数: %v",
+		"launch_args_fail":           "执行启动参数失败: %v",
+		"state_disconnected":         "未连接",
+		"state_connecting":           "正在连接…",
+		"state_connected":            "已连接",
+		"state_reconnecting":         "正在重新连接…",
+		"state_error":                "出错",
+		"state_degraded":             "已连接 (异常)",
+		"tooltip_uptime":             "已连接 %s",
+		"log_state_changed":          "隧道状态: %v",
+		"log_state_icon_fail":        "无法生成状态图标: %v",
+		"log_start_rollback":         "启动未完成，正在撤销已应用的网络更改...",
+		"log_start_cancelled":        "连接已取消。",
+		"notify_connected_msg":       "已连接，经由 %s",
+		"notify_disconnected_msg":    "已断开，流量不再经过隧道。",
+		"notify_reconnected_msg":     "网络变化后已重新连接，经由 %s",
+		"notify_error_msg":           "连接出错: %v",
+		"notify_fail":                "显示通知失败: %v",
+		"step_start":                 "启动隧道",
+		"step_prepare_wintun":        "准备 wintun.dll",
+		"step_start_tun2socks":       "启动 tun2socks",
+		"step_wait_adapter":          "等待 TUN 网卡",
+		"step_configure_address":     "设置 TUN 网卡地址",
+		"step_configure_dns":         "设置 TUN 网卡 DNS",
+		"step_add_routes":            "添加路由",
+		"start_error_msg":            "隧道未能启动。\n\n失败步骤: %s\n%s",
+		"advice_missing_binary":      "确认 tun2socks.exe 和 wintun.dll 与 TUNTray.exe 位于同一目录，且未被杀毒软件隔离。",
+		"advice_adapter_timeout":     "检查 wintun 驱动能否加载；若其他 VPN 正在使用 wintun，请先将其关闭，必要时重启电脑。",
+		"advice_route_conflict":      "路由已被其他程序占用，请关闭其他 VPN 或代理软件后重试，或在配置中更换 TUN 地址。",
+		"advice_permission":          "以管理员身份运行 TUNTray。",
+		"details_step":               "步骤",
+		"details_kind":               "类型",
+		"details_command":            "命令",
+		"details_output":             "输出",
+		"details_error":              "错误",
+		"details_advice":             "建议",
+		"open_log":                   "打开日志",
+		"copy_details":               "复制详情",
+		"close":                      "关闭",
+		"copy_details_fail":          "复制错误详情失败: %v",
+		"open_log_fail":              "打开日志失败: %v",
+		"statistics":                 "统计",
+		"statistics_tooltip":         "查看流量统计与连接历史",
+		"session_history":            "连接历史",
+		"session_history_tooltip":    "最近的连接记录",
+		"no_sessions":                "暂无记录",
+		"clear_sessions":             "清除历史",
+		"clear_sessions_tooltip":     "删除所有连接记录",
+		"stats_not_connected":        "未连接",
+		"stats_rate":                 "↑ %s/s  ↓ %s/s",
+		"stats_total":                "本次连接: ↑ %s  ↓ %s",
+		"session_entry":              "%s  %v  ↑ %s ↓ %s  (%s)",
+		"log_stats_read_fail":        "读取 TUN 网卡流量计数失败: %v",
+		"log_session_ended":          "连接结束: 上传 %s，下载 %s，时长 %v",
+		"log_sessions_parse_fail":    "解析连接历史失败: %v",
+		"log_sessions_write_fail":    "保存连接历史失败: %v",
+		"connections":                "连接",
+		"connections_tooltip":        "查看并关闭经过隧道的连接",
+		"no_connections":             "暂无连接",
+		"connections_unavailable":    "tun2socks API 不可用 (隧道未运行，或配置方案自行设置了 -restapi)",
+		"connection_entry":           "%s → %s  ↑ %s ↓ %s  %v",
+		"connection_tooltip":         "%s 连接，点击可关闭",
+		"close_connection":           "关闭连接",
+		"close_connection_confirm":   "关闭此连接?\n\n%s",
+		"close_connection_fail":      "关闭连接失败: %v",
+		"log_connection_closed":      "已关闭连接 %s",
+		"log_connections_fail":       "获取连接列表失败: %v",
+		"log_restapi_fail":           "无法为 tun2socks API 分配端口，连接列表不可用: %v",
+		"restapi_status":             "tun2socks API %s %s 返回 %s",
+		"view_logs":                  "查看日志",
+		"view_logs_tooltip":          "查看最近的日志，可筛选和导出",
+		"log_viewer_prompt":          "筛选: %s\n显示 %d 条 (内存中共 %d 条)，最新的在前",
+		"log_viewer_empty":           "(没有符合条件的日志)",
+		"log_filter":                 "筛选...",
+		"log_filter_prompt":          "要修改哪个筛选条件?",
+		"log_filter_source":          "来源",
+		"log_filter_level":           "最低级别",
+		"log_filter_search":          "搜索文字",
+		"log_filter_clear":           "清除筛选",
+		"log_filter_label":           "来源 %s，级别 ≥ %s",
+		"log_filter_search_label":    "，包含 \"%s\"",
+		"log_source_all":             "全部",
+		"log_export":                 "导出...",
+		"log_export_minutes":         "导出最近多少分钟的日志 (所有来源和级别)?",
+		"log_export_minutes_invalid": "请输入正整数分钟数。",
+		"log_export_fail":            "导出日志失败: %v",
+		"log_exported":               "已导出 %d 条日志到 %s",
+		"diagnostics":                "创建诊断包...",
+		"diagnostics_tooltip":        "将配置 (已脱敏)、日志、路由、网卡、DNS 和代理测试结果打包为 zip",
+		"diagnostics_zip":            "Zip 文件",
+		"diagnostics_collecting":     "正在收集诊断信息...",
+		"diagnostics_done":           "诊断包已保存到:\n%s\n\n代理账号密码和 API 令牌已移除，发送前仍可自行检查内容。",
+		"diagnostics_fail":           "创建诊断包失败: %v",
+		"log_diagnostics_written":    "诊断包已写入 %s",
+		"selftest":                   "自检",
+		"selftest_tooltip":           "连接后检查流量是否真正经过隧道",
+		"selftest_run":               "重新自检",
+		"selftest_run_tooltip":       "立即再次检查隧道",
+		"selftest_dns":               "DNS 解析",
+		"selftest_tcp":               "TCP 连接",
+		"selftest_http":              "HTTP 请求",
+		"selftest_external_ip":       "外部 IP",
+		"selftest_running":           "检测中...",
+		"selftest_not_run":           "尚未检测",
+		"selftest_skipped":           "跳过",
+		"selftest_failed":            "自检失败 (%s): %v",
+		"selftest_http_status":       "服务器返回 %s",
+		"selftest_bad_external_ip":   "返回的不是 IP 地址",
+		"log_selftest_start":         "开始连接自检",
+		"log_selftest_step_ok":       "自检 %s 通过: %s (%v)",
+		"log_selftest_step_fail":     "自检 %s 失败: %v",
+		"exit_ip":                    "外部 IP: %s",
+		"exit_ip_tooltip":            "隧道的出口地址，点击重新查询",
+		"exit_ip_checking":           "查询中...",
+		"exit_ip_unknown":            "查询失败",
+		"exit_ip_disabled":           "已关闭",
+		"log_exit_ip":                "外部 IP: %s",
+		"log_exit_ip_fail":           "查询外部 IP 失败: %v",
+		"log_fake_ip_enabled":        "Fake-IP 模式已启用，地址段 %s",
 	},
 	English: {
 		// Menu items
-		"start":            "Start",
-		"stop":             "Stop",
-		"select_proxy":     "Select Proxy",
-		"manage_proxies":   "Manage Proxies",
-		"add_new_proxy":    "Add New Proxy...",
-		"delete_proxy":     "Delete Proxy",
-		"language":         "Language",
-		"chinese":          "中文",
-		"english":          "English",
-		"quit":             "Quit",
+		"start":               "Start",
+		"stop":                "Stop",
+		"release_kill_switch": "Release Kill Switch",
+		"select_proxy":        "Select Proxy",
+		"manage_proxies":      "Manage Proxies",
+		"add_new_proxy":       "Add New Proxy...",
+		"add_from_clipboard":  "Add from Clipboard...",
+		"add_typed_proxy":     "Add Proxy by Type...",
+		"edit_proxy":          "Edit Proxy...",
+		"proxy_chain":         "Proxy Chain",
+		"app_routing":         "Per-App Routing",
+		"enable_app_routing":  "Enable Per-App Routing",
+		"add_app_rule":        "Add Application...",
+		"remove_app_rules":    "Remove Applications...",
+		"tunnelled_apps":      "Tunnelled Now",
+		"no_tunnelled_apps":   "(none)",
+		"configure_chain":     "Configure Chain...",
+		"clear_chain":         "Disable Chain",
+		"profiles":            "Profiles",
+		"new_profile":         "New Profile...",
+		"edit_profile":        "Edit Active Profile...",
+		"delete_profile":      "Delete Active Profile",
+		"settings":            "Settings",
+		"auto_connect":        "Auto-connect on Launch",
+		"auto_reconnect":      "Reconnect on Network Change",
+		"pause_rules":         "Pause Network Rules",
+		"add_network_rule":    "Add Rule for Current Network...",
+		"kill_switch":         "Kill Switch",
+		"dns_forwarder":       "DNS Forwarder (Leak Protection)",
+		"block_other_dns":     "Block DNS on Other Adapters",
+		"configure_dns":       "DNS Upstream...",
+		"rule_routing":        "Rule-Based Routing",
+		"test_rules":          "Test URL/IP Against Rules...",
+		"control_api":         "Local Control API",
+		"copy_api_token":      "Copy API Token",
+		"delete_proxy":        "Delete Proxy",
+		"language":            "Language",
+		"chinese":             "中文",
+		"english":             "English",
+		"quit":                "Quit",
 
 		// Tooltips and titles
-		"app_title":        "TUNTray",
-		"app_tooltip":     "TUN Traffic Forwarding Manager",
-		"start_tooltip":   "Start TUN",
-		"stop_tooltip":    "Stop TUN",
-		"select_tooltip":  "Select a proxy server",
-		"add_tooltip":     "Add a new proxy address",
-		"delete_tooltip":  "Delete an existing proxy address",
-		"manage_tooltip":  "Add or delete proxies",
+		"app_title":                   "TUNTray",
+		"app_tooltip":                 "TUN Traffic Forwarding Manager",
+		"start_tooltip":               "Start TUN",
+		"stop_tooltip":                "Stop TUN",
+		"cancel":                      "Cancel",
+		"cancel_tooltip":              "Abort the connection attempt and undo its changes",
+		"release_kill_switch_tooltip": "The kill switch is still blocking non-tunnel traffic; click to lift it",
+		"select_tooltip":              "Select a proxy server",
+		"add_tooltip":                 "Add a new proxy address",
+		"delete_tooltip":              "Delete an existing proxy address",
+		"manage_tooltip":              "Add or delete proxies",
+		"clipboard_tooltip":           "Import one or more proxy links from the clipboard",
+		"add_typed_tooltip":           "Add a proxy by filling in a form for its protocol (SOCKS5, HTTP, Shadowsocks, ...)",
+		"edit_tooltip":                "Edit an existing proxy in a form",
+		"chain_tooltip":               "Route traffic through several proxies in turn",
+		"app_routing_tooltip":         "Send only selected programs through the tunnel; everything else goes direct",
+		"enable_app_routing_tooltip":  "When on, only TCP connections of matching programs are routed into the tunnel",
+		"add_app_rule_tooltip":        "Choose a program to send through the tunnel",
+		"remove_app_rules_tooltip":    "Remove per-app routing rules",
+		"tunnelled_apps_tooltip":      "Programs with connections through the tunnel right now",
+		"configure_chain_tooltip":     "Pick the chain hops in order",
+		"clear_chain_tooltip":         "Use the selected proxy directly",
+		"profiles_tooltip":            "Switch between bundles of proxy, routes and DNS settings",
+		"new_profile_tooltip":         "Create a profile based on the active one",
+		"edit_profile_tooltip":        "Edit TUN address, routes, DNS and tun2socks flags",
+		"delete_profile_tooltip":      "Delete the active profile",
+		"settings_tooltip":            "Connection behaviour options",
+		"auto_connect_tooltip":        "Start TUN as soon as TUNTray launches",
+		"auto_reconnect_tooltip":      "Re-apply routes or restart the tunnel after network changes, resume from sleep or tun2socks exiting",
+		"pause_rules_tooltip":         "Temporarily stop starting or stopping the tunnel based on the network",
+		"add_network_rule_tooltip":    "Automatically start or stop the tunnel on this network",
+		"kill_switch_tooltip":         "While connected, block non-tunnel traffic except to the proxy server and LAN until you disconnect",
+		"dns_forwarder_tooltip":       "Answer DNS on the TUN address and forward queries through the proxy or via DoH/DoT",
+		"block_other_dns_tooltip":     "While connected, stop other adapters from sending DNS queries so Windows cannot fall back to the ISP resolver",
+		"configure_dns_tooltip":       "Choose how and where the DNS forwarder sends queries",
+		"rule_routing_tooltip":        "Send connections direct, reject them or pick a proxy according to routing_rules in config.json",
+		"test_rules_tooltip":          "See which rule a URL, domain or IP matches",
+		"control_api_tooltip":         "Let scripts on this machine control TUNTray over a token-protected HTTP API",
+		"copy_api_token_tooltip":      "Copy the control API's access token to the clipboard",
+		"notifications":               "Notifications",
+		"notifications_tooltip":       "Choose which events show a desktop notification",
+		"notify_connected":            "Connected",
+		"notify_disconnected":         "Disconnected",
+		"notify_reconnected":          "Reconnected",
+		"notify_errors":               "Errors",
 
 		// Error messages
-		"permission_error_title":  "Insufficient Privileges",
+		"permission_error_title": "Insufficient Privileges",
 		"permission_error_msg":   "This program requires administrator privileges to run.\nPlease right-click and select \"Run as administrator\".",
 
 		// Operation messages
-		"start_success":   "Started successfully",
-		"start_fail":      "Failed to start",
-		"stop_success":    "Stopped successfully",
-		"stop_fail":       "Failed to stop",
+		"start_success": "Started successfully",
+		"start_fail":    "Failed to start",
+		"stop_success":  "Stopped successfully",
+		"stop_fail":     "Failed to stop",
 
 		// Log messages
-		"log_starting":    "Starting TUN...",
-		"log_stopping":    "Stopping TUN...",
-		"log_proxy_switch": "Switched proxy to: %s",
-		"log_proxy_added":  "Proxy '%s' added, menu updated.",
-		"log_proxy_deleted": "Proxy '%s' deleted, menu updated.",
+		"log_starting":            "Starting TUN...",
+		"log_stopping":            "Stopping TUN...",
+		"log_proxy_switch":        "Switched proxy to: %s",
+		"log_proxy_added":         "Proxy '%s' added, menu updated.",
+		"log_proxy_deleted":       "Proxy '%s' deleted, menu updated.",
 		"log_all_proxies_deleted": "All proxies have been deleted.",
 
 		// Dialog messages
-		"add_proxy_title":      "Add New Proxy",
-		"add_proxy_prompt":     "Enter new proxy address:",
-		"proxy_empty_error":    "Proxy address cannot be empty.",
-		"proxy_exists_error":    "This proxy address already exists.",
-		"add_proxy_failed":      "Add Failed",
-		"input_invalid":         "Invalid Input",
-		"add_proxy_success":     "Proxy added successfully.",
-		"operation_success":    "Success",
-		"user_cancelled":        "User cancelled adding proxy.",
-		"cannot_open_input":     "Cannot open input dialog: %v",
+		"add_proxy_title":          "Add New Proxy",
+		"add_proxy_prompt":         "Enter new proxy address:",
+		"proxy_empty_error":        "Proxy address cannot be empty.",
+		"proxy_exists_error":       "This proxy address already exists.",
+		"add_proxy_failed":         "Add Failed",
+		"input_invalid":            "Invalid Input",
+		"add_proxy_success":        "Proxy added successfully.",
+		"operation_success":        "Success",
+		"user_cancelled":           "User cancelled adding proxy.",
+		"cannot_open_input":        "Cannot open input dialog: %v",
+		"proxy_invalid_error":      "Invalid proxy address: %s",
+		"proxy_scheme_error":       "Unsupported proxy protocol: %s",
+		"log_proxy_rejected":       "Proxy '%s' rejected: %v",
+		"clipboard_read_fail":      "Cannot read clipboard: %v",
+		"clipboard_no_proxies":     "No new proxy links found in the clipboard.",
+		"clipboard_confirm_prompt": "Select the proxies to add:",
+		"clipboard_import_success": "Added %d proxies.",
+		"proxy_protocol_prompt":    "Select the proxy protocol:",
+		"proxy_server_prompt":      "Server address:",
+		"proxy_port_prompt":        "Port:",
+		"proxy_port_invalid":       "Invalid port: %s",
+		"proxy_cipher_prompt":      "Cipher:",
+		"proxy_plugin_prompt":      "Plugin (optional, e.g. obfs-local;obfs=http;obfs-host=example.com):",
+		"proxy_userid_prompt":      "User ID (optional):",
+		"proxy_username_prompt":    "Username (optional, leave empty for no authentication):",
+		"edit_proxy_prompt":        "Select the proxy to edit:",
+		"edit_proxy_success":       "Proxy updated successfully.",
+		"log_proxy_edited":         "Proxy '%s' changed to '%s'.",
+		"log_dialog_error":         "Dialog failed: %v",
+		"chain_no_candidates":      "Proxy chains support SOCKS5 and HTTP proxies only. Please add such a proxy first.",
+		"chain_hop_prompt":         "Select hop %d (click \"Done\" to finish):",
+		"chain_done":               "Done",
+		"chain_set_success":        "Proxy chain set:\n%s",
+		"log_chain_set":            "Proxy chain set: %s",
+		"log_chain_cleared":        "Proxy chain disabled.",
+		"profile_name_prompt":      "Profile name:",
+		"profile_name_empty":       "Profile name cannot be empty.",
+		"profile_exists_error":     "A profile with this name already exists.",
+		"edit_profile_title":       "Edit Profile - %s",
+		"profile_tun_prompt":       "TUN address/mask (e.g. 192.168.123.1/255.255.255.0):",
+		"profile_dns_prompt":       "DNS servers (comma separated):",
+		"profile_routes_prompt":    "Routes through the tunnel (CIDRs, comma separated; empty means all traffic):",
+		"profile_args_prompt":      "Extra tun2socks flags (optional, e.g. -mtu 1400):",
+		"profile_value_invalid":    "Invalid value: %s",
+		"delete_profile_confirm":   "Delete profile '%s'?",
+		"log_profile_switch":       "Switched profile to: %s",
+		"log_profile_added":        "Profile '%s' created.",
+		"log_profile_updated":      "Profile '%s' updated.",
+		"log_profile_deleted":      "Profile '%s' deleted.",
 
 		// Config messages
-		"config_load_success":  "Successfully loaded config.json.",
-		"config_parse_fail":    "Failed to parse config.json: %v. Will try to migrate or create default configuration.",
-		"migration_start":      "Found old proxies.json, migrating...",
-		"migration_success":     "Migration successful, old proxies.json deleted.",
-		"no_valid_config":      "No valid configuration found, creating default...",
-		"config_encode_fail":    "Cannot encode config.json: %v",
-		"config_write_fail":    "Cannot write config.json: %v",
+		"config_load_success": "Successfully loaded config.json.",
+		"config_parse_fail":   "Failed to parse config.json: %v. Will try to migrate or create default configuration.",
+		"migration_start":     "Found old proxies.json, migrating...",
+		"migration_success":   "Migration successful, old proxies.json deleted.",
+		"no_valid_config":     "No valid configuration found, creating default...",
+		"config_encode_fail":  "Cannot encode config.json: %v",
+		"config_write_fail":   "Cannot write config.json: %v",
 
 		// Core logic messages
-		"prepare_wintun_fail":  "Failed to prepare wintun.dll: %w",
-		"no_proxy_selected":    "No proxy server selected",
-		"start_tun2socks_fail": "Failed to start tun2socks.exe: %w",
-		"stop_tun2socks_fail":  "Failed to stop tun2socks.exe: %w",
-		"wait_adapter_timeout": "Waiting for network adapter '%s' timed out",
-		"adapter_found":        "Network adapter '%s' found",
-		"get_interfaces_fail":  "Failed to get network interfaces: %w",
-		"copy_wintun_success":  "Copied wintun.dll from development directory.",
-		"copy_wintun_fail":     "Failed to copy wintun.dll (%s): %w",
-		"wintun_not_found":     "wintun.dll does not exist in current directory and cannot be copied from %s: %w",
-		"command_exec_fail":    "Failed to execute command '%s': %s, %w",
+		"prepare_wintun_fail":        "Failed to prepare wintun.dll: %w",
+		"no_proxy_selected":          "No proxy server selected",
+		"start_tun2socks_fail":       "Failed to start tun2socks.exe: %w",
+		"stop_tun2socks_fail":        "Failed to stop tun2socks.exe: %w",
+		"wait_adapter_timeout":       "Waiting for network adapter '%s' timed out",
+		"adapter_found":              "Network adapter '%s' found",
+		"get_interfaces_fail":        "Failed to get network interfaces: %w",
+		"copy_wintun_success":        "Copied wintun.dll from development directory.",
+		"copy_wintun_fail":           "Failed to copy wintun.dll (%s): %w",
+		"wintun_not_found":           "wintun.dll does not exist in current directory and cannot be copied from %s: %w",
+		"command_exec_fail":          "Failed to execute command '%s': %s, %w",
+		"chain_hop_unsupported":      "Proxy not supported in a chain: %s",
+		"chain_hop_fail":             "Connecting through %s failed: %w",
+		"chain_listen_fail":          "Failed to start local chain listener: %w",
+		"log_chain_listening":        "Local chain listener on %s: %s",
+		"log_chain_dial_fail":        "Chain connection to %s failed: %v",
+		"log_profile_starting":       "Starting with profile '%s'",
+		"log_auto_connect":           "Auto-connect on launch is enabled.",
+		"log_tun2socks_exited":       "tun2socks exited: %v",
+		"log_network_change":         "Network change detected: %s",
+		"log_reapply_routes":         "Re-applying tunnel routes...",
+		"reapply_routes_fail":        "Failed to re-apply routes: %v",
+		"log_restarting":             "Restarting tunnel...",
+		"kill_switch_no_interfaces":  "No network interfaces to protect",
+		"kill_switch_resolve_fail":   "Cannot resolve proxy server %s: %w",
+		"reason_resumed":             "resumed from sleep",
+		"reason_link_changed":        "interfaces or default gateway changed",
+		"reason_tunnel_exited":       "tun2socks exited",
+		"log_network_info":           "Current network: %s",
+		"log_rule_applied":           "Applying network rule '%s': %s",
+		"rule_action_invalid":        "Network rule '%s' has an invalid action: %s",
+		"rule_default":               "default",
+		"rule_no_network":            "No connected network detected.",
+		"rule_action_prompt":         "Current network:\n%s\n\nOn this network:",
+		"rule_action_connect":        "Start the tunnel",
+		"rule_action_disconnect":     "Stop the tunnel (trusted network)",
+		"rule_profile_prompt":        "Profile to use:",
+		"rule_name_prompt":           "Rule name:",
+		"rule_added_success":         "Network rule added.",
+		"log_rule_added":             "Network rule '%s' added: %s",
+		"kill_switch_firewall_off":   "Warning: some Windows Firewall profiles are disabled; the kill switch has no effect on those networks.",
+		"log_kill_switch_engaged":    "Kill switch engaged, allowed destinations: %s",
+		"log_kill_switch_lifted":     "Kill switch lifted.",
+		"kill_switch_engage_fail":    "Failed to engage kill switch: %v",
+		"kill_switch_lift_fail":      "Failed to lift kill switch: %v",
+		"kill_switch_local_proxy":    "The proxy runs on this machine; add the servers your local proxy client connects to under kill_switch_allow in config.json, or the kill switch will block it.",
+		"kill_switch_app_routing":    "The kill switch cannot be used with per-app routing: programs that are not selected connect directly by design, and the firewall cannot tell those connections from a leak after the tunnel drops.",
+		"kill_switch_rule_direct":    "The kill switch cannot be used with DIRECT rules for domains, countries or MATCH (%s): TUNTray makes those connections itself outside the tunnel, and the firewall cannot exempt them. Use IP-CIDR rules for DIRECT instead.",
+		"dns_mode_proxy":             "DNS over TCP through the proxy",
+		"dns_mode_doh":               "DNS over HTTPS (DoH)",
+		"dns_mode_dot":               "DNS over TLS (DoT)",
+		"dns_mode_prompt":            "How should DNS queries be forwarded?",
+		"dns_upstream_prompt":        "Upstream for %s (a URL for DoH, host:port otherwise):",
+		"dns_upstream_invalid":       "Invalid DNS upstream: %s",
+		"dns_mode_invalid":           "Unknown DNS forwarder mode: %s",
+		"dns_listen_fail":            "Failed to start the DNS forwarder on %s: %w",
+		"dns_block_fail":             "Failed to block DNS on other adapters: %w",
+		"dns_unblock_fail":           "Failed to restore DNS on other adapters: %v",
+		"dns_next_start":             "DNS settings take effect the next time the tunnel starts.",
+		"log_dns_listening":          "DNS forwarder listening on %s, upstream %s (%s)",
+		"log_dns_via_tunnel":         "This proxy type cannot be dialled directly; DNS queries go through the tunnel.",
+		"log_dns_upstream_fail":      "DNS query for %s failed: %v",
+		"log_dns_bootstrap_fail":     "Could not resolve %s before connecting: %v",
+		"log_dns_blocked":            "DNS on other adapters blocked.",
+		"log_dns_unblocked":          "DNS on other adapters restored.",
+		"log_dns_updated":            "DNS forwarder upstream set to %s (%s)",
+		"fake_ip_regex_invalid":      "Invalid fake-IP domain regex %s: %v",
+		"fake_ip_range_invalid":      "Invalid fake-IP range: %s",
+		"fake_ip_unknown":            "%s is not in the fake-IP table (it may have expired)",
+		"dispatch_proxy_unsupported": "Fake-IP mode and rule routing need a SOCKS5/HTTP proxy or a proxy chain: %s",
+		"app_rule_programs":          "Programs",
+		"app_rule_exists":            "This program is already matched by rule '%s'.",
+		"app_rules_next_start":       "Per-app routing changes take effect the next time the tunnel starts.",
+		"app_rules_empty":            "There are no per-app routing rules yet.",
+		"remove_app_rules_prompt":    "Select the rules to remove:",
+		"log_app_rule_added":         "App rule '%s' added: %s",
+		"log_app_rule_removed":       "App rule '%s' removed",
+		"log_app_routing_started":    "Per-app routing started with %d rules",
+		"log_app_route_added":        "%s connected to %s; route added into the tunnel",
+		"log_app_routing_fail":       "Per-app routing error: %v",
+		"rule_invalid":               "Invalid rule: %s",
+		"rule_target_unknown":        "Rule target '%s' is not DIRECT, REJECT, PROXY or the tag of a known proxy",
+		"geoip_open_fail":            "Failed to open GeoIP database %s: %w",
+		"rules_next_start":           "Rule routing changes take effect the next time the tunnel starts.",
+		"test_rules_prompt":          "Enter a URL, domain or IP:",
+		"test_rules_subject":         "Host: %s\nDomain seen by the rules: %s\nIP: %s\nCountry: %s",
+		"test_rules_matched":         "Matched rule: %s\nResult: %s",
+		"test_rules_default":         "No rule matched; using %s",
+		"log_rule_test":              "Rule test for %s: %s",
+		"log_rule_routing":           "Rule routing on with %d rules",
+		"log_direct_routes":          "Added %d direct routes via gateway %s",
+		"log_direct_route_fail":      "Failed to add direct route %s: %s",
+		"api_listen_fail":            "Failed to start the control API on %s: %v",
+		"api_loopback_only":          "it may only listen on a loopback address",
+		"log_api_listening":          "Control API listening on %s",
+		"log_api_stopped":            "Control API stopped.",
+		"api_copy_token_fail":        "Failed to copy the API token: %v",
+		"log_api_token_copied":       "API token copied to the clipboard.",
+		"cli_status":                 "Status:  %s\nProfile: %s\nProxy:   %s",
+		"cli_unknown_profile":        "Unknown profile %q",
+		"instance_lock_fail":         "Failed to create the single-instance lock: %v",
+		"instance_listen_fail":       "Failed to start the endpoint for other instances: %v",
+		"instance_unreachable":       "TUNTray is already running but cannot be reached.",
+		"instance_already_running":   "TUNTray is already running. Use its icon in the system tray.",
+		"instance_forward_fail":      "Failed to forward the launch arguments: %v",
+		"log_instance_forward":       "TUNTray is already running; forwarding the launch arguments to it.",
+		"log_launch_args_invalid":    "Ignoring invalid launch arguments: %v",
+		"launch_args_fail":           "Failed to carry out the launch arguments: %v",
+		"state_disconnected":         "Disconnected",
+		"state_connecting":           "Connecting…",
+		"state_connected":            "Connected",
+		"state_reconnecting":         "Reconnecting…",
+		"state_error":                "Error",
+		"state_degraded":             "Degraded",
+		"tooltip_uptime":             "Up %s",
+		"log_state_changed":          "Tunnel state: %v",
+		"log_state_icon_fail":        "Failed to build the status icons: %v",
+		"log_start_rollback":         "Start did not complete; rolling back the network changes made so far...",
+		"log_start_cancelled":        "Connection attempt cancelled.",
+		"notify_connected_msg":       "Connected via %s",
+		"notify_disconnected_msg":    "Disconnected. Traffic no longer goes through the tunnel.",
+		"notify_reconnected_msg":     "Reconnected via %s after a network change",
+		"notify_error_msg":           "Connection error: %v",
+		"notify_fail":                "Failed to show a notification: %v",
+		"step_start":                 "Starting the tunnel",
+		"step_prepare_wintun":        "Preparing wintun.dll",
+		"step_start_tun2socks":       "Starting tun2socks",
+		"step_wait_adapter":          "Waiting for the TUN adapter",
+		"step_configure_address":     "Setting the TUN adapter address",
+		"step_configure_dns":         "Setting the TUN adapter DNS servers",
+		"step_add_routes":            "Adding routes",
+		"start_error_msg":            "The tunnel did not start.\n\nFailed step: %s\n%s",
+		"advice_missing_binary":      "Make sure tun2socks.exe and wintun.dll are in the same folder as TUNTray.exe and have not been quarantined by antivirus software.",
+		"advice_adapter_timeout":     "Check that the wintun driver can load. Close other VPNs that use wintun, and restart the computer if that does not help.",
+		"advice_route_conflict":      "Another program already owns these routes. Close other VPN or proxy software and try again, or choose a different TUN address in the profile.",
+		"advice_permission":          "Run TUNTray as administrator.",
+		"details_step":               "Step",
+		"details_kind":               "Kind",
+		"details_command":            "Command",
+		"details_output":             "Output",
+		"details_error":              "Error",
+		"details_advice":             "Advice",
+		"open_log":                   "Open log",
+		"copy_details":               "Copy details",
+		"close":                      "Close",
+		"copy_details_fail":          "Failed to copy the error details: %v",
+		"open_log_fail":              "Failed to open the log: %v",
+		"statistics":                 "Statistics",
+		"statistics_tooltip":         "Traffic statistics and session history",
+		"session_history":            "Session History",
+		"session_history_tooltip":    "Recent sessions",
+		"no_sessions":                "No sessions yet",
+		"clear_sessions":             "Clear History",
+		"clear_sessions_tooltip":     "Delete all session records",
+		"stats_not_connected":        "Not connected",
+		"stats_rate":                 "↑ %s/s  ↓ %s/s",
+		"stats_total":                "This session: ↑ %s  ↓ %s",
+		"session_entry":              "%s  %v  ↑ %s ↓ %s  (%s)",
+		"log_stats_read_fail":        "Failed to read the TUN adapter counters: %v",
+		"log_session_ended":          "Session ended: sent %s, received %s, lasted %v",
+		"log_sessions_parse_fail":    "Failed to parse the session history: %v",
+		"log_sessions_write_fail":    "Failed to save the session history: %v",
+		"connections":                "Connections",
+		"connections_tooltip":        "View and close connections through the tunnel",
+		"no_connections":             "No connections",
+		"connections_unavailable":    "The tun2socks API is not available (the tunnel is not running, or the profile sets its own -restapi)",
+		"connection_entry":           "%s → %s  ↑ %s ↓ %s  %v",
+		"connection_tooltip":         "%s connection; click to close it",
+		"close_connection":           "Close Connection",
+		"close_connection_confirm":   "Close this connection?\n\n%s",
+		"close_connection_fail":      "Failed to close the connection: %v",
+		"log_connection_closed":      "Closed connection %s",
+		"log_connections_fail":       "Failed to list connections: %v",
+		"log_restapi_fail":           "Could not pick a port for the tun2socks API, connections will not be listed: %v",
+		"restapi_status":             "tun2socks API %s %s returned %s",
+		"view_logs":                  "View Logs",
+		"view_logs_tooltip":          "Browse, filter and export recent log entries",
+		"log_viewer_prompt":          "Filter: %s\nShowing %d of %d entries in memory, newest first",
+		"log_viewer_empty":           "(No matching entries)",
+		"log_filter":                 "Filter...",
+		"log_filter_prompt":          "Which filter do you want to change?",
+		"log_filter_source":          "Source",
+		"log_filter_level":           "Minimum level",
+		"log_filter_search":          "Search text",
+		"log_filter_clear":           "Clear filters",
+		"log_filter_label":           "source %s, level ≥ %s",
+		"log_filter_search_label":    ", containing \"%s\"",
+		"log_source_all":             "all",
+		"log_export":                 "Export...",
+		"log_export_minutes":         "Export the log entries of the last how many minutes (all sources and levels)?",
+		"log_export_minutes_invalid": "Please enter a whole number of minutes.",
+		"log_export_fail":            "Failed to export the logs: %v",
+		"log_exported":               "Exported %d log entries to %s",
+		"diagnostics":                "Create Diagnostics Bundle...",
+		"diagnostics_tooltip":        "Zip the redacted config, logs, routes, adapters, DNS and a proxy probe for a bug report",
+		"diagnostics_zip":            "Zip files",
+		"diagnostics_collecting":     "Collecting diagnostics...",
+		"diagnostics_done":           "The diagnostics bundle was saved to:\n%s\n\nProxy credentials and API tokens have been removed; you may still want to look through it before sending it.",
+		"diagnostics_fail":           "Failed to create the diagnostics bundle: %v",
+		"log_diagnostics_written":    "Diagnostics bundle written to %s",
+		"selftest":                   "Self-Test",
+		"selftest_tooltip":           "Checks after connecting that traffic really gets through the tunnel",
+		"selftest_run":               "Run Again",
+		"selftest_run_tooltip":       "Test the tunnel again now",
+		"selftest_dns":               "DNS",
+		"selftest_tcp":               "TCP",
+		"selftest_http":              "HTTP",
+		"selftest_external_ip":       "External IP",
+		"selftest_running":           "testing...",
+		"selftest_not_run":           "not run yet",
+		"selftest_skipped":           "skipped",
+		"selftest_failed":            "Self-test failed (%s): %v",
+		"selftest_http_status":       "the server answered %s",
+		"selftest_bad_external_ip":   "the answer is not an IP address",
+		"log_selftest_start":         "Running the connection self-test",
+		"log_selftest_step_ok":       "Self-test %s passed: %s (%v)",
+		"log_selftest_step_fail":     "Self-test %s failed: %v",
+		"exit_ip":                    "External IP: %s",
+		"exit_ip_tooltip":            "The address the tunnel exits from; click to look it up again",
+		"exit_ip_checking":           "checking...",
+		"exit_ip_unknown":            "lookup failed",
+		"exit_ip_disabled":           "off",
+		"log_exit_ip":                "External IP: %s",
+		"log_exit_ip_fail":           "Failed to look up the external IP: %v",
+		"log_fake_ip_enabled":        "Fake-IP mode on, range %s",
 	},
 }
 
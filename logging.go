@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TUNTray logs through log/slog. Messages written with the standard log
+// package arrive at info level; failures go through logWarn.
+
+const logFileName = "TUNTray.log"
+
+// LogConfig controls the log file.
+type LogConfig struct {
+	Level      string `json:"level"`        // debug, info, warn or error
+	Format     string `json:"format"`       // text or json
+	MaxSizeMB  int    `json:"max_size_mb"`  // Rotate when the file reaches this size
+	MaxAgeDays int    `json:"max_age_days"` // Delete rotated files older than this; 0 keeps them
+	MaxBackups int    `json:"max_backups"`  // Rotated files to keep; 0 keeps them all
+}
+
+// defaultLogConfig is used for configs written before log settings existed.
+var defaultLogConfig = LogConfig{Level: "info", Format: "text", MaxSizeMB: 10, MaxAgeDays: 14, MaxBackups: 5}
+
+var (
+	logLevel slog.LevelVar
+	logFile  *rotatingFile // nil if the log could not be opened
+)
+
+// setupLogging opens the log with the default settings, so that everything
+// from startup on is recorded. applyLogConfig takes over once the config is
+// loaded.
+func setupLogging() {
+	var err error
+	logFile, err = openRotatingFile(logFileName, defaultLogConfig)
+	if err != nil {
+		// There's nowhere to report this. The application still runs, but
+		// without a log.
+		slog.SetDefault(slog.New(newRingHandler(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: &logLevel}))))
+		return
+	}
+	setLogHandler(defaultLogConfig)
+}
+
+// applyLogConfig switches to the configured level, format and rotation.
+func applyLogConfig(config LogConfig) {
+	if logFile == nil {
+		return
+	}
+	logFile.setLimits(config)
+	setLogHandler(config)
+}
+
+func setLogHandler(config LogConfig) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler
+	if strings.EqualFold(config.Format, "json") {
+		handler = slog.NewJSONHandler(logFile, options)
+	} else {
+		handler = slog.NewTextHandler(logFile, options)
+	}
+	slog.SetDefault(slog.New(newRingHandler(handler)))
+}
+
+// logWarn logs a failure, formatted like log.Printf.
+func logWarn(format string, args ...any) {
+	slog.Warn(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// --- tun2socks output ---
+
+// tun2socksLevels maps the level names tun2socks (zap) and older builds
+// (logrus) write.
+var tun2socksLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"warn":    slog.LevelWarn,
+	"warning": slog.LevelWarn,
+	"error":   slog.LevelError,
+	"fatal":   slog.LevelError,
+	"panic":   slog.LevelError,
+}
+
+// parseTun2socksLine splits a line of tun2socks output into its level and
+// message. It understands zap's console and JSON encodings and logrus'
+// key=value lines; anything else is logged whole at fallback.
+func parseTun2socksLine(line string, fallback slog.Level) (slog.Level, string) {
+	line = strings.TrimSpace(line)
+
+	// {"level":"info","ts":1700000000.1,"msg":"[TCP] ..."}
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Msg != "" {
+			if level, ok := tun2socksLevels[strings.ToLower(entry.Level)]; ok {
+				return level, entry.Msg
+			}
+			return fallback, entry.Msg
+		}
+	}
+
+	// 2024-05-01T10:00:00.000+0800	INFO	[TCP] 198.18.0.1:50000 <-> 1.1.1.1:443
+	if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+		if level, ok := tun2socksLevels[strings.ToLower(fields[1])]; ok {
+			return level, fields[2]
+		}
+	}
+
+	// time="2024-05-01T10:00:00+08:00" level=info msg="[TCP] ..."
+	if i := strings.Index(line, "level="); i >= 0 {
+		rest := line[i+len("level="):]
+		name, _, _ := strings.Cut(rest, " ")
+		if level, ok := tun2socksLevels[strings.ToLower(name)]; ok {
+			if j := strings.Index(rest, "msg="); j >= 0 {
+				msg := rest[j+len("msg="):]
+				if unquoted, err := unquoteLogValue(msg); err == nil {
+					msg = unquoted
+				}
+				return level, msg
+			}
+		}
+	}
+	return fallback, line
+}
+
+// unquoteLogValue reads a double-quoted logrus value, ignoring what follows.
+func unquoteLogValue(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		value, _, _ := strings.Cut(s, " ")
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", fmt.Errorf("unterminated value")
+}
+
+// logTun2socks records a line of tun2socks output from the named stream.
+func logTun2socks(stream, line string) {
+	fallback := slog.LevelInfo
+	if stream == "stderr" {
+		fallback = slog.LevelWarn
+	}
+	level, msg := parseTun2socksLine(line, fallback)
+	slog.Log(context.Background(), level, annotateFakeIPs(msg), "component", "tun2socks", "stream", stream)
+}
+
+// --- Rotation ---
+
+// rotatingFile is an append-only log file that is renamed aside with a
+// timestamp once it reaches its size limit. Old files are pruned by age
+// and count.
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	limits LogConfig
+	// retryAt delays the next attempt after a rotation failed, so that a
+	// file that cannot be moved is not closed and reopened on every write.
+	retryAt time.Time
+}
+
+// rotateRetry is how long to wait before trying a failed rotation again.
+const rotateRetry = time.Minute
+
+func openRotatingFile(path string, limits LogConfig) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, limits: limits}
+	if err := f.open(path); err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+// open starts appending to the file at path.
+func (f *rotatingFile) open(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Name returns the path of the current log file.
+func (f *rotatingFile) Name() string { return f.path }
+
+func (f *rotatingFile) setLimits(limits LogConfig) {
+	f.mu.Lock()
+	f.limits = limits
+	f.mu.Unlock()
+	f.prune()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if max := int64(f.limits.MaxSizeMB) << 20; max > 0 && f.size > 0 && f.size+int64(len(p)) > max && time.Now().After(f.retryAt) {
+		f.rotateLocked()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotateLocked moves the full file aside and starts a new one. If the file
+// cannot be moved, e.g. because another TUNTray has it open, or the new one
+// cannot be created, logging carries on in the old file and rotation is
+// tried again after rotateRetry. Callers must hold f.mu.
+func (f *rotatingFile) rotateLocked() {
+	// Windows cannot rename a file while it is open.
+	f.file.Close()
+	ext := filepath.Ext(f.path)
+	old := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format("20060102-150405") + ext
+	if err := os.Rename(f.path, old); err != nil {
+		old = f.path
+	} else if err := f.open(f.path); err == nil {
+		go f.prune()
+		return
+	}
+	f.retryAt = time.Now().Add(rotateRetry)
+	if err := f.open(old); err != nil {
+		f.file = nil // Nowhere left to write
+	}
+}
+
+// backups lists the rotated files, newest first.
+func (f *rotatingFile) backups() []string {
+	ext := filepath.Ext(f.path)
+	matches, _ := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	// The timestamp in the name sorts chronologically.
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	return matches
+}
+
+// prune deletes rotated files beyond the configured age and count.
+func (f *rotatingFile) prune() {
+	f.mu.Lock()
+	limits := f.limits
+	f.mu.Unlock()
+	for i, path := range f.backups() {
+		expired := false
+		if limits.MaxAgeDays > 0 {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > time.Duration(limits.MaxAgeDays)*24*time.Hour {
+				expired = true
+			}
+		}
+		if expired || (limits.MaxBackups > 0 && i >= limits.MaxBackups) {
+			os.Remove(path)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
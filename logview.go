@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+)
+
+// Recent log entries are also kept in memory, whatever the file's level,
+// for "View Logs" and for exporting the last few minutes.
+
+const (
+	logRingSize      = 5000
+	maxViewerEntries = 500 // Shown at once in the viewer, newest first
+)
+
+// logEntry is a log record as kept in the ring.
+type logEntry struct {
+	Time    time.Time
+	Level   slog.Level
+	Source  string // "app" or "tun2socks"
+	Message string
+	Attrs   string // Other attributes as key=value pairs
+}
+
+func (e logEntry) String() string {
+	line := fmt.Sprintf("%s %-5s [%s] %s", e.Time.Format("2006-01-02 15:04:05"), e.Level, e.Source, e.Message)
+	if e.Attrs != "" {
+		line += " " + e.Attrs
+	}
+	return line
+}
+
+// logRing holds the most recent entries.
+type logRing struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int // Where the next entry goes once the ring is full
+}
+
+var recentLogs = &logRing{}
+
+func (r *logRing) add(e logEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < logRingSize {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % logRingSize
+}
+
+// snapshot returns the entries, oldest first.
+func (r *logRing) snapshot() []logEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]logEntry, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+// ringHandler records every entry in recentLogs before passing it on to
+// the file's handler, which applies the configured level.
+type ringHandler struct {
+	next   slog.Handler
+	source string
+	attrs  []string
+}
+
+func newRingHandler(next slog.Handler) *ringHandler {
+	return &ringHandler{next: next, source: "app"}
+}
+
+func (h *ringHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *ringHandler) Handle(ctx context.Context, r slog.Record) error {
+	e := logEntry{Time: r.Time, Level: r.Level, Source: h.source, Message: r.Message}
+	attrs := append([]string(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "component" {
+			e.Source = a.Value.String()
+		} else {
+			attrs = append(attrs, a.String())
+		}
+		return true
+	})
+	e.Attrs = strings.Join(attrs, " ")
+	recentLogs.add(e)
+
+	if h.next.Enabled(ctx, r.Level) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := &ringHandler{next: h.next.WithAttrs(attrs), source: h.source, attrs: append([]string(nil), h.attrs...)}
+	for _, a := range attrs {
+		if a.Key == "component" {
+			clone.source = a.Value.String()
+		} else {
+			clone.attrs = append(clone.attrs, a.String())
+		}
+	}
+	return clone
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	return &ringHandler{next: h.next.WithGroup(name), source: h.source, attrs: h.attrs}
+}
+
+// --- Filtering ---
+
+// logFilter selects entries for the viewer.
+type logFilter struct {
+	Source   string // "" for all sources
+	MinLevel slog.Level
+	Search   string // Case-insensitive substring; "" matches everything
+}
+
+func (f logFilter) matches(e logEntry) bool {
+	if f.Source != "" && e.Source != f.Source {
+		return false
+	}
+	if e.Level < f.MinLevel {
+		return false
+	}
+	if f.Search != "" && !strings.Contains(strings.ToLower(e.String()), strings.ToLower(f.Search)) {
+		return false
+	}
+	return true
+}
+
+// filterLogs returns the entries matching f, newest first, at most max.
+func filterLogs(entries []logEntry, f logFilter, max int) []logEntry {
+	var out []logEntry
+	for i := len(entries) - 1; i >= 0 && len(out) < max; i-- {
+		if f.matches(entries[i]) {
+			out = append(out, entries[i])
+		}
+	}
+	return out
+}
+
+// logsSince returns the entries from the last d, oldest first.
+func logsSince(entries []logEntry, d time.Duration) []logEntry {
+	cutoff := time.Now().Add(-d)
+	for i, e := range entries {
+		if !e.Time.Before(cutoff) {
+			return entries[i:]
+		}
+	}
+	return nil
+}
+
+// --- Viewer ---
+
+var (
+	mViewLogs     *systray.MenuItem
+	logViewerOpen atomic.Bool
+)
+
+// addViewLogsMenu adds the "View Logs" item.
+func addViewLogsMenu() {
+	mViewLogs = systray.AddMenuItem(GetText("view_logs"), GetText("view_logs_tooltip"))
+}
+
+// refreshViewLogsMenuTexts relabels the item after a language switch.
+func refreshViewLogsMenuTexts() {
+	if mViewLogs == nil {
+		return
+	}
+	mViewLogs.SetTitle(GetText("view_logs"))
+	mViewLogs.SetTooltip(GetText("view_logs_tooltip"))
+}
+
+// showLogViewer lists recent log entries until the user closes it. It runs
+// on its own goroutine, so it must not touch the tunnel.
+func showLogViewer() {
+	if !logViewerOpen.CompareAndSwap(false, true) {
+		return
+	}
+	defer logViewerOpen.Store(false)
+
+	filter := logFilter{MinLevel: slog.LevelInfo}
+	for {
+		all := recentLogs.snapshot()
+		shown := filterLogs(all, filter, maxViewerEntries)
+		lines := make([]string, len(shown))
+		for i, e := range shown {
+			lines[i] = e.String()
+		}
+		if len(lines) == 0 {
+			lines = []string{GetText("log_viewer_empty")}
+		}
+
+		_, err := zenity.List(fmt.Sprintf(GetText("log_viewer_prompt"), filterLabel(filter), len(shown), len(all)), lines,
+			zenity.Title(GetText("view_logs")),
+			zenity.Width(900), zenity.Height(600),
+			zenity.OKLabel(GetText("log_filter")),
+			zenity.ExtraButton(GetText("log_export")),
+			zenity.CancelLabel(GetText("close")))
+		switch {
+		case err == nil:
+			filter = chooseLogFilter(filter)
+		case errors.Is(err, zenity.ErrExtraButton):
+			exportLogs()
+		default:
+			return
+		}
+	}
+}
+
+// filterLabel describes f for the viewer's prompt.
+func filterLabel(f logFilter) string {
+	source := GetText("log_source_all")
+	if f.Source != "" {
+		source = f.Source
+	}
+	label := fmt.Sprintf(GetText("log_filter_label"), source, f.MinLevel)
+	if f.Search != "" {
+		label += fmt.Sprintf(GetText("log_filter_search_label"), f.Search)
+	}
+	return label
+}
+
+// chooseLogFilter asks which part of f to change and returns the result.
+func chooseLogFilter(f logFilter) logFilter {
+	options := []string{GetText("log_filter_source"), GetText("log_filter_level"), GetText("log_filter_search"), GetText("log_filter_clear")}
+	choice, err := zenity.List(GetText("log_filter_prompt"), options,
+		zenity.Title(GetText("log_filter")),
+		zenity.DisallowEmpty())
+	if err != nil {
+		return f
+	}
+	switch choice {
+	case options[0]:
+		sources := []string{GetText("log_source_all"), "app", "tun2socks"}
+		if s, err := zenity.List(GetText("log_filter_source"), sources, zenity.Title(GetText("log_filter")), zenity.DisallowEmpty()); err == nil {
+			f.Source = s
+			if s == sources[0] {
+				f.Source = ""
+			}
+		}
+	case options[1]:
+		levels := []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+		names := make([]string, len(levels))
+		for i, l := range levels {
+			names[i] = l.String()
+		}
+		if s, err := zenity.List(GetText("log_filter_level"), names, zenity.Title(GetText("log_filter")),
+			zenity.DefaultItems(f.MinLevel.String()), zenity.DisallowEmpty()); err == nil {
+			f.MinLevel.UnmarshalText([]byte(s))
+		}
+	case options[2]:
+		if s, err := zenity.Entry(GetText("log_filter_search"), zenity.Title(GetText("log_filter")), zenity.EntryText(f.Search)); err == nil {
+			f.Search = strings.TrimSpace(s)
+		}
+	case options[3]:
+		f = logFilter{MinLevel: slog.LevelInfo}
+	}
+	return f
+}
+
+// exportLogs writes the entries of the last N minutes, from every source and
+// at every level, to a file of the user's choosing.
+func exportLogs() {
+	text, err := zenity.Entry(GetText("log_export_minutes"),
+		zenity.Title(GetText("log_export")),
+		zenity.EntryText("30"))
+	if err != nil {
+		return
+	}
+	minutes, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || minutes <= 0 {
+		zenity.Warning(GetText("log_export_minutes_invalid"), zenity.Title(GetText("log_export")))
+		return
+	}
+	path, err := zenity.SelectFileSave(
+		zenity.Title(GetText("log_export")),
+		zenity.Filename(time.Now().Format("TUNTray-logs-20060102-150405.txt")),
+		zenity.ConfirmOverwrite())
+	if err != nil {
+		return
+	}
+
+	entries := logsSince(recentLogs.snapshot(), time.Duration(minutes)*time.Minute)
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.String())
+		b.WriteString("\r\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		logWarn(GetText("log_export_fail"), err)
+		zenity.Error(fmt.Sprintf(GetText("log_export_fail"), err), zenity.Title(GetText("log_export")))
+		return
+	}
+	slog.Info(fmt.Sprintf(GetText("log_exported"), len(entries), path))
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -22,19 +27,53 @@ import (
 
 // --- Constants ---
 const (
-	tunAlias       = "wintun"
-	tunIP          = "192.168.123.1"
-	tunMask        = "255.255.255.0"
-	tunDNS         = "8.8.8.8"
-	configFile     = "config.json"
-	oldProxiesFile = "proxies.json"
+	tunAlias           = "wintun"
+	defaultTunIP       = "192.168.123.1"
+	defaultTunMask     = "255.255.255.0"
+	defaultTunDNS      = "8.8.8.8"
+	defaultProfileName = "Default"
+	configFile         = "config.json"
+	oldProxiesFile     = "proxies.json"
 )
 
+// supportedProxySchemes lists the proxy protocols accepted by tun2socks' -proxy flag.
+var supportedProxySchemes = map[string]bool{
+	"http":   true,
+	"socks4": true,
+	"socks5": true,
+	"ss":     true,
+	"relay":  true,
+}
+
 // --- App Configuration ---
 type AppConfig struct {
-	Proxies           []string `json:"proxies"`
-	LastSelectedProxy string   `json:"last_selected_proxy"`
-	Language          Language `json:"language"`
+	Proxies              []string            `json:"proxies"`
+	LastSelectedProxy    string              `json:"last_selected_proxy"`
+	Language             Language            `json:"language"`
+	Profiles             []Profile           `json:"profiles"`
+	ActiveProfile        string              `json:"active_profile"`
+	AutoConnect          bool                `json:"auto_connect"`                // Start the tunnel when TUNTray launches
+	AutoReconnect        bool                `json:"reconnect_on_network_change"` // Restart or re-route after network changes
+	NetworkRules         []NetworkRule       `json:"network_rules,omitempty"`
+	DefaultNetworkAction string              `json:"default_network_action,omitempty"` // Action when no rule matches; empty does nothing
+	RulesPaused          bool                `json:"rules_paused"`
+	KillSwitch           bool                `json:"kill_switch"`                 // Block non-tunnel traffic while connected
+	KillSwitchEngaged    bool                `json:"kill_switch_engaged"`         // Firewall rules are in place; survives crashes
+	KillSwitchAllow      []string            `json:"kill_switch_allow,omitempty"` // Extra IPv4 CIDRs reachable outside the tunnel
+	DNSForwarder         DNSForwarderConfig  `json:"dns_forwarder"`
+	DNSBlocked           bool                `json:"dns_blocked"`             // DNS on other adapters is blocked; lifted on next launch after a crash
+	Tun2socksPID         int                 `json:"tun2socks_pid,omitempty"` // The tun2socks process TUNTray started, so "TUNTray stop" can end it after a crash
+	AppRouting           bool                `json:"app_routing"`             // Tunnel only the programs selected by AppRules
+	AppRules             []AppRule           `json:"app_rules,omitempty"`
+	RuleRouting          bool                `json:"rule_routing"`             // Dispatch connections by RoutingRules
+	RoutingRules         []string            `json:"routing_rules,omitempty"`  // Clash-style, e.g. "DOMAIN-SUFFIX,github.com,PROXY"
+	GeoIPDatabase        string              `json:"geoip_database,omitempty"` // MMDB file for GEOIP rules; defaults to Country.mmdb
+	API                  APIConfig           `json:"api"`
+	Notifications        NotificationsConfig `json:"notifications"`
+	Log                  LogConfig           `json:"log"`
+	SelfTest             SelfTestConfig      `json:"self_test"`
+	ExternalIP           ExternalIPConfig    `json:"external_ip"`
+	Chain                []string            `json:"chain,omitempty"` // Deprecated: migrated into the first profile
 }
 
 // initializeLanguage sets up the language based on config or system default
@@ -42,18 +81,18 @@ func initializeLanguage(configLoaded bool) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	log.Printf("Initializing language. Config language: %v, configLoaded: %v\n", appConfig.Language, configLoaded)
+	slog.Debug("Initializing language", "config_language", appConfig.Language, "config_loaded", configLoaded)
 
 	// If language is not set in config (Unset), default to English
 	if appConfig.Language == Unset {
-		log.Println("Language not set in config, defaulting to English...")
-		appConfig.Language = English  // Default to English
+		slog.Debug("Language not set in config, defaulting to English")
+		appConfig.Language = English // Default to English
 		SetLanguage(appConfig.Language)
 		saveConfig()
-		log.Printf("Default language set to: %v\n", appConfig.Language)
+		slog.Debug("Default language set", "language", appConfig.Language)
 	} else {
 		SetLanguage(appConfig.Language)
-		log.Printf("Language loaded from config: %v\n", appConfig.Language)
+		slog.Debug("Language loaded from config", "language", appConfig.Language)
 	}
 
 	// For existing configs that don't have language field, we can't detect it
@@ -70,42 +109,101 @@ func initializeLanguage(configLoaded bool) {
 // --- Global State ---
 var (
 	tun2socksCmd         *exec.Cmd
-	appConfig            AppConfig // Holds the entire application configuration
-	proxies              []string  // Kept for convenience, mirrors appConfig.Proxies
-	currentProxy         string
+	tun2socksDone        chan struct{} // Closed when the running tun2socks process exits
+	appConfig            AppConfig     // Holds the entire application configuration
+	proxies              []string      // Kept for convenience, mirrors appConfig.Proxies
+	currentProxy         string        // Mirrors the active profile's proxy
+	runningProfile       Profile       // Snapshot of the profile the tunnel was started with
 	mStart               *systray.MenuItem
 	mStop                *systray.MenuItem
+	mCancel              *systray.MenuItem
 	mSelectProxy         *systray.MenuItem
 	mDeleteProxy         *systray.MenuItem
 	mManageProxies       *systray.MenuItem
 	mAddNewProxy         *systray.MenuItem
+	mImportClipboard     *systray.MenuItem
+	mAddTypedProxy       *systray.MenuItem
+	mEditProxy           *systray.MenuItem
+	mChain               *systray.MenuItem
+	mConfigureChain      *systray.MenuItem
+	mClearChain          *systray.MenuItem
+	mProfiles            *systray.MenuItem
+	mNewProfile          *systray.MenuItem
+	mEditProfile         *systray.MenuItem
+	mDeleteProfile       *systray.MenuItem
+	mSettings            *systray.MenuItem
+	mAutoConnect         *systray.MenuItem
+	mAutoReconnect       *systray.MenuItem
+	mPauseRules          *systray.MenuItem
+	mAddNetworkRule      *systray.MenuItem
+	mKillSwitch          *systray.MenuItem
+	mReleaseKillSwitch   *systray.MenuItem
+	mDNSForwarder        *systray.MenuItem
+	mBlockOtherDNS       *systray.MenuItem
+	mConfigureDNS        *systray.MenuItem
+	mRuleRouting         *systray.MenuItem
+	mAPI                 *systray.MenuItem
+	mCopyAPIToken        *systray.MenuItem
+	mTestRules           *systray.MenuItem
+	mAppRouting          *systray.MenuItem
+	mEnableAppRouting    *systray.MenuItem
+	mAddAppRule          *systray.MenuItem
+	mRemoveAppRules      *systray.MenuItem
+	mTunnelledApps       *systray.MenuItem
+	mNoTunnelledApps     *systray.MenuItem
 	mQuit                *systray.MenuItem
 	mLanguage            *systray.MenuItem
 	proxyMenuItems       map[string]*systray.MenuItem
 	deleteProxyMenuItems map[string]*systray.MenuItem
+	profileMenuItems     map[string]*systray.MenuItem
+	languageMenuItems    map[Language]*systray.MenuItem
 	mu                   sync.RWMutex
-	logFile              *os.File
+	chainServer          *socksServer
+	dnsServer            *dnsForwarder
 )
 
 //go:embed winres/icon.ico
 var iconData []byte
 
 func main() {
-	// Set up logging to a file.
-	var err error
-	// Use O_APPEND to keep a running log across application restarts.
-	logFile, err = os.OpenFile("TUNTray.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err == nil {
-		// When compiled with -H=windowsgui, stdout is discarded, so writing to it
-		// via MultiWriter can cause issues. We will log exclusively to the file.
-		log.SetOutput(logFile)
-	} else {
-		// If we can't even open the log file, there's nowhere to log the error.
-		// The application will still run, but without logging.
+	// Command line invocations may come from any directory, but config.json,
+	// tun2socks.exe and the log live next to the executable.
+	cli := len(os.Args) > 1 && cliCommands[os.Args[1]]
+	if cli {
+		if exe, err := os.Executable(); err == nil {
+			os.Chdir(filepath.Dir(exe))
+		}
 	}
-	log.SetFlags(log.Ldate | log.Ltime)
+
+	// Set up logging to a file. When compiled with -H=windowsgui, stdout is
+	// discarded, so we log exclusively to the file.
+	setupLogging()
 	log.Println("--- Application Starting ---")
 
+	if cli {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
+	var err error
+	pendingLaunch, err = parseLaunchArgs(os.Args[1:])
+	if err != nil {
+		log.Printf(GetText("log_launch_args_invalid")+"\n", err)
+	}
+	if !acquireInstanceLock() {
+		// Another TUNTray owns the tunnel; pass our arguments on to it.
+		configLoaded, _ := loadConfig()
+		initializeLanguage(configLoaded)
+		log.Println(GetText("log_instance_forward"))
+		if !pendingLaunch.empty() {
+			if err := forwardLaunch(os.Args[1:]); err != nil {
+				logWarn(GetText("instance_forward_fail"), err)
+				zenity.Error(err.Error(), zenity.Title(GetText("app_title")), zenity.ErrorIcon)
+			}
+		} else {
+			zenity.Info(GetText("instance_already_running"), zenity.Title(GetText("app_title")))
+		}
+		os.Exit(0)
+	}
 	systray.Run(onReady, onExit)
 }
 
@@ -120,6 +218,22 @@ func isElevated() bool {
 	return err == nil
 }
 
+// hiddenCommand prepares a console helper such as netsh or powershell so it
+// runs without flashing a window.
+func hiddenCommand(name string, args ...string) *exec.Cmd {
+	return hiddenCommandContext(context.Background(), name, args...)
+}
+
+// hiddenCommandContext is hiddenCommand with a context that kills the
+// helper when done.
+func hiddenCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if runtime.GOOS == "windows" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	}
+	return cmd
+}
+
 func onReady() {
 	if !isElevated() {
 		zenity.Error(GetText("permission_error_msg"),
@@ -129,7 +243,7 @@ func onReady() {
 		return
 	}
 
-	systray.SetIcon(iconData)
+	systray.SetIcon(stateIcon(stateDisconnected))
 
 	configLoaded, _ := loadConfig()
 
@@ -141,8 +255,23 @@ func onReady() {
 
 	mStart = systray.AddMenuItem(GetText("start"), GetText("start_tooltip"))
 	mStop = systray.AddMenuItem(GetText("stop"), GetText("stop_tooltip"))
+	mCancel = systray.AddMenuItem(GetText("cancel"), GetText("cancel_tooltip"))
+	mCancel.Hide()
+	mReleaseKillSwitch = systray.AddMenuItem(GetText("release_kill_switch"), GetText("release_kill_switch_tooltip"))
 	systray.AddSeparator()
 
+	// --- Profiles Menu ---
+	mProfiles = systray.AddMenuItem(GetText("profiles"), GetText("profiles_tooltip"))
+	mNewProfile = mProfiles.AddSubMenuItem(GetText("new_profile"), GetText("new_profile_tooltip"))
+	mEditProfile = mProfiles.AddSubMenuItem(GetText("edit_profile"), GetText("edit_profile_tooltip"))
+	mDeleteProfile = mProfiles.AddSubMenuItem(GetText("delete_profile"), GetText("delete_profile_tooltip"))
+	profileMenuItems = make(map[string]*systray.MenuItem)
+	mu.Lock()
+	for _, p := range appConfig.Profiles {
+		addProfileMenuItemLocked(p.Name)
+	}
+	mu.Unlock()
+
 	// --- Select Proxy Menu ---
 	mSelectProxy = systray.AddMenuItem(GetText("select_proxy"), GetText("select_tooltip"))
 	proxyMenuItems = make(map[string]*systray.MenuItem)
@@ -159,9 +288,17 @@ func onReady() {
 		}(p, item)
 	}
 
+	// --- Proxy Chain Menu ---
+	mChain = systray.AddMenuItem(GetText("proxy_chain"), GetText("chain_tooltip"))
+	mConfigureChain = mChain.AddSubMenuItem(GetText("configure_chain"), GetText("configure_chain_tooltip"))
+	mClearChain = mChain.AddSubMenuItem(GetText("clear_chain"), GetText("clear_chain_tooltip"))
+
 	// --- Manage Proxy Menu ---
 	mManageProxies = systray.AddMenuItem(GetText("manage_proxies"), GetText("manage_tooltip"))
 	mAddNewProxy = mManageProxies.AddSubMenuItem(GetText("add_new_proxy"), GetText("add_tooltip"))
+	mImportClipboard = mManageProxies.AddSubMenuItem(GetText("add_from_clipboard"), GetText("clipboard_tooltip"))
+	mAddTypedProxy = mManageProxies.AddSubMenuItem(GetText("add_typed_proxy"), GetText("add_typed_tooltip"))
+	mEditProxy = mManageProxies.AddSubMenuItem(GetText("edit_proxy"), GetText("edit_tooltip"))
 	mDeleteProxy = mManageProxies.AddSubMenuItem(GetText("delete_proxy"), GetText("delete_tooltip"))
 	deleteProxyMenuItems = make(map[string]*systray.MenuItem)
 	if len(proxies) > 0 {
@@ -181,8 +318,46 @@ func onReady() {
 		mDeleteProxy.Disable()
 	}
 
+	// --- Per-App Routing Menu ---
+	mu.RLock()
+	mAppRouting = systray.AddMenuItem(GetText("app_routing"), GetText("app_routing_tooltip"))
+	mEnableAppRouting = mAppRouting.AddSubMenuItemCheckbox(GetText("enable_app_routing"), GetText("enable_app_routing_tooltip"), appConfig.AppRouting)
+	mu.RUnlock()
+	mAddAppRule = mAppRouting.AddSubMenuItem(GetText("add_app_rule"), GetText("add_app_rule_tooltip"))
+	mRemoveAppRules = mAppRouting.AddSubMenuItem(GetText("remove_app_rules"), GetText("remove_app_rules_tooltip"))
+	mTunnelledApps = mAppRouting.AddSubMenuItem(GetText("tunnelled_apps"), GetText("tunnelled_apps_tooltip"))
+	mNoTunnelledApps = mTunnelledApps.AddSubMenuItem(GetText("no_tunnelled_apps"), GetText("no_tunnelled_apps"))
+	mNoTunnelledApps.Disable()
+
+	// --- Statistics Menu ---
+	loadSessions()
+	addExitMenu()
+	addStatisticsMenu()
+	addConnectionsMenu()
+	addSelfTestMenu()
+	addViewLogsMenu()
+	addDiagnosticsMenu()
+
 	systray.AddSeparator()
 
+	// --- Settings Menu ---
+	mu.RLock()
+	mSettings = systray.AddMenuItem(GetText("settings"), GetText("settings_tooltip"))
+	mAutoConnect = mSettings.AddSubMenuItemCheckbox(GetText("auto_connect"), GetText("auto_connect_tooltip"), appConfig.AutoConnect)
+	mAutoReconnect = mSettings.AddSubMenuItemCheckbox(GetText("auto_reconnect"), GetText("auto_reconnect_tooltip"), appConfig.AutoReconnect)
+	mPauseRules = mSettings.AddSubMenuItemCheckbox(GetText("pause_rules"), GetText("pause_rules_tooltip"), appConfig.RulesPaused)
+	mAddNetworkRule = mSettings.AddSubMenuItem(GetText("add_network_rule"), GetText("add_network_rule_tooltip"))
+	mKillSwitch = mSettings.AddSubMenuItemCheckbox(GetText("kill_switch"), GetText("kill_switch_tooltip"), appConfig.KillSwitch)
+	mDNSForwarder = mSettings.AddSubMenuItemCheckbox(GetText("dns_forwarder"), GetText("dns_forwarder_tooltip"), appConfig.DNSForwarder.Enabled)
+	mBlockOtherDNS = mSettings.AddSubMenuItemCheckbox(GetText("block_other_dns"), GetText("block_other_dns_tooltip"), appConfig.DNSForwarder.SuppressOtherDNS)
+	mConfigureDNS = mSettings.AddSubMenuItem(GetText("configure_dns"), GetText("configure_dns_tooltip"))
+	mRuleRouting = mSettings.AddSubMenuItemCheckbox(GetText("rule_routing"), GetText("rule_routing_tooltip"), appConfig.RuleRouting)
+	mTestRules = mSettings.AddSubMenuItem(GetText("test_rules"), GetText("test_rules_tooltip"))
+	mAPI = mSettings.AddSubMenuItemCheckbox(GetText("control_api"), GetText("control_api_tooltip"), appConfig.API.Enabled)
+	mCopyAPIToken = mSettings.AddSubMenuItem(GetText("copy_api_token"), GetText("copy_api_token_tooltip"))
+	addNotificationsMenuLocked()
+	mu.RUnlock()
+
 	// --- Language Menu ---
 	_, languageSubMenus := createLanguageMenu()
 	go handleLanguageSelection(languageSubMenus)
@@ -190,74 +365,392 @@ func onReady() {
 	systray.AddSeparator()
 	mQuit = systray.AddMenuItem(GetText("quit"), "Quit program")
 
-	mStop.Disable()
+	updateTrayState()
+	go refreshUptime()
+	mu.RLock()
+	updateKillSwitchMenuLocked()
+	mu.RUnlock()
 
-	// Set initial proxy based on saved config
-	initialProxy := ""
-	if len(proxies) > 0 {
-		// Check if the last selected proxy is still valid
-		lastProxyIsValid := false
-		for _, p := range proxies {
-			if p == appConfig.LastSelectedProxy {
-				lastProxyIsValid = true
-				break
-			}
-		}
+	// Restore the active profile and its proxy selection from the saved config
+	mu.Lock()
+	applyActiveProfileLocked()
+	mu.Unlock()
 
-		if lastProxyIsValid {
-			initialProxy = appConfig.LastSelectedProxy
-		} else {
-			initialProxy = proxies[0] // Fallback to the first one
-		}
-		setProxy(initialProxy)
-	}
+	// DNS blocked by a previous run that did not exit cleanly would leave the
+	// machine without name resolution.
+	unblockOtherDNS()
+
+	go watchNetwork()
+	startInstanceEndpoint()
+	startAPI()
 
 	// --- Main Event Loop ---
 	go func() {
+		// Launch arguments take precedence over network rules, and network
+		// rules over auto-connect.
+		mu.RLock()
+		autoConnect := appConfig.AutoConnect
+		mu.RUnlock()
+		autoConnectPending := false // Until the network rules have had their say
+		if !pendingLaunch.empty() {
+			if _, err := applyLaunchArgs(pendingLaunch); err != nil {
+				logWarn(GetText("launch_args_fail"), err)
+			}
+		} else if networkRulesActive() {
+			autoConnectPending = autoConnect
+			requestRuleCheck()
+		} else if autoConnect {
+			log.Println(GetText("log_auto_connect"))
+			handleStart()
+		}
+
 		for {
 			select {
+			case change := <-networkChanges:
+				if change.LinkChanged || change.Resumed || change.RuleCheck {
+					applied, changed := evaluateNetworkRules(change.Network)
+					if !applied && autoConnectPending {
+						log.Println(GetText("log_auto_connect"))
+						handleStart()
+						changed = true
+					}
+					autoConnectPending = false
+					if changed || change.RuleCheck {
+						continue
+					}
+				}
+				handleNetworkChange(change)
+			case <-mAutoConnect.ClickedCh:
+				toggleSetting(mAutoConnect, &appConfig.AutoConnect)
+			case <-mAutoReconnect.ClickedCh:
+				toggleSetting(mAutoReconnect, &appConfig.AutoReconnect)
+			case <-mPauseRules.ClickedCh:
+				toggleSetting(mPauseRules, &appConfig.RulesPaused)
+				if !mPauseRules.Checked() {
+					requestRuleCheck()
+				}
+			case <-mAddNetworkRule.ClickedCh:
+				go addRuleForCurrentNetwork()
+			case <-mKillSwitch.ClickedCh:
+				toggleKillSwitch()
+			case <-mReleaseKillSwitch.ClickedCh:
+				releaseKillSwitch()
+			case <-mDNSForwarder.ClickedCh:
+				toggleSetting(mDNSForwarder, &appConfig.DNSForwarder.Enabled)
+				if tunnelRunning() {
+					zenity.Info(GetText("dns_next_start"), zenity.Title(GetText("dns_forwarder")))
+				}
+			case <-mBlockOtherDNS.ClickedCh:
+				toggleSetting(mBlockOtherDNS, &appConfig.DNSForwarder.SuppressOtherDNS)
+				if tunnelRunning() {
+					zenity.Info(GetText("dns_next_start"), zenity.Title(GetText("block_other_dns")))
+				}
+			case <-mConfigureDNS.ClickedCh:
+				configureDNSForwarder()
+			case <-mRuleRouting.ClickedCh:
+				toggleSetting(mRuleRouting, &appConfig.RuleRouting)
+				if tunnelRunning() {
+					zenity.Info(GetText("rules_next_start"), zenity.Title(GetText("rule_routing")))
+				}
+			case <-mTestRules.ClickedCh:
+				testRules()
+			case <-mAPI.ClickedCh:
+				toggleAPI()
+			case <-mCopyAPIToken.ClickedCh:
+				copyAPIToken()
+			case <-mNotifyConnected.ClickedCh:
+				toggleSetting(mNotifyConnected, &appConfig.Notifications.Connected)
+			case <-mNotifyDisconnected.ClickedCh:
+				toggleSetting(mNotifyDisconnected, &appConfig.Notifications.Disconnected)
+			case <-mNotifyReconnected.ClickedCh:
+				toggleSetting(mNotifyReconnected, &appConfig.Notifications.Reconnected)
+			case <-mViewLogs.ClickedCh:
+				go showLogViewer() // Left open while the app carries on
+			case <-mDiagnostics.ClickedCh:
+				go createDiagnosticsBundle()
+			case <-mClearSessions.ClickedCh:
+				clearSessions()
+			case <-mNotifyErrors.ClickedCh:
+				toggleSetting(mNotifyErrors, &appConfig.Notifications.Errors)
+			case call := <-apiCalls:
+				handleAPICall(call)
+			case <-mEnableAppRouting.ClickedCh:
+				toggleSetting(mEnableAppRouting, &appConfig.AppRouting)
+				if tunnelRunning() {
+					zenity.Info(GetText("app_rules_next_start"), zenity.Title(GetText("app_routing")))
+				}
+			case <-mAddAppRule.ClickedCh:
+				addAppRule()
+			case <-mRemoveAppRules.ClickedCh:
+				removeAppRules()
+			case op := <-opFinished:
+				finishOp(op)
+			case result := <-selfTestFinished:
+				finishSelfTest(result)
+			case <-mExitIP.ClickedCh:
+				refreshExit()
+			case <-mRunSelfTest.ClickedCh:
+				startSelfTest(true)
 			case <-mStart.ClickedCh:
-				handleStart()
+				handleStart().interactive = true
 			case <-mStop.ClickedCh:
 				handleStop()
+			case <-mCancel.ClickedCh:
+				handleStop()
 			case <-mQuit.ClickedCh:
+				// Roll back a half-finished start before exiting.
+				cancelStart()
 				systray.Quit()
 				return
 			case <-mAddNewProxy.ClickedCh:
 				if !mStart.Disabled() {
 					addNewProxy()
 				}
+			case <-mImportClipboard.ClickedCh:
+				if !mStart.Disabled() {
+					importProxiesFromClipboard()
+				}
+			case <-mAddTypedProxy.ClickedCh:
+				if !mStart.Disabled() {
+					addTypedProxy()
+				}
+			case <-mEditProxy.ClickedCh:
+				if !mStart.Disabled() {
+					editProxy()
+				}
+			case <-mConfigureChain.ClickedCh:
+				if !mStart.Disabled() {
+					configureChain()
+				}
+			case <-mClearChain.ClickedCh:
+				if !mStart.Disabled() {
+					clearChain()
+				}
+			case <-mNewProfile.ClickedCh:
+				if !mStart.Disabled() {
+					newProfileFromActive()
+				}
+			case <-mEditProfile.ClickedCh:
+				if !mStart.Disabled() {
+					editActiveProfile()
+				}
+			case <-mDeleteProfile.ClickedCh:
+				if !mStart.Disabled() {
+					deleteActiveProfile()
+				}
 			}
 		}
 	}()
 }
 
-func handleStart() {
+// tunnelOp is a start, reconnect or stop running in the background, so the
+// menu stays responsive while the adapter comes up or goes away.
+type tunnelOp struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once finishOp has run
+	err    error
+
+	interactive bool               // Started from the menu, so failures get a dialog
+	stopping    bool               // A stop, which runs to completion even if cancelled
+	finish      func(op *tunnelOp) // Records the outcome; nil for starts and reconnects
+	next        *tunnelOp          // A start waiting for this stop to finish
+}
+
+var (
+	activeOp   *tunnelOp // Owned by the main event loop
+	opFinished = make(chan *tunnelOp)
+)
+
+// handleStart starts the tunnel in the background for the Start menu item,
+// the control API and automation, and returns the operation to wait on. It
+// begins once a stop in progress is done. It must run on the main event
+// loop, which completes the operation.
+func handleStart() *tunnelOp {
+	if activeOp == nil {
+		return beginStart(&tunnelOp{})
+	}
+	if activeOp.stopping && activeOp.next == nil {
+		activeOp.next = &tunnelOp{done: make(chan struct{})}
+	}
+	if activeOp.next != nil {
+		return activeOp.next
+	}
+	return activeOp
+}
+
+// beginStart starts the tunnel for op.
+func beginStart(op *tunnelOp) *tunnelOp {
 	log.Println(GetText("log_starting"))
-	if err := startTun(); err != nil {
-		log.Printf(GetText("start_fail")+": %v\n", err)
-	} else {
+	setState(stateConnecting, nil)
+	return runOp(op, startTun)
+}
+
+func runTunnelOp(fn func(context.Context) error) *tunnelOp {
+	return runOp(&tunnelOp{}, fn)
+}
+
+// runOp runs fn for op on its own goroutine.
+func runOp(op *tunnelOp, fn func(context.Context) error) *tunnelOp {
+	op.ctx, op.cancel = context.WithCancel(context.Background())
+	if op.done == nil {
+		op.done = make(chan struct{})
+	}
+	activeOp = op
+	ctx := op.ctx
+	go func() {
+		op.err = fn(ctx)
+		opFinished <- op
+	}()
+	return op
+}
+
+// finishOp records the outcome of op on the main event loop.
+func finishOp(op *tunnelOp) {
+	activeOp = nil
+	switch {
+	case op.finish != nil:
+		op.finish(op)
+	case op.err == nil:
+		// A start that completed before it was cancelled is still up, and
+		// handleStop takes it down like any other.
 		log.Println(GetText("start_success"))
-		mStart.Disable()
-		mStop.Enable()
+		setState(stateConnected, nil)
+		applyKillSwitch()
+		startSelfTest(false)
+	case op.ctx.Err() != nil:
+		// Cancelling is an explicit disconnect, like Stop.
+		log.Println(GetText("log_start_cancelled"))
+		op.err = op.ctx.Err()
+		setState(stateDisconnected, nil)
+		releaseKillSwitch()
+	case op.err != nil:
+		// Leave any kill switch engaged: the user did not ask to disconnect.
+		slog.Error(GetText("start_fail"), "error", op.err)
+		setState(stateError, op.err)
+		if op.interactive {
+			go showStartError(op.err)
+		}
+		mu.RLock()
+		updateKillSwitchMenuLocked()
+		mu.RUnlock()
+	}
+	op.cancel()
+	close(op.done)
+
+	if next := op.next; next != nil {
+		if op.err != nil {
+			next.err = op.err
+			close(next.done)
+		} else {
+			beginStart(next)
+		}
 	}
 }
 
-func handleStop() {
+// finishStop records the outcome of a stop.
+func finishStop(op *tunnelOp) {
+	if op.err != nil {
+		slog.Error(GetText("stop_fail"), "error", op.err)
+		notifyError(op.err)
+		return
+	}
+	log.Println(GetText("stop_success"))
+	setState(stateDisconnected, nil)
+	// An explicit disconnect is the only time the kill switch is lifted.
+	releaseKillSwitch()
+}
+
+// dropNext abandons the start waiting for op, if any.
+func dropNext(op *tunnelOp) {
+	if op.next != nil {
+		op.next.err = context.Canceled
+		close(op.next.done)
+		op.next = nil
+	}
+}
+
+// cancelStart aborts the start or reconnect in progress, if any, and waits
+// for it to roll back. A stop in progress is waited for, but nothing starts
+// after it.
+func cancelStart() {
+	if activeOp == nil {
+		return
+	}
+	dropNext(activeOp)
+	activeOp.cancel()
+	finishOp(<-opFinished)
+}
+
+// waitForOp waits for the operation in progress, if any, to finish.
+func waitForOp() {
+	if activeOp != nil {
+		finishOp(<-opFinished)
+	}
+}
+
+// applyKillSwitch engages or refreshes the kill switch for the running
+// tunnel when the option is on.
+func applyKillSwitch() {
+	mu.RLock()
+	enabled := appConfig.KillSwitch
+	profile := runningProfile
+	updateKillSwitchMenuLocked()
+	mu.RUnlock()
+	if !enabled {
+		return
+	}
+	if err := engageKillSwitch(profile); err != nil {
+		logWarn(GetText("kill_switch_engage_fail"), err)
+		notifyError(fmt.Errorf(GetTextWithFormat("kill_switch_engage_fail"), err))
+	}
+}
+
+// handleStop stops the tunnel in the background for the Stop menu item and
+// the control API, and returns the operation to wait on. A start still in
+// progress is cancelled instead, returning nil unless it had already
+// finished. It must run on the main event loop, which completes the
+// operation.
+func handleStop() *tunnelOp {
+	if activeOp != nil {
+		if activeOp.stopping {
+			// Whatever began it, it now ends as an explicit disconnect.
+			activeOp.finish = finishStop
+			dropNext(activeOp)
+			return activeOp
+		}
+		cancelStart()
+		if s, _ := currentState(); !s.connected() {
+			return nil
+		}
+	}
 	log.Println(GetText("log_stopping"))
-	if err := stopTun(); err != nil {
-		log.Printf(GetText("stop_fail")+": %v\n", err)
+	// Cleanup runs to the end: a half-removed route is worse than waiting.
+	return runOp(&tunnelOp{stopping: true, finish: finishStop}, func(context.Context) error { return stopTun() })
+}
+
+// toggleSetting flips a boolean option and its checkbox, then saves the config.
+func toggleSetting(item *systray.MenuItem, setting *bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	*setting = !*setting
+	if *setting {
+		item.Check()
 	} else {
-		log.Println(GetText("stop_success"))
-		mStop.Disable()
-		mStart.Enable()
+		item.Uncheck()
 	}
+	saveConfig()
 }
 
 func onExit() {
+	stopTrafficMonitor() // Record the session
 	if tun2socksCmd != nil && tun2socksCmd.Process != nil {
 		stopTun()
 	}
+	// Quitting is an explicit disconnect too.
+	releaseKillSwitch()
+	stopAPI()
+	stopInstanceEndpoint()
 	log.Println("--- Application Exiting ---")
 	if logFile != nil {
 		logFile.Close()
@@ -281,6 +774,7 @@ func setProxy(proxyAddr string) {
 
 	currentProxy = proxyAddr
 	appConfig.LastSelectedProxy = proxyAddr
+	activeProfileLocked().Proxy = proxyAddr
 	saveConfig() // Save config while holding the lock
 
 	log.Printf(GetText("log_proxy_switch")+"\n", currentProxy)
@@ -318,19 +812,58 @@ func addNewProxy() {
 	mu.Lock()
 	defer mu.Unlock()
 
-	// Check for duplicates
+	if err := validateProxy(newProxy); err != nil {
+		log.Printf(GetText("log_proxy_rejected")+"\n", newProxy, err)
+		zenity.Warning(err.Error(), zenity.Title(GetText("add_proxy_failed")))
+		return
+	}
+	addProxyLocked(newProxy)
+
+	zenity.Info(GetText("add_proxy_success"), zenity.Title(GetText("operation_success")))
+}
+
+// validateProxy checks that proxyAddr is a well-formed tun2socks proxy URL
+// and is not already in the list. Callers must hold mu.
+func validateProxy(proxyAddr string) error {
+	if proxyAddr == "" {
+		return errors.New(GetText("proxy_empty_error"))
+	}
+	u, err := url.Parse(proxyAddr)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), proxyAddr)
+	}
+	if !supportedProxySchemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf(GetTextWithFormat("proxy_scheme_error"), u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), proxyAddr)
+	}
 	for _, p := range appConfig.Proxies {
-		if p == newProxy {
-			log.Printf(GetText("proxy_exists_error")+" ", newProxy)
-			zenity.Warning(GetText("proxy_exists_error"), zenity.Title(GetText("add_proxy_failed")))
-			return
+		if p == proxyAddr {
+			return errors.New(GetText("proxy_exists_error"))
 		}
 	}
+	return nil
+}
 
+// addProxyLocked appends an already validated proxy to the config and adds
+// it to the "Select Proxy" and "Delete Proxy" menus. Callers must hold mu.
+func addProxyLocked(newProxy string) {
 	appConfig.Proxies = append(appConfig.Proxies, newProxy)
 	proxies = appConfig.Proxies // Keep the convenience slice in sync
 	saveConfig()
 
+	addProxyMenuItemsLocked(newProxy)
+
+	log.Printf(GetText("log_proxy_added")+"", newProxy)
+}
+
+// addProxyMenuItemsLocked adds newProxy to the "Select Proxy" and
+// "Delete Proxy" menus. Callers must hold mu.
+func addProxyMenuItemsLocked(newProxy string) {
+	if mSelectProxy == nil {
+		return
+	}
 	// Dynamically add to "Select Proxy" menu
 	itemSelect := mSelectProxy.AddSubMenuItem(newProxy, newProxy)
 	proxyMenuItems[newProxy] = itemSelect
@@ -357,9 +890,19 @@ func addNewProxy() {
 			}
 		}
 	}(newProxy, itemDelete)
+}
 
-	log.Printf(GetText("log_proxy_added")+"", newProxy)
-	zenity.Info(GetText("add_proxy_success"), zenity.Title(GetText("operation_success")))
+// removeProxyMenuItemsLocked hides proxyAddr's entries in the "Select Proxy"
+// and "Delete Proxy" menus. Callers must hold mu.
+func removeProxyMenuItemsLocked(proxyAddr string) {
+	if item, ok := proxyMenuItems[proxyAddr]; ok {
+		item.Hide()
+		delete(proxyMenuItems, proxyAddr)
+	}
+	if item, ok := deleteProxyMenuItems[proxyAddr]; ok {
+		item.Hide()
+		delete(deleteProxyMenuItems, proxyAddr)
+	}
 }
 
 func deleteProxy(proxyAddr string) {
@@ -384,22 +927,17 @@ func deleteProxy(proxyAddr string) {
 
 	appConfig.Proxies = newProxies
 	proxies = appConfig.Proxies // Keep the convenience slice in sync
+	removeFromChainLocked(proxyAddr, "")
 
 	// --- Update UI ---
-	if item, ok := proxyMenuItems[proxyAddr]; ok {
-		item.Hide()
-		delete(proxyMenuItems, proxyAddr)
-	}
-	if item, ok := deleteProxyMenuItems[proxyAddr]; ok {
-		item.Hide()
-		delete(deleteProxyMenuItems, proxyAddr)
-	}
+	removeProxyMenuItemsLocked(proxyAddr)
 
 	// If the deleted proxy was the current one, select a new one
 	if currentProxy == proxyAddr {
 		if len(appConfig.Proxies) > 0 {
 			currentProxy = appConfig.Proxies[0]
 			appConfig.LastSelectedProxy = currentProxy
+			activeProfileLocked().Proxy = currentProxy
 			// Update checkmarks for the new proxy
 			for p, item := range proxyMenuItems {
 				if p == currentProxy {
@@ -411,13 +949,14 @@ func deleteProxy(proxyAddr string) {
 		} else {
 			currentProxy = ""
 			appConfig.LastSelectedProxy = ""
+			activeProfileLocked().Proxy = ""
 			log.Println(GetText("log_all_proxies_deleted"))
 		}
 	}
 
 	saveConfig() // Save all changes
 
-	if len(appConfig.Proxies) == 0 {
+	if len(appConfig.Proxies) == 0 && mDeleteProxy != nil {
 		mDeleteProxy.Disable()
 	}
 
@@ -430,16 +969,26 @@ func loadConfig() (bool, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	// Options missing from older config files keep these defaults.
+	appConfig.Notifications = defaultNotifications
+	appConfig.Log = defaultLogConfig
+	appConfig.SelfTest = defaultSelfTest
+	appConfig.ExternalIP = defaultExternalIP
+	defer func() { applyLogConfig(appConfig.Log) }()
+
 	// Try to read the new config.json first
 	data, err := os.ReadFile(configFile)
 	if err == nil {
 		if err := json.Unmarshal(data, &appConfig); err == nil {
 			log.Println(GetText("config_load_success"))
 			proxies = appConfig.Proxies // Sync the convenience slice
+			if ensureProfilesLocked() {
+				saveConfig()
+			}
 			// Config loaded successfully, check if language field was present
 			return true, nil
 		}
-		log.Printf(GetText("config_parse_fail")+"\n", err)
+		logWarn(GetText("config_parse_fail"), err)
 		return false, err
 	}
 
@@ -451,8 +1000,9 @@ func loadConfig() (bool, error) {
 		if json.Unmarshal(data, &oldProxies) == nil && len(oldProxies) > 0 {
 			appConfig.Proxies = oldProxies
 			appConfig.LastSelectedProxy = oldProxies[0] // Default to first
-			appConfig.Language = Unset                 // New config, language not set
+			appConfig.Language = Unset                  // New config, language not set
 			proxies = appConfig.Proxies
+			ensureProfilesLocked()
 			saveConfig()              // Save as new config.json
 			os.Remove(oldProxiesFile) // Clean up old file
 			log.Println(GetText("migration_success"))
@@ -468,6 +1018,7 @@ func loadConfig() (bool, error) {
 	}
 	appConfig.Language = Unset // New config, language not set
 	proxies = appConfig.Proxies
+	ensureProfilesLocked()
 	saveConfig()
 	return false, nil
 }
@@ -475,62 +1026,228 @@ func loadConfig() (bool, error) {
 func saveConfig() {
 	data, err := json.MarshalIndent(appConfig, "", "  ")
 	if err != nil {
-		log.Printf(GetText("config_encode_fail")+"\n", err)
+		logWarn(GetText("config_encode_fail"), err)
 		return
 	}
 	if err := os.WriteFile(configFile, data, 0644); err != nil {
-		log.Printf(GetText("config_write_fail")+"\n", err)
+		logWarn(GetText("config_write_fail"), err)
 	}
 }
 
 // --- Core TUN Logic ---
 
-func startTun() error {
+// startTun brings the tunnel up. If it fails or ctx is cancelled once
+// tun2socks has been launched, everything applied so far is rolled back.
+func startTun(ctx context.Context) (err error) {
 	if err := prepareWintunDll(); err != nil {
-		return fmt.Errorf(GetTextWithFormat("prepare_wintun_fail"), err)
+		return stepFailed(GetText("step_prepare_wintun"), fmt.Errorf(GetTextWithFormat("prepare_wintun_fail"), err))
 	}
 
+	// Everything below is driven by a snapshot of the active profile, which
+	// stopTun later uses to undo exactly what was applied.
 	mu.RLock()
-	proxy := currentProxy
+	profile := *activeProfileLocked()
+	appRules := append([]AppRule(nil), appConfig.AppRules...)
+	profile.AppRouting = appConfig.AppRouting && len(appRules) > 0
+	ruleRouting := appConfig.RuleRouting && len(appConfig.RoutingRules) > 0
+	routingRules := append([]string(nil), appConfig.RoutingRules...)
+	geoipPath := appConfig.GeoIPDatabase
 	mu.RUnlock()
-	if proxy == "" {
-		return fmt.Errorf(GetText("no_proxy_selected"))
+	if geoipPath == "" {
+		geoipPath = defaultGeoIPDatabase
+	}
+	proxy := profile.Proxy
+	if proxy == "" && len(profile.Chain) == 0 {
+		return errors.New(GetText("no_proxy_selected"))
+	}
+	log.Printf(GetText("log_profile_starting")+"\n", profile.Name)
+
+	// With a chain configured, tun2socks talks to a local SOCKS5 listener
+	// that dials through every hop in turn. In fake-IP mode the listener
+	// also turns fake addresses back into domains, and with rule routing it
+	// dispatches connections; both need a proxy TUNTray can dial itself.
+	var dialer proxyDialer
+	defer func() {
+		// Until tun2socks is launched the listener and the rule engine are
+		// all there is to undo; after that, stopTun closes them as well.
+		if err != nil {
+			closeChainServer()
+			closeRuleEngine()
+		}
+	}()
+	hops := profile.Chain
+	if len(hops) == 0 && (profile.FakeIP.Enabled || ruleRouting) {
+		if u, err := url.Parse(proxy); err != nil || !chainHopSchemes[strings.ToLower(u.Scheme)] {
+			return fmt.Errorf(GetTextWithFormat("dispatch_proxy_unsupported"), proxyName(proxy))
+		}
+		hops = []string{proxy}
+	}
+	direct := newDirectDialer(detectDirectIP())
+	if len(hops) > 0 {
+		chain, err := newChainDialer(hops, direct)
+		if err != nil {
+			return err
+		}
+		dialer = chain
+	}
+	if ruleRouting {
+		engine, err := compileRules(routingRules, geoipPath)
+		if err != nil {
+			return err
+		}
+		rules, err := newRuleDialer(engine, dialer, direct)
+		if err != nil {
+			engine.Close()
+			return err
+		}
+		activeRules = engine
+		dialer = rules
+		log.Printf(GetText("log_rule_routing")+"\n", len(engine.rules))
+	}
+	if profile.FakeIP.Enabled {
+		pool, err := fakeIPPoolFor(profile)
+		if err != nil {
+			return err
+		}
+		dialer = &fakeIPDialer{pool: pool, forward: dialer}
+		log.Printf(GetText("log_fake_ip_enabled")+"\n", pool)
+	}
+	if dialer != nil {
+		server, err := startSocksServer("127.0.0.1:0", dialer)
+		if err != nil {
+			return fmt.Errorf(GetTextWithFormat("chain_listen_fail"), err)
+		}
+		chainServer = server
+		proxy = "socks5://" + chainServer.Addr()
+		log.Printf(GetText("log_chain_listening")+"\n", chainServer.Addr(), proxyNames(hops))
+	}
+
+	args := []string{"-device", tunAlias, "-proxy", proxy, "-loglevel", "info"}
+	var api *restAPIClient
+	if !hasRestAPIFlag(profile.Tun2socksArgs) {
+		// The Connections menu needs tun2socks' API; it is optional.
+		if addr, secret, flag, err := restAPIEndpoint(); err != nil {
+			logWarn(GetText("log_restapi_fail"), err)
+		} else {
+			args = append(args, "-restapi", flag)
+			api = newRestAPIClient(addr, secret)
+		}
 	}
-	tun2socksCmd = exec.Command("./tun2socks.exe", "-device", "wintun", "-proxy", proxy, "-loglevel", "info")
+	// Profile flags come last so they can override the defaults above.
+	args = append(args, profile.Tun2socksArgs...)
+	tun2socksCmd = exec.Command("./tun2socks.exe", args...)
 	if runtime.GOOS == "windows" {
 		tun2socksCmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	}
 
 	stdout, _ := tun2socksCmd.StdoutPipe()
 	stderr, _ := tun2socksCmd.StderrPipe()
-	go logPipe(stdout, "TUN2SOCKS_STDOUT")
-	go logPipe(stderr, "TUN2SOCKS_STDERR")
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go func() { logPipe(stdout, "stdout"); pipes.Done() }()
+	go func() { logPipe(stderr, "stderr"); pipes.Done() }()
 
+	mu.Lock()
+	runningProfile = profile
+	restAPI = api
+	mu.Unlock()
+	defer func() {
+		if err != nil {
+			log.Println(GetText("log_start_rollback"))
+			stopTun()
+		}
+	}()
 	if err := tun2socksCmd.Start(); err != nil {
-		return fmt.Errorf(GetTextWithFormat("start_tun2socks_fail"), err)
+		tun2socksCmd = nil
+		return stepFailed(GetText("step_start_tun2socks"), fmt.Errorf(GetTextWithFormat("start_tun2socks_fail"), err))
 	}
 
-	if err := waitForAdapter(); err != nil {
-		tun2socksCmd.Process.Kill()
+	mu.Lock()
+	appConfig.Tun2socksPID = tun2socksCmd.Process.Pid
+	saveConfig()
+	mu.Unlock()
+
+	// Reap the process once its output is drained so exits can be detected.
+	done := make(chan struct{})
+	go func(cmd *exec.Cmd) {
+		pipes.Wait()
+		err := cmd.Wait()
+		log.Printf(GetText("log_tun2socks_exited")+"\n", err)
+		close(done)
+	}(tun2socksCmd)
+	mu.Lock()
+	tun2socksDone = done
+	mu.Unlock()
+
+	if err := waitForAdapter(ctx); err != nil {
 		return err
 	}
 
-	commands := []string{
-		fmt.Sprintf("netsh interface ipv4 set address name=%s source=static addr=%s mask=%s", tunAlias, tunIP, tunMask),
-		fmt.Sprintf("netsh interface ipv4 set dnsservers name=%s static address=%s register=none validate=no", tunAlias, tunDNS),
-		fmt.Sprintf("netsh interface ipv4 add route 0.0.0.0/0 %s %s metric=1", tunAlias, tunIP),
+	runCommand := func(step, cmdStr string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if output, err := exec.Command("cmd", "/C", cmdStr).CombinedOutput(); err != nil {
+			return commandFailed(GetText(step), cmdStr, output, err)
+		}
+		return nil
 	}
-	for _, cmdStr := range commands {
-		cmd := exec.Command("cmd", "/C", cmdStr)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			if strings.Contains(cmdStr, "add route") {
-				delCmdStr := fmt.Sprintf("netsh interface ipv4 delete route 0.0.0.0/0 %s", tunAlias)
-				exec.Command("cmd", "/C", delCmdStr).Run()
-				if output, err := exec.Command("cmd", "/C", cmdStr).CombinedOutput(); err != nil {
-					return fmt.Errorf(GetTextWithFormat("command_exec_fail"), cmdStr, string(output), err)
-				}
-			} else {
-				return fmt.Errorf(GetTextWithFormat("command_exec_fail"), cmdStr, string(output), err)
+	if err := runCommand("step_configure_address", fmt.Sprintf("netsh interface ipv4 set address name=%s source=static addr=%s mask=%s", tunAlias, profile.TunIP, profile.TunMask)); err != nil {
+		return err
+	}
+
+	// With the forwarder on, the TUN adapter's only DNS server is TUNTray.
+	dnsServers := profile.DNS
+	mu.RLock()
+	// Fake-IP mode is implemented by the forwarder.
+	forwardDNS := appConfig.DNSForwarder.Enabled || profile.FakeIP.Enabled
+	mu.RUnlock()
+	if forwardDNS {
+		if err := startDNSForwarderFor(profile); err != nil {
+			return err
+		}
+		dnsServers = []string{profile.TunIP}
+	}
+	for i, dns := range dnsServers {
+		var cmdStr string
+		if i == 0 {
+			cmdStr = fmt.Sprintf("netsh interface ipv4 set dnsservers name=%s static address=%s register=none validate=no", tunAlias, dns)
+		} else {
+			cmdStr = fmt.Sprintf("netsh interface ipv4 add dnsservers name=%s address=%s index=%d validate=no", tunAlias, dns, i+1)
+		}
+		if err := runCommand("step_configure_dns", cmdStr); err != nil {
+			return err
+		}
+	}
+	if forwardDNS {
+		// Drop answers cached from the ISP's resolver.
+		exec.Command("ipconfig", "/flushdns").Run()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := applyRoutes(profile); err != nil {
+		return err
+	}
+	if profile.AppRouting {
+		startAppRouter(profile, appRules)
+	}
+	if activeRules != nil {
+		applyDirectRoutes(activeRules.DirectRoutes())
+	}
+	return nil
+}
+
+// applyRoutes sends the profile's routes into the TUN adapter, replacing any
+// stale route left behind by a previous run.
+func applyRoutes(profile Profile) error {
+	for _, route := range profile.TunnelRoutes() {
+		cmdStr := fmt.Sprintf("netsh interface ipv4 add route %s %s %s metric=1", route, tunAlias, profile.TunIP)
+		if _, err := exec.Command("cmd", "/C", cmdStr).CombinedOutput(); err != nil {
+			delCmdStr := fmt.Sprintf("netsh interface ipv4 delete route %s %s", route, tunAlias)
+			exec.Command("cmd", "/C", delCmdStr).Run()
+			if output, err := exec.Command("cmd", "/C", cmdStr).CombinedOutput(); err != nil {
+				return commandFailed(GetText("step_add_routes"), cmdStr, output, err)
 			}
 		}
 	}
@@ -539,15 +1256,18 @@ func startTun() error {
 
 func stopTun() error {
 	// 1. Clean up network settings with netsh
-	netshCommands := []string{
-		fmt.Sprintf("netsh interface ipv4 delete route 0.0.0.0/0 %s", tunAlias),
+	stopAppRouter()
+	var netshCommands []string
+	for _, route := range runningProfile.TunnelRoutes() {
+		netshCommands = append(netshCommands, fmt.Sprintf("netsh interface ipv4 delete route %s %s", route, tunAlias))
+	}
+	netshCommands = append(netshCommands,
 		fmt.Sprintf("netsh interface ipv4 set dnsservers name=%s source=dhcp", tunAlias),
 		fmt.Sprintf("netsh interface ipv4 set address name=%s source=dhcp", tunAlias),
-	}
+	)
 	for _, cmdStr := range netshCommands {
 		exec.Command("cmd", "/C", cmdStr).Run() // Ignore errors during cleanup
 	}
-
 	// 2. Clean up network profile from registry with PowerShell, just like the original script
 	psCleanupCmd := `$profilesPath = 'HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Profiles'; if (Test-Path $profilesPath) { Get-ChildItem $profilesPath | ForEach-Object { try { $profile = Get-ItemProperty $_.PsPath; if ($profile.ProfileName -like 'wintun*') { Remove-Item $_.PsPath -Recurse -Force } } catch {} } }`
 	exec.Command("powershell", "-Command", psCleanupCmd).Run() // Ignore errors during cleanup
@@ -559,9 +1279,30 @@ func stopTun() error {
 		}
 		tun2socksCmd = nil
 	}
+	mu.Lock()
+	tun2socksDone = nil
+	restAPI = nil
+	if appConfig.Tun2socksPID != 0 {
+		appConfig.Tun2socksPID = 0
+		saveConfig()
+	}
+	mu.Unlock()
+
+	// 4. Stop the local chain listener, rule engine and DNS forwarder, if any
+	closeChainServer()
+	closeRuleEngine()
+	closeDNSForwarder()
 	return nil
 }
 
+// closeChainServer stops the local SOCKS5 listener used for proxy chains.
+func closeChainServer() {
+	if chainServer != nil {
+		chainServer.Close()
+		chainServer = nil
+	}
+}
+
 func prepareWintunDll() error {
 	dst := "./wintun.dll"
 	// If wintun.dll already exists in the target location, do nothing.
@@ -592,7 +1333,7 @@ func prepareWintunDll() error {
 	return nil
 }
 
-func waitForAdapter() error {
+func waitForAdapter(ctx context.Context) error {
 	deadline := time.Now().Add(20 * time.Second)
 	for time.Now().Before(deadline) {
 		interfaces, err := net.Interfaces()
@@ -605,18 +1346,22 @@ func waitForAdapter() error {
 				return nil
 			}
 		}
-		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return fmt.Errorf(GetTextWithFormat("wait_adapter_timeout"), tunAlias)
+	return stepFailed(GetText("step_wait_adapter"), adapterTimeoutError{tunAlias})
 }
 
-func logPipe(pipe io.ReadCloser, prefix string) {
+func logPipe(pipe io.ReadCloser, stream string) {
 	if pipe == nil {
 		return
 	}
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
-		log.Printf("[%s] %s\n", prefix, scanner.Text())
+		logTun2socks(stream, scanner.Text())
 	}
 }
 
@@ -632,9 +1377,10 @@ func createLanguageMenu() (*systray.MenuItem, map[Language]*systray.MenuItem) {
 	mLanguageEnglish := mLanguage.AddSubMenuItem(GetText("english"), "Switch to English")
 
 	subMenus := map[Language]*systray.MenuItem{
-		Chinese:  mLanguageChinese,
+		Chinese: mLanguageChinese,
 		English: mLanguageEnglish,
 	}
+	languageMenuItems = subMenus
 
 	// Update checkmarks based on current language
 	updateLanguageCheckmarks(subMenus)
@@ -647,27 +1393,29 @@ func handleLanguageSelection(subMenus map[Language]*systray.MenuItem) {
 	for {
 		select {
 		case <-subMenus[Chinese].ClickedCh:
-			log.Println("Language switch requested: Chinese")
-			SetLanguage(Chinese)
-			appConfig.Language = Chinese
-			saveConfig()
-			log.Printf("Language switched to Chinese, config updated. Current language: %v\n", GetCurrentLanguage())
-			updateLanguageCheckmarks(subMenus)
-			refreshUITexts()
+			switchLanguage(Chinese)
 			zenity.Info(GetText("operation_success"), zenity.Title(GetText("language")))
 		case <-subMenus[English].ClickedCh:
-			log.Println("Language switch requested: English")
-			SetLanguage(English)
-			appConfig.Language = English
-			saveConfig()
-			log.Printf("Language switched to English, config updated. Current language: %v\n", GetCurrentLanguage())
-			updateLanguageCheckmarks(subMenus)
-			refreshUITexts()
+			switchLanguage(English)
 			zenity.Info(GetText("operation_success"), zenity.Title(GetText("language")))
 		}
 	}
 }
 
+// switchLanguage changes the UI language and saves it, for the Language
+// menu and the control API.
+func switchLanguage(lang Language) {
+	slog.Debug("Language switch requested", "language", lang)
+	SetLanguage(lang)
+	mu.Lock()
+	appConfig.Language = lang
+	saveConfig()
+	mu.Unlock()
+	slog.Debug("Language switched, config updated", "language", lang, "current", GetCurrentLanguage())
+	updateLanguageCheckmarks(languageMenuItems)
+	refreshUITexts()
+}
+
 // updateLanguageCheckmarks updates the checkmarks on language menu items
 func updateLanguageCheckmarks(subMenus map[Language]*systray.MenuItem) {
 	currentLang := GetCurrentLanguage()
@@ -693,6 +1441,10 @@ func refreshUITexts() {
 		mStop.SetTitle(GetText("stop"))
 		mStop.SetTooltip(GetText("stop_tooltip"))
 	}
+	if mCancel != nil {
+		mCancel.SetTitle(GetText("cancel"))
+		mCancel.SetTooltip(GetText("cancel_tooltip"))
+	}
 	if mSelectProxy != nil {
 		mSelectProxy.SetTitle(GetText("select_proxy"))
 		mSelectProxy.SetTooltip(GetText("select_tooltip"))
@@ -709,6 +1461,96 @@ func refreshUITexts() {
 		mAddNewProxy.SetTitle(GetText("add_new_proxy"))
 		mAddNewProxy.SetTooltip(GetText("add_tooltip"))
 	}
+	if mImportClipboard != nil {
+		mImportClipboard.SetTitle(GetText("add_from_clipboard"))
+		mImportClipboard.SetTooltip(GetText("clipboard_tooltip"))
+	}
+	if mAddTypedProxy != nil {
+		mAddTypedProxy.SetTitle(GetText("add_typed_proxy"))
+		mAddTypedProxy.SetTooltip(GetText("add_typed_tooltip"))
+	}
+	if mEditProxy != nil {
+		mEditProxy.SetTitle(GetText("edit_proxy"))
+		mEditProxy.SetTooltip(GetText("edit_tooltip"))
+	}
+	if mChain != nil {
+		mChain.SetTitle(GetText("proxy_chain"))
+		mConfigureChain.SetTitle(GetText("configure_chain"))
+		mConfigureChain.SetTooltip(GetText("configure_chain_tooltip"))
+		mClearChain.SetTitle(GetText("clear_chain"))
+		mClearChain.SetTooltip(GetText("clear_chain_tooltip"))
+		mu.RLock()
+		updateChainMenuLocked()
+		mu.RUnlock()
+	}
+	if mProfiles != nil {
+		mProfiles.SetTitle(GetText("profiles"))
+		mProfiles.SetTooltip(GetText("profiles_tooltip"))
+		mNewProfile.SetTitle(GetText("new_profile"))
+		mNewProfile.SetTooltip(GetText("new_profile_tooltip"))
+		mEditProfile.SetTitle(GetText("edit_profile"))
+		mEditProfile.SetTooltip(GetText("edit_profile_tooltip"))
+		mDeleteProfile.SetTitle(GetText("delete_profile"))
+		mDeleteProfile.SetTooltip(GetText("delete_profile_tooltip"))
+	}
+	if mSettings != nil {
+		mSettings.SetTitle(GetText("settings"))
+		mSettings.SetTooltip(GetText("settings_tooltip"))
+		mAutoConnect.SetTitle(GetText("auto_connect"))
+		mAutoConnect.SetTooltip(GetText("auto_connect_tooltip"))
+		mAutoReconnect.SetTitle(GetText("auto_reconnect"))
+		mAutoReconnect.SetTooltip(GetText("auto_reconnect_tooltip"))
+		mPauseRules.SetTitle(GetText("pause_rules"))
+		mPauseRules.SetTooltip(GetText("pause_rules_tooltip"))
+		mAddNetworkRule.SetTitle(GetText("add_network_rule"))
+		mAddNetworkRule.SetTooltip(GetText("add_network_rule_tooltip"))
+	}
+	if mReleaseKillSwitch != nil {
+		mReleaseKillSwitch.SetTitle(GetText("release_kill_switch"))
+		mReleaseKillSwitch.SetTooltip(GetText("release_kill_switch_tooltip"))
+		mKillSwitch.SetTitle(GetText("kill_switch"))
+		mKillSwitch.SetTooltip(GetText("kill_switch_tooltip"))
+	}
+	if mRuleRouting != nil {
+		mRuleRouting.SetTitle(GetText("rule_routing"))
+		mRuleRouting.SetTooltip(GetText("rule_routing_tooltip"))
+		mTestRules.SetTitle(GetText("test_rules"))
+		mTestRules.SetTooltip(GetText("test_rules_tooltip"))
+	}
+	if mAPI != nil {
+		mAPI.SetTitle(GetText("control_api"))
+		mAPI.SetTooltip(GetText("control_api_tooltip"))
+		mCopyAPIToken.SetTitle(GetText("copy_api_token"))
+		mCopyAPIToken.SetTooltip(GetText("copy_api_token_tooltip"))
+	}
+	refreshNotificationsMenuTexts()
+	refreshExitMenuTexts()
+	refreshStatisticsMenuTexts()
+	refreshConnectionsMenuTexts()
+	refreshSelfTestMenuTexts()
+	refreshViewLogsMenuTexts()
+	refreshDiagnosticsMenuTexts()
+	if mAppRouting != nil {
+		mAppRouting.SetTitle(GetText("app_routing"))
+		mAppRouting.SetTooltip(GetText("app_routing_tooltip"))
+		mEnableAppRouting.SetTitle(GetText("enable_app_routing"))
+		mEnableAppRouting.SetTooltip(GetText("enable_app_routing_tooltip"))
+		mAddAppRule.SetTitle(GetText("add_app_rule"))
+		mAddAppRule.SetTooltip(GetText("add_app_rule_tooltip"))
+		mRemoveAppRules.SetTitle(GetText("remove_app_rules"))
+		mRemoveAppRules.SetTooltip(GetText("remove_app_rules_tooltip"))
+		mTunnelledApps.SetTitle(GetText("tunnelled_apps"))
+		mTunnelledApps.SetTooltip(GetText("tunnelled_apps_tooltip"))
+		mNoTunnelledApps.SetTitle(GetText("no_tunnelled_apps"))
+	}
+	if mDNSForwarder != nil {
+		mDNSForwarder.SetTitle(GetText("dns_forwarder"))
+		mDNSForwarder.SetTooltip(GetText("dns_forwarder_tooltip"))
+		mBlockOtherDNS.SetTitle(GetText("block_other_dns"))
+		mBlockOtherDNS.SetTooltip(GetText("block_other_dns_tooltip"))
+		mConfigureDNS.SetTitle(GetText("configure_dns"))
+		mConfigureDNS.SetTooltip(GetText("configure_dns_tooltip"))
+	}
 	if mQuit != nil {
 		mQuit.SetTitle(GetText("quit"))
 	}
@@ -718,8 +1560,10 @@ func refreshUITexts() {
 	}
 
 	// Update the title and tooltip of the main app
-	systray.SetTitle(GetText("app_title"))
-	systray.SetTooltip(GetText("app_tooltip"))
+	if mStart != nil {
+		systray.SetTitle(GetText("app_title"))
+	}
+	updateTrayState()
 
 	log.Println("UI texts refreshed successfully")
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const networkPollInterval = 5 * time.Second
+
+// networkChange describes why the watcher thinks the network moved under us.
+type networkChange struct {
+	Reason        string // Human readable, for the log
+	Resumed       bool   // The machine came back from sleep
+	LinkChanged   bool   // Interfaces or the default gateway changed
+	TunnelExited  bool   // tun2socks died while the tunnel was up
+	RuleCheck     bool   // Network rules were asked to be applied again
+	Before, After networkSnapshot
+	Network       networkInfo // Collected for the network rules, when they are active
+}
+
+// networkSnapshot is the part of the network state we watch for changes.
+type networkSnapshot struct {
+	Interfaces string // Sorted summary of the non-TUN interfaces that are up, with IPv4 addresses
+	Gateway    string // Default IPv4 gateway outside the tunnel
+}
+
+// networkChanges receives changes detected by watchNetwork; the main event
+// loop consumes it so that reconnects never race with menu actions.
+var networkChanges = make(chan networkChange, 1)
+
+// ruleChecks asks watchNetwork to collect the network for the network rules
+// without waiting for it to change.
+var ruleChecks = make(chan struct{}, 1)
+
+// requestRuleCheck has the network rules applied again to the current
+// network. The result arrives on networkChanges.
+func requestRuleCheck() {
+	select {
+	case ruleChecks <- struct{}{}:
+	default:
+	}
+}
+
+// takeNetworkSnapshot reads the current interfaces and default gateway.
+func takeNetworkSnapshot() networkSnapshot {
+	var parts []string
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, i := range interfaces {
+			if i.Name == tunAlias || i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, _ := i.Addrs()
+			var list []string
+			for _, a := range addrs {
+				// IPv6 privacy addresses rotate on their own; only track IPv4.
+				if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+					list = append(list, a.String())
+				}
+			}
+			sort.Strings(list)
+			parts = append(parts, i.Name+"="+strings.Join(list, ","))
+		}
+	}
+	sort.Strings(parts)
+	return networkSnapshot{
+		Interfaces: strings.Join(parts, ";"),
+		Gateway:    defaultGateway(),
+	}
+}
+
+// defaultGateway returns the gateway of the best IPv4 default route that does
+// not belong to the TUN adapter, as listed by "route print".
+func defaultGateway() string {
+	output, err := hiddenCommand("route", "print", "-4", "0.0.0.0").Output()
+	if err != nil {
+		return ""
+	}
+
+	mu.RLock()
+	tunIP := runningProfile.TunIP
+	mu.RUnlock()
+
+	// Data lines look like: "0.0.0.0  0.0.0.0  192.168.1.1  192.168.1.23  25"
+	best, bestMetric := "", -1
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if net.ParseIP(fields[2]) == nil || fields[3] == tunIP {
+			continue
+		}
+		var metric int
+		fmt.Sscan(fields[4], &metric)
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[2], metric
+		}
+	}
+	return best
+}
+
+// watchNetwork polls the network state and reports changes on
+// networkChanges. A gap between polls much longer than the interval means
+// the machine was asleep. The network rules' commands take seconds, so the
+// rules' view of the network is collected here rather than on the main
+// event loop.
+func watchNetwork() {
+	last := takeNetworkSnapshot()
+	lastTick := time.Now()
+	var reportedExit chan struct{} // Only report each tun2socks exit once
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ruleChecks:
+			// Wait for the main event loop rather than drop the check, so
+			// that every request is answered.
+			networkChanges <- networkChange{RuleCheck: true, Before: last, After: last, Network: currentNetworkInfo()}
+			continue
+		}
+
+		change := networkChange{Before: last}
+		var reasons []string
+		if now.Sub(lastTick) > 3*networkPollInterval {
+			change.Resumed = true
+			reasons = append(reasons, GetText("reason_resumed"))
+		}
+		lastTick = now
+
+		current := takeNetworkSnapshot()
+		change.After = current
+		if current != last {
+			change.LinkChanged = true
+			reasons = append(reasons, GetText("reason_link_changed"))
+		}
+		last = current
+
+		mu.RLock()
+		done := tun2socksDone
+		mu.RUnlock()
+		if tunnelRunning() && done != nil && done != reportedExit && !tun2socksAlive() {
+			reportedExit = done
+			change.TunnelExited = true
+			reasons = append(reasons, GetText("reason_tunnel_exited"))
+		}
+
+		if len(reasons) == 0 {
+			continue
+		}
+		change.Reason = strings.Join(reasons, ", ")
+		log.Printf(GetText("log_network_change")+"\n", change.Reason)
+		if (change.LinkChanged || change.Resumed) && networkRulesActive() {
+			change.Network = currentNetworkInfo()
+		}
+		select {
+		case networkChanges <- change:
+		default:
+			// A change is already pending; the handler will see the latest state.
+		}
+	}
+}
+
+// tun2socksAlive reports whether the tun2socks process started by startTun
+// is still running.
+func tun2socksAlive() bool {
+	mu.RLock()
+	done := tun2socksDone
+	mu.RUnlock()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// handleNetworkChange runs on the main event loop and brings the tunnel back
+// in line with the new network.
+func handleNetworkChange(change networkChange) {
+	if activeOp != nil {
+		return // The start or reconnect in progress sees the new network
+	}
+	mu.RLock()
+	reconnect := appConfig.AutoReconnect
+	mu.RUnlock()
+	if !tunnelRunning() {
+		return
+	}
+	if !reconnect {
+		// Without auto-reconnect a dead tun2socks ends the session; clean up
+		// its routes but leave any kill switch engaged.
+		if change.TunnelExited {
+			runOp(&tunnelOp{stopping: true, finish: finishExited}, func(context.Context) error { return stopTun() })
+		}
+		return
+	}
+
+	// tun2socks binds to the physical interface it finds at startup, and the
+	// chain listener to its address, so a new link needs a full restart.
+	if change.TunnelExited || change.LinkChanged {
+		restartTun()
+		return
+	}
+
+	log.Println(GetText("log_reapply_routes"))
+	mu.RLock()
+	profile := runningProfile
+	mu.RUnlock()
+	runOp(&tunnelOp{finish: finishReapply}, func(context.Context) error { return applyRoutes(profile) })
+}
+
+// finishExited ends the session once the routes of a tun2socks that died
+// are cleaned up, leaving any kill switch engaged.
+func finishExited(op *tunnelOp) {
+	if op.err != nil {
+		slog.Error(GetText("stop_fail"), "error", op.err)
+	}
+	setState(stateError, errors.New(GetText("reason_tunnel_exited")))
+	mu.RLock()
+	updateKillSwitchMenuLocked()
+	mu.RUnlock()
+}
+
+// finishReapply restarts the tunnel if its routes could not be put back,
+// unless a stop cancelled the attempt.
+func finishReapply(op *tunnelOp) {
+	if op.err != nil && op.ctx.Err() == nil {
+		logWarn(GetText("reapply_routes_fail"), op.err)
+		restartTun()
+	}
+}
+
+// restartTun tears the tunnel down and starts it again with the active profile.
+func restartTun() {
+	log.Println(GetText("log_restarting"))
+	setState(stateReconnecting, nil)
+	runTunnelOp(func(ctx context.Context) error {
+		stopTun()
+		return startTun(ctx)
+	})
+}
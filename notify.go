@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+)
+
+// NotificationsConfig picks the events that raise a desktop notification.
+type NotificationsConfig struct {
+	Connected    bool `json:"connected"`
+	Disconnected bool `json:"disconnected"`
+	Reconnected  bool `json:"reconnected"` // Back up after a network change or tun2socks exit
+	Errors       bool `json:"errors"`
+}
+
+// defaultNotifications is used for configs written before notifications
+// existed.
+var defaultNotifications = NotificationsConfig{Connected: true, Disconnected: true, Reconnected: true, Errors: true}
+
+var (
+	mNotifications      *systray.MenuItem
+	mNotifyConnected    *systray.MenuItem
+	mNotifyDisconnected *systray.MenuItem
+	mNotifyReconnected  *systray.MenuItem
+	mNotifyErrors       *systray.MenuItem
+)
+
+// addNotificationsMenuLocked adds the Notifications submenu to Settings.
+// Callers must hold mu.
+func addNotificationsMenuLocked() {
+	n := appConfig.Notifications
+	mNotifications = mSettings.AddSubMenuItem(GetText("notifications"), GetText("notifications_tooltip"))
+	mNotifyConnected = mNotifications.AddSubMenuItemCheckbox(GetText("notify_connected"), "", n.Connected)
+	mNotifyDisconnected = mNotifications.AddSubMenuItemCheckbox(GetText("notify_disconnected"), "", n.Disconnected)
+	mNotifyReconnected = mNotifications.AddSubMenuItemCheckbox(GetText("notify_reconnected"), "", n.Reconnected)
+	mNotifyErrors = mNotifications.AddSubMenuItemCheckbox(GetText("notify_errors"), "", n.Errors)
+}
+
+// refreshNotificationsMenuTexts relabels the submenu after a language switch.
+func refreshNotificationsMenuTexts() {
+	if mNotifications == nil {
+		return
+	}
+	mNotifications.SetTitle(GetText("notifications"))
+	mNotifications.SetTooltip(GetText("notifications_tooltip"))
+	mNotifyConnected.SetTitle(GetText("notify_connected"))
+	mNotifyDisconnected.SetTitle(GetText("notify_disconnected"))
+	mNotifyReconnected.SetTitle(GetText("notify_reconnected"))
+	mNotifyErrors.SetTitle(GetText("notify_errors"))
+}
+
+// notifyStateChange announces the move from prev to s, if the user wants
+// to hear about it.
+func notifyStateChange(prev, s tunnelState, err error) {
+	mu.RLock()
+	n := appConfig.Notifications
+	via := proxyRoute(runningProfile)
+	mu.RUnlock()
+
+	switch {
+	case s.connected() && prev == stateReconnecting:
+		if n.Reconnected {
+			notify(fmt.Sprintf(GetText("notify_reconnected_msg"), via), false)
+		}
+	case s.connected() && !prev.connected():
+		if n.Connected {
+			notify(fmt.Sprintf(GetText("notify_connected_msg"), via), false)
+		}
+	case s == stateDisconnected && prev.connected():
+		if n.Disconnected {
+			notify(GetText("notify_disconnected_msg"), false)
+		}
+	case (s == stateError || s == stateDegraded) && err != nil:
+		notifyError(err)
+	}
+}
+
+// notifyError reports a failure, with its localized reason.
+func notifyError(err error) {
+	mu.RLock()
+	enabled := appConfig.Notifications.Errors
+	mu.RUnlock()
+	if enabled {
+		notify(fmt.Sprintf(GetText("notify_error_msg"), err), true)
+	}
+}
+
+// notify shows a desktop notification without blocking the caller. There
+// is nowhere to show one when running headless.
+func notify(message string, isError bool) {
+	if mStart == nil {
+		return
+	}
+	icon := zenity.InfoIcon
+	if isError {
+		icon = zenity.ErrorIcon
+	}
+	go func() {
+		if err := zenity.Notify(message, zenity.Title(GetText("app_title")), icon); err != nil {
+			logWarn(GetText("notify_fail"), err)
+		}
+	}()
+}
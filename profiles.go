@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+)
+
+// Profile bundles everything startTun needs for one setup, such as "office"
+// (split tunnel, internal DNS) or "travel" (full tunnel, public DNS).
+type Profile struct {
+	Name          string       `json:"name"`
+	Proxy         string       `json:"proxy"`
+	Chain         []string     `json:"chain,omitempty"` // Ordered proxy hops; empty means no chaining
+	TunIP         string       `json:"tun_ip"`
+	TunMask       string       `json:"tun_mask"`
+	DNS           []string     `json:"dns"`
+	Routes        []string     `json:"routes,omitempty"`         // CIDRs sent into the tunnel; empty means all traffic
+	Tun2socksArgs []string     `json:"tun2socks_args,omitempty"` // Extra tun2socks flags, e.g. ["-mtu", "1400"]
+	FakeIP        FakeIPConfig `json:"fake_ip"`
+	AppRouting    bool         `json:"-"` // Set by startTun when per-app routing is on
+}
+
+// TunnelRoutes returns the CIDRs to route into the TUN adapter. In fake-IP
+// mode that is the fake range plus any explicit routes; with per-app routing
+// only explicit routes are static, the rest are added as programs connect.
+func (p Profile) TunnelRoutes() []string {
+	if p.FakeIP.Enabled {
+		return append([]string{p.FakeIP.FakeRange()}, p.Routes...)
+	}
+	if p.AppRouting {
+		return p.Routes
+	}
+	if len(p.Routes) == 0 {
+		return []string{"0.0.0.0/0"}
+	}
+	return p.Routes
+}
+
+// newProfile returns a full-tunnel profile with the default TUN addressing.
+func newProfile(name, proxy string) Profile {
+	return Profile{
+		Name:    name,
+		Proxy:   proxy,
+		TunIP:   defaultTunIP,
+		TunMask: defaultTunMask,
+		DNS:     []string{defaultTunDNS},
+	}
+}
+
+// ensureProfilesLocked makes sure at least one profile exists and that the
+// active profile is valid, migrating settings from configs that predate
+// profiles. It reports whether the config was changed. Callers must hold mu.
+func ensureProfilesLocked() bool {
+	changed := false
+	if len(appConfig.Profiles) == 0 {
+		p := newProfile(defaultProfileName, appConfig.LastSelectedProxy)
+		p.Chain = appConfig.Chain
+		appConfig.Profiles = []Profile{p}
+		appConfig.Chain = nil
+		changed = true
+	}
+	if findProfileLocked(appConfig.ActiveProfile) == nil {
+		appConfig.ActiveProfile = appConfig.Profiles[0].Name
+		changed = true
+	}
+	return changed
+}
+
+// findProfileLocked returns the profile called name, or nil. Callers must hold mu.
+func findProfileLocked(name string) *Profile {
+	for i := range appConfig.Profiles {
+		if appConfig.Profiles[i].Name == name {
+			return &appConfig.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// activeProfileLocked returns the active profile. Callers must hold mu.
+func activeProfileLocked() *Profile {
+	if p := findProfileLocked(appConfig.ActiveProfile); p != nil {
+		return p
+	}
+	return &appConfig.Profiles[0]
+}
+
+// applyActiveProfileLocked makes the active profile's proxy current and
+// updates the menus to match. Callers must hold mu.
+func applyActiveProfileLocked() {
+	p := activeProfileLocked()
+
+	proxy := p.Proxy
+	valid := false
+	for _, candidate := range appConfig.Proxies {
+		if candidate == proxy {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		proxy = ""
+		if len(appConfig.Proxies) > 0 {
+			proxy = appConfig.Proxies[0] // Fallback to the first one
+		}
+	}
+
+	currentProxy = proxy
+	p.Proxy = proxy
+	appConfig.LastSelectedProxy = proxy
+	saveConfig()
+
+	for addr, item := range proxyMenuItems {
+		if addr == proxy {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+	for name, item := range profileMenuItems {
+		if name == p.Name {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+	updateChainMenuLocked()
+	if mDeleteProfile != nil {
+		if len(appConfig.Profiles) > 1 {
+			mDeleteProfile.Enable()
+		} else {
+			mDeleteProfile.Disable()
+		}
+	}
+}
+
+// setProfile switches to the profile called name.
+func setProfile(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if findProfileLocked(name) == nil {
+		return
+	}
+	appConfig.ActiveProfile = name
+	applyActiveProfileLocked()
+	log.Printf(GetText("log_profile_switch")+"\n", name)
+}
+
+// addProfileMenuItemLocked adds name to the Profiles submenu. Callers must hold mu.
+func addProfileMenuItemLocked(name string) {
+	item := mProfiles.AddSubMenuItemCheckbox(name, name, false)
+	profileMenuItems[name] = item
+	go func(profile string, menuItem *systray.MenuItem) {
+		for {
+			<-menuItem.ClickedCh
+			if !mStart.Disabled() {
+				setProfile(profile)
+			}
+		}
+	}(name, item)
+}
+
+// newProfileFromActive creates a profile as a copy of the active one and
+// opens it for editing.
+func newProfileFromActive() {
+	name, err := zenity.Entry(GetText("profile_name_prompt"),
+		zenity.Title(GetText("new_profile")))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		zenity.Warning(GetText("profile_name_empty"), zenity.Title(GetText("input_invalid")))
+		return
+	}
+
+	mu.Lock()
+	if findProfileLocked(name) != nil {
+		mu.Unlock()
+		zenity.Warning(GetText("profile_exists_error"), zenity.Title(GetText("input_invalid")))
+		return
+	}
+	p := *activeProfileLocked()
+	p.Name = name
+	p.Chain = append([]string(nil), p.Chain...)
+	p.DNS = append([]string(nil), p.DNS...)
+	p.Routes = append([]string(nil), p.Routes...)
+	p.Tun2socksArgs = append([]string(nil), p.Tun2socksArgs...)
+	p.FakeIP.DomainSuffix = append([]string(nil), p.FakeIP.DomainSuffix...)
+	p.FakeIP.DomainKeyword = append([]string(nil), p.FakeIP.DomainKeyword...)
+	p.FakeIP.DomainRegex = append([]string(nil), p.FakeIP.DomainRegex...)
+	appConfig.Profiles = append(appConfig.Profiles, p)
+	appConfig.ActiveProfile = name
+	addProfileMenuItemLocked(name)
+	applyActiveProfileLocked()
+	mu.Unlock()
+
+	log.Printf(GetText("log_profile_added")+"\n", name)
+	editActiveProfile()
+}
+
+// editActiveProfile walks the user through the active profile's network
+// settings. The proxy is chosen from the Select Proxy menu as usual.
+func editActiveProfile() {
+	mu.RLock()
+	p := *activeProfileLocked()
+	mu.RUnlock()
+	title := fmt.Sprintf(GetText("edit_profile_title"), p.Name)
+
+	tunAddr, err := zenity.Entry(GetText("profile_tun_prompt"),
+		zenity.Title(title), zenity.EntryText(p.TunIP+"/"+p.TunMask))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	ip, mask, ok := strings.Cut(strings.TrimSpace(tunAddr), "/")
+	if net.ParseIP(ip).To4() == nil || !ok || net.ParseIP(mask).To4() == nil {
+		zenity.Warning(fmt.Sprintf(GetText("profile_value_invalid"), tunAddr), zenity.Title(GetText("input_invalid")))
+		return
+	}
+
+	dns, err := promptList(title, GetText("profile_dns_prompt"), p.DNS, func(s string) bool {
+		return net.ParseIP(s).To4() != nil
+	})
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	routes, err := promptList(title, GetText("profile_routes_prompt"), p.Routes, func(s string) bool {
+		_, _, err := net.ParseCIDR(s)
+		return err == nil
+	})
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	args, err := zenity.Entry(GetText("profile_args_prompt"),
+		zenity.Title(title), zenity.EntryText(strings.Join(p.Tun2socksArgs, " ")))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	active := findProfileLocked(p.Name)
+	if active == nil {
+		return
+	}
+	active.TunIP, active.TunMask = ip, mask
+	active.DNS = dns
+	active.Routes = routes
+	active.Tun2socksArgs = strings.Fields(args)
+	saveConfig()
+
+	log.Printf(GetText("log_profile_updated")+"\n", p.Name)
+}
+
+// promptList asks for a comma-separated list and checks every element.
+func promptList(title, prompt string, current []string, valid func(string) bool) ([]string, error) {
+	text, err := zenity.Entry(prompt, zenity.Title(title), zenity.EntryText(strings.Join(current, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, s := range strings.Split(text, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !valid(s) {
+			return nil, fmt.Errorf(GetTextWithFormat("profile_value_invalid"), s)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// deleteActiveProfile removes the active profile and switches to the first
+// remaining one. The last profile cannot be deleted.
+func deleteActiveProfile() {
+	mu.RLock()
+	name := activeProfileLocked().Name
+	count := len(appConfig.Profiles)
+	mu.RUnlock()
+	if count < 2 {
+		return
+	}
+
+	if err := zenity.Question(fmt.Sprintf(GetText("delete_profile_confirm"), name),
+		zenity.Title(GetText("delete_profile"))); err != nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var kept []Profile
+	for _, p := range appConfig.Profiles {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	appConfig.Profiles = kept
+	appConfig.ActiveProfile = kept[0].Name
+	if item, ok := profileMenuItems[name]; ok {
+		item.Hide()
+		delete(profileMenuItems, name)
+	}
+	applyActiveProfileLocked()
+
+	log.Printf(GetText("log_profile_deleted")+"\n", name)
+}
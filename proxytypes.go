@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ncruces/zenity"
+)
+
+// ProxySpec is the structured form of a tun2socks proxy URL.
+type ProxySpec struct {
+	Protocol   string // One of supportedProxySchemes
+	Server     string
+	Port       string
+	Username   string // HTTP, SOCKS5 and Relay user, SOCKS4 user ID
+	Password   string
+	Cipher     string // Shadowsocks only
+	Plugin     string // Shadowsocks SIP003 plugin name, e.g. "obfs-local"
+	PluginOpts string // Shadowsocks SIP003 plugin options, e.g. "obfs=http;obfs-host=example.com"
+	Tag        string // Optional URL fragment naming the server
+}
+
+// proxyProtocols lists the protocols offered by the typed proxy form, in menu order.
+var proxyProtocols = []struct {
+	Scheme string
+	Name   string
+}{
+	{"socks5", "SOCKS5"},
+	{"http", "HTTP"},
+	{"ss", "Shadowsocks"},
+	{"socks4", "SOCKS4"},
+	{"relay", "Relay"},
+}
+
+// shadowsocksCiphers lists the Shadowsocks ciphers supported by tun2socks.
+var shadowsocksCiphers = []string{
+	"aes-128-gcm",
+	"aes-192-gcm",
+	"aes-256-gcm",
+	"chacha20-ietf-poly1305",
+	"xchacha20-ietf-poly1305",
+}
+
+// URL builds the string passed to tun2socks' -proxy flag.
+func (s ProxySpec) URL() string {
+	u := &url.URL{
+		Scheme: s.Protocol,
+		Host:   net.JoinHostPort(s.Server, s.Port),
+	}
+	switch s.Protocol {
+	case "ss":
+		// SIP002: the user info is the unpadded URL-safe base64 of "cipher:password".
+		userInfo := base64.RawURLEncoding.EncodeToString([]byte(s.Cipher + ":" + s.Password))
+		u.User = url.User(userInfo)
+		if s.Plugin != "" {
+			plugin := s.Plugin
+			if s.PluginOpts != "" {
+				plugin += ";" + s.PluginOpts
+			}
+			u.Path = "/"
+			u.RawQuery = "plugin=" + url.QueryEscape(plugin)
+		}
+	case "socks4":
+		if s.Username != "" {
+			u.User = url.User(s.Username)
+		}
+	default:
+		if s.Username != "" || s.Password != "" {
+			u.User = url.UserPassword(s.Username, s.Password)
+		}
+	}
+	u.Fragment = s.Tag
+	return u.String()
+}
+
+// parseProxySpec splits a proxy URL into its typed fields. Shadowsocks links
+// are accepted both in SIP002 form and in the legacy fully base64-encoded form.
+func parseProxySpec(raw string) (ProxySpec, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), raw)
+	}
+	spec := ProxySpec{Protocol: strings.ToLower(u.Scheme), Tag: u.Fragment}
+	if !supportedProxySchemes[spec.Protocol] {
+		return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_scheme_error"), u.Scheme)
+	}
+
+	if spec.Protocol == "ss" && u.User == nil {
+		// Legacy format: ss://base64(cipher:password@host:port)#tag
+		encoded, _, _ := strings.Cut(raw[len(u.Scheme)+len("://"):], "#")
+		decoded, err := decodeBase64(encoded)
+		if err != nil {
+			return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), raw)
+		}
+		if u, err = url.Parse("ss://" + decoded); err != nil {
+			return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), raw)
+		}
+	}
+
+	spec.Server = u.Hostname()
+	spec.Port = u.Port()
+	if spec.Server == "" || spec.Port == "" {
+		return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), raw)
+	}
+
+	if u.User != nil {
+		spec.Username = u.User.Username()
+		spec.Password, _ = u.User.Password()
+	}
+	if spec.Protocol == "ss" {
+		if _, hasPassword := u.User.Password(); !hasPassword {
+			// SIP002 user info is base64("cipher:password").
+			decoded, err := decodeBase64(spec.Username)
+			if err != nil {
+				return ProxySpec{}, fmt.Errorf(GetTextWithFormat("proxy_invalid_error"), raw)
+			}
+			spec.Username, spec.Password, _ = strings.Cut(decoded, ":")
+		}
+		spec.Cipher, spec.Username = strings.ToLower(spec.Username), ""
+		if plugin := u.Query().Get("plugin"); plugin != "" {
+			spec.Plugin, spec.PluginOpts, _ = strings.Cut(plugin, ";")
+		}
+	}
+	return spec, nil
+}
+
+// decodeBase64 accepts both the standard and URL-safe alphabets, with or
+// without padding, as found in the wild in Shadowsocks links.
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	if data, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return string(data), nil
+	}
+	data, err := base64.RawStdEncoding.DecodeString(s)
+	return string(data), err
+}
+
+// addTypedProxy asks for a protocol and its fields, then adds the resulting URL.
+func addTypedProxy() {
+	names := make([]string, len(proxyProtocols))
+	for i, p := range proxyProtocols {
+		names[i] = p.Name
+	}
+	choice, err := zenity.List(GetText("proxy_protocol_prompt"), names,
+		zenity.Title(GetText("add_typed_proxy")),
+		zenity.DisallowEmpty())
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	spec := ProxySpec{}
+	for _, p := range proxyProtocols {
+		if p.Name == choice {
+			spec.Protocol = p.Scheme
+		}
+	}
+	if spec.Protocol == "ss" {
+		spec.Cipher = shadowsocksCiphers[0]
+	}
+
+	spec, err = promptProxySpec(spec, GetText("add_typed_proxy"))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	newProxy := spec.URL()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := validateProxy(newProxy); err != nil {
+		log.Printf(GetText("log_proxy_rejected")+"\n", newProxy, err)
+		zenity.Warning(err.Error(), zenity.Title(GetText("add_proxy_failed")))
+		return
+	}
+	addProxyLocked(newProxy)
+
+	zenity.Info(GetText("add_proxy_success"), zenity.Title(GetText("operation_success")))
+}
+
+// editProxy lets the user pick an existing proxy, edit it in the typed form
+// and replaces it in place.
+func editProxy() {
+	mu.RLock()
+	list := append([]string(nil), appConfig.Proxies...)
+	mu.RUnlock()
+	if len(list) == 0 {
+		return
+	}
+
+	oldProxy, err := zenity.List(GetText("edit_proxy_prompt"), list,
+		zenity.Title(GetText("edit_proxy")),
+		zenity.DisallowEmpty())
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	spec, err := parseProxySpec(oldProxy)
+	if err != nil {
+		zenity.Warning(err.Error(), zenity.Title(GetText("input_invalid")))
+		return
+	}
+	spec, err = promptProxySpec(spec, GetText("edit_proxy"))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	newProxy := spec.URL()
+	if newProxy == oldProxy {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := validateProxy(newProxy); err != nil {
+		log.Printf(GetText("log_proxy_rejected")+"\n", newProxy, err)
+		zenity.Warning(err.Error(), zenity.Title(GetText("add_proxy_failed")))
+		return
+	}
+	replaceProxyLocked(oldProxy, newProxy)
+
+	zenity.Info(GetText("edit_proxy_success"), zenity.Title(GetText("operation_success")))
+}
+
+// replaceProxyLocked swaps oldProxy for newProxy in the config, keeping its
+// position and selection. Callers must hold mu.
+func replaceProxyLocked(oldProxy, newProxy string) {
+	for i, p := range appConfig.Proxies {
+		if p == oldProxy {
+			appConfig.Proxies[i] = newProxy
+		}
+	}
+	proxies = appConfig.Proxies
+	removeFromChainLocked(oldProxy, newProxy)
+
+	removeProxyMenuItemsLocked(oldProxy)
+	addProxyMenuItemsLocked(newProxy)
+
+	if currentProxy == oldProxy {
+		currentProxy = newProxy
+		appConfig.LastSelectedProxy = newProxy
+		proxyMenuItems[newProxy].Check()
+	}
+	saveConfig()
+
+	log.Printf(GetText("log_proxy_edited")+"\n", oldProxy, newProxy)
+}
+
+// promptProxySpec walks the user through the fields relevant to spec.Protocol,
+// starting from the values already in spec.
+func promptProxySpec(spec ProxySpec, title string) (ProxySpec, error) {
+	server, err := zenity.Entry(GetText("proxy_server_prompt"),
+		zenity.Title(title), zenity.EntryText(spec.Server))
+	if err != nil {
+		return spec, err
+	}
+	spec.Server = strings.TrimSpace(server)
+
+	port, err := zenity.Entry(GetText("proxy_port_prompt"),
+		zenity.Title(title), zenity.EntryText(spec.Port))
+	if err != nil {
+		return spec, err
+	}
+	spec.Port = strings.TrimSpace(port)
+	if n, err := strconv.Atoi(spec.Port); err != nil || n < 1 || n > 65535 {
+		return spec, fmt.Errorf(GetTextWithFormat("proxy_port_invalid"), spec.Port)
+	}
+
+	switch spec.Protocol {
+	case "ss":
+		ciphers := shadowsocksCiphers
+		if spec.Cipher != "" && !slices.Contains(ciphers, spec.Cipher) {
+			// Keep ciphers from imported links selectable even if not in our list.
+			ciphers = append(slices.Clone(ciphers), spec.Cipher)
+		}
+		cipher, err := zenity.List(GetText("proxy_cipher_prompt"), ciphers,
+			zenity.Title(title),
+			zenity.DefaultItems(spec.Cipher),
+			zenity.DisallowEmpty())
+		if err != nil {
+			return spec, err
+		}
+		spec.Cipher = cipher
+
+		_, password, err := zenity.Password(zenity.Title(title))
+		if err != nil {
+			return spec, err
+		}
+		if password != "" {
+			spec.Password = password
+		}
+
+		plugin := spec.Plugin
+		if spec.PluginOpts != "" {
+			plugin += ";" + spec.PluginOpts
+		}
+		plugin, err = zenity.Entry(GetText("proxy_plugin_prompt"),
+			zenity.Title(title), zenity.EntryText(plugin))
+		if err != nil {
+			return spec, err
+		}
+		spec.Plugin, spec.PluginOpts, _ = strings.Cut(strings.TrimSpace(plugin), ";")
+	case "socks4":
+		userID, err := zenity.Entry(GetText("proxy_userid_prompt"),
+			zenity.Title(title), zenity.EntryText(spec.Username))
+		if err != nil {
+			return spec, err
+		}
+		spec.Username = strings.TrimSpace(userID)
+	default:
+		// An empty user name means no authentication.
+		username, err := zenity.Entry(GetText("proxy_username_prompt"),
+			zenity.Title(title), zenity.EntryText(spec.Username))
+		if err != nil {
+			return spec, err
+		}
+		spec.Username = strings.TrimSpace(username)
+		if spec.Username == "" {
+			spec.Password = ""
+			break
+		}
+
+		_, password, err := zenity.Password(zenity.Title(title))
+		if err != nil {
+			return spec, err
+		}
+		// Leaving the password empty keeps the existing one when editing.
+		if password != "" {
+			spec.Password = password
+		}
+	}
+	return spec, nil
+}
+
+// logDialogError logs why a dialog flow ended early and shows any error
+// other than a cancellation to the user.
+func logDialogError(err error) {
+	if errors.Is(err, zenity.ErrCanceled) {
+		log.Println(GetText("user_cancelled"))
+		return
+	}
+	log.Printf(GetText("log_dialog_error")+"\n", err)
+	zenity.Warning(err.Error(), zenity.Title(GetText("input_invalid")))
+}
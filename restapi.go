@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// tun2socks serves live connections over a RESTful API when started with
+// -restapi. TUNTray enables it on a random loopback port with a fresh
+// secret for every run, and talks to it with restAPIClient.
+
+// restAPIEndpoint picks an address and secret for tun2socks' API and
+// returns them with the matching -restapi value.
+func restAPIEndpoint() (addr, secret, flag string, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", "", err
+	}
+	addr = listener.Addr().String()
+	listener.Close() // tun2socks binds it again straight away
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", "", "", err
+	}
+	secret = hex.EncodeToString(token)
+	return addr, secret, "http://" + secret + "@" + addr, nil
+}
+
+// restAPIClient talks to tun2socks' API.
+type restAPIClient struct {
+	base   string // e.g. "http://127.0.0.1:51234"
+	secret string
+	http   *http.Client
+}
+
+func newRestAPIClient(addr, secret string) *restAPIClient {
+	return &restAPIClient{base: "http://" + addr, secret: secret, http: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// connectionMetadata describes the two ends of a flow.
+type connectionMetadata struct {
+	Network         string `json:"network"`
+	SourceIP        string `json:"sourceIP"`
+	SourcePort      uint16 `json:"sourcePort"`
+	DestinationIP   string `json:"destinationIP"`
+	DestinationPort uint16 `json:"destinationPort"`
+}
+
+// destination is the flow's remote end, e.g. "93.184.216.34:443".
+func (m connectionMetadata) destination() string {
+	return net.JoinHostPort(m.DestinationIP, strconv.Itoa(int(m.DestinationPort)))
+}
+
+// connection is a flow through tun2socks.
+type connection struct {
+	ID       string             `json:"id"`
+	Metadata connectionMetadata `json:"metadata"`
+	Upload   int64              `json:"upload"`
+	Download int64              `json:"download"`
+	Start    time.Time          `json:"start"`
+	Process  string             `json:"process,omitempty"` // Filled in by TUNTray when it can tell
+}
+
+// connectionsSnapshot is the answer to GET /connections.
+type connectionsSnapshot struct {
+	DownloadTotal int64        `json:"downloadTotal"`
+	UploadTotal   int64        `json:"uploadTotal"`
+	Connections   []connection `json:"connections"`
+}
+
+// connections lists the active flows.
+func (c *restAPIClient) connections(ctx context.Context) (*connectionsSnapshot, error) {
+	var snapshot connectionsSnapshot
+	if err := c.do(ctx, http.MethodGet, "/connections", &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// closeConnection closes the flow with the given ID.
+func (c *restAPIClient) closeConnection(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/connections/"+url.PathEscape(id), nil)
+}
+
+func (c *restAPIClient) do(ctx context.Context, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(GetTextWithFormat("restapi_status"), method, path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "s3cret"
+
+// startStubRestAPI serves handler as tun2socks' API would, refusing
+// requests without the secret, and returns a client for it.
+func startStubRestAPI(t *testing.T, handler http.HandlerFunc) *restAPIClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer "+testSecret {
+			t.Errorf("Authorization %q, want the bearer secret", got)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return newRestAPIClient(strings.TrimPrefix(server.URL, "http://"), testSecret)
+}
+
+func TestRestAPIConnections(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	client := startStubRestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/connections" {
+			t.Errorf("got %s %s, want GET /connections", r.Method, r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"downloadTotal": 2048,
+			"uploadTotal":   1024,
+			"connections": []map[string]any{{
+				"id": "c1",
+				"metadata": map[string]any{
+					"network":         "tcp",
+					"sourceIP":        "198.18.0.1",
+					"sourcePort":      50000,
+					"destinationIP":   "2001:db8::1",
+					"destinationPort": 443,
+				},
+				"upload":   100,
+				"download": 200,
+				"start":    start,
+				"chains":   []string{"ignored"},
+			}},
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snapshot, err := client.connections(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.DownloadTotal != 2048 || snapshot.UploadTotal != 1024 {
+		t.Errorf("totals %d/%d, want 2048/1024", snapshot.DownloadTotal, snapshot.UploadTotal)
+	}
+	if len(snapshot.Connections) != 1 {
+		t.Fatalf("got %d connections, want 1", len(snapshot.Connections))
+	}
+	c := snapshot.Connections[0]
+	if c.ID != "c1" || c.Upload != 100 || c.Download != 200 || !c.Start.Equal(start) {
+		t.Errorf("got %+v", c)
+	}
+	if got := c.Metadata.destination(); got != "[2001:db8::1]:443" {
+		t.Errorf("destination %q, want [2001:db8::1]:443", got)
+	}
+}
+
+func TestRestAPICloseConnectionEscapesID(t *testing.T) {
+	client := startStubRestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("method %s, want DELETE", r.Method)
+		}
+		// The ID must stay a single path segment.
+		if got := r.URL.EscapedPath(); got != "/connections/a%2Fb%20c" {
+			t.Errorf("path %q, want /connections/a%%2Fb%%20c", got)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.closeConnection(ctx, "a/b c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestAPIErrorStatus(t *testing.T) {
+	client := startStubRestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.connections(ctx); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("GET: got %v, want an error with the status", err)
+	}
+	if err := client.closeConnection(ctx, "c1"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("DELETE: got %v, want an error with the status", err)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ncruces/zenity"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Rule targets with a fixed meaning. Any other target names a proxy from
+// the list, by its tag (the URL fragment) or its full URL.
+const (
+	ruleTargetDirect = "DIRECT" // Bypass the proxy
+	ruleTargetReject = "REJECT" // Refuse the connection
+	ruleTargetProxy  = "PROXY"  // The active profile's proxy or chain
+)
+
+const defaultGeoIPDatabase = "Country.mmdb"
+
+// routingRule is one Clash-style rule, e.g. "DOMAIN-SUFFIX,github.com,PROXY".
+type routingRule struct {
+	Type   string
+	Value  string
+	Target string
+	Line   string     // As written in the config, for explanations
+	cidr   *net.IPNet // For IP-CIDR
+}
+
+// ruleEngine matches connections against the rules in order.
+type ruleEngine struct {
+	rules []routingRule
+	geoip *maxminddb.Reader // Nil unless a GEOIP rule is used
+}
+
+// compileRules parses the rules and opens the GeoIP database if needed.
+func compileRules(lines []string, geoipPath string) (*ruleEngine, error) {
+	e := &ruleEngine{}
+	fail := func(err error) (*ruleEngine, error) {
+		e.Close()
+		return nil, err
+	}
+	for _, line := range lines {
+		r, ok, err := parseRoutingRule(line)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			continue
+		}
+		if r.Type == "GEOIP" && e.geoip == nil {
+			db, err := maxminddb.Open(geoipPath)
+			if err != nil {
+				return fail(fmt.Errorf(GetTextWithFormat("geoip_open_fail"), geoipPath, err))
+			}
+			e.geoip = db
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+// parseRoutingRule parses one line of the rules. Blank lines and comments
+// return ok == false.
+func parseRoutingRule(line string) (r routingRule, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	r = routingRule{Type: strings.ToUpper(fields[0]), Line: line}
+	switch {
+	case r.Type == "MATCH" && len(fields) == 2:
+		r.Target = fields[1]
+	case len(fields) == 3 || (len(fields) == 4 && strings.EqualFold(fields[3], "no-resolve")):
+		r.Value, r.Target = fields[1], fields[2]
+	default:
+		return r, false, fmt.Errorf(GetTextWithFormat("rule_invalid"), line)
+	}
+
+	switch r.Type {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		r.Value = strings.ToLower(strings.Trim(r.Value, "."))
+	case "IP-CIDR", "IP-CIDR6":
+		_, cidr, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return r, false, fmt.Errorf(GetTextWithFormat("rule_invalid"), line)
+		}
+		r.cidr = cidr
+	case "GEOIP":
+		r.Value = strings.ToUpper(r.Value)
+	case "MATCH":
+	default:
+		return r, false, fmt.Errorf(GetTextWithFormat("rule_invalid"), line)
+	}
+	if strings.EqualFold(r.Target, ruleTargetDirect) || strings.EqualFold(r.Target, ruleTargetReject) || strings.EqualFold(r.Target, ruleTargetProxy) {
+		r.Target = strings.ToUpper(r.Target)
+	}
+	return r, true, nil
+}
+
+// Close releases the GeoIP database.
+func (e *ruleEngine) Close() {
+	if e.geoip != nil {
+		e.geoip.Close()
+		e.geoip = nil
+	}
+}
+
+// Country returns the ISO country code of ip from the GeoIP database.
+func (e *ruleEngine) Country(ip net.IP) string {
+	return countryOf(e.geoip, ip)
+}
+
+// countryOf returns the ISO country code of ip from db, if it knows it.
+func countryOf(db *maxminddb.Reader, ip net.IP) string {
+	if db == nil || ip == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// Match returns the first rule matching a connection to domain or ip, either
+// of which may be empty, and false when no rule matches.
+func (e *ruleEngine) Match(domain string, ip net.IP) (routingRule, bool) {
+	for _, r := range e.rules {
+		matched := false
+		switch r.Type {
+		case "DOMAIN":
+			matched = domain == r.Value
+		case "DOMAIN-SUFFIX":
+			matched = domain != "" && (domain == r.Value || strings.HasSuffix(domain, "."+r.Value))
+		case "DOMAIN-KEYWORD":
+			matched = domain != "" && strings.Contains(domain, r.Value)
+		case "IP-CIDR", "IP-CIDR6":
+			matched = ip != nil && r.cidr.Contains(ip)
+		case "GEOIP":
+			matched = ip != nil && e.Country(ip) == r.Value
+		case "MATCH":
+			matched = true
+		}
+		if matched {
+			return r, true
+		}
+	}
+	return routingRule{}, false
+}
+
+// DirectRoutes returns the CIDRs of the leading IP-CIDR,DIRECT rules. No
+// earlier rule can claim their traffic, so they can bypass the tunnel with
+// plain routes instead of going through the dispatcher.
+func (e *ruleEngine) DirectRoutes() []string {
+	var routes []string
+	for _, r := range e.rules {
+		if r.Type != "IP-CIDR" || r.Target != ruleTargetDirect {
+			break
+		}
+		routes = append(routes, r.cidr.String())
+	}
+	return routes
+}
+
+// Targets returns the named proxies the rules refer to.
+func (e *ruleEngine) Targets() []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, r := range e.rules {
+		switch r.Target {
+		case ruleTargetDirect, ruleTargetReject, ruleTargetProxy:
+			continue
+		}
+		if !seen[r.Target] {
+			seen[r.Target] = true
+			targets = append(targets, r.Target)
+		}
+	}
+	return targets
+}
+
+// findNamedProxyLocked returns the proxy whose tag or URL is name. Callers must
+// hold mu.
+func findNamedProxyLocked(name string) (string, bool) {
+	for _, p := range appConfig.Proxies {
+		if p == name {
+			return p, true
+		}
+		if u, err := url.Parse(p); err == nil && u.Fragment != "" && strings.EqualFold(u.Fragment, name) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// decide returns the rule deciding a connection to host, as tun2socks or
+// the fake-IP listener hands it over, and false if none matches and the
+// connection goes to the proxy. It also returns what the rules saw of the
+// connection. Names are never resolved: a connection made by name meets
+// only domain rules, and one made by address meets domain rules only if
+// the DNS forwarder resolved a name to that address.
+func (e *ruleEngine) decide(host string) (r routingRule, domain string, ip net.IP, ok bool) {
+	domain, ip = strings.ToLower(host), net.ParseIP(host)
+	if ip != nil {
+		domain = resolvedDomains.Lookup(ip)
+	}
+	r, ok = e.Match(domain, ip)
+	return r, domain, ip, ok
+}
+
+// ruleDialer dispatches each connection to DIRECT, REJECT or a proxy
+// according to the rules.
+type ruleDialer struct {
+	engine  *ruleEngine
+	direct  proxyDialer
+	proxies map[string]proxyDialer // By target, including ruleTargetProxy
+}
+
+// newRuleDialer prepares a dialer for every target of engine. proxy is the
+// dialer of the active profile.
+func newRuleDialer(engine *ruleEngine, proxy, direct proxyDialer) (*ruleDialer, error) {
+	d := &ruleDialer{engine: engine, direct: direct, proxies: map[string]proxyDialer{ruleTargetProxy: proxy}}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, target := range engine.Targets() {
+		addr, ok := findNamedProxyLocked(target)
+		if !ok {
+			return nil, fmt.Errorf(GetTextWithFormat("rule_target_unknown"), target)
+		}
+		dialer, err := newChainDialer([]string{addr}, direct)
+		if err != nil {
+			return nil, err
+		}
+		d.proxies[target] = dialer
+	}
+	return d, nil
+}
+
+var errRuleRejected = errors.New("rejected by rule")
+
+func (d *ruleDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	target := ruleTargetProxy
+	if r, _, _, ok := d.engine.decide(host); ok {
+		target = r.Target
+	}
+	switch target {
+	case ruleTargetReject:
+		return nil, errRuleRejected
+	case ruleTargetDirect:
+		return d.direct.DialContext(ctx, network, address)
+	}
+	return d.proxies[target].DialContext(ctx, network, address)
+}
+
+// --- Resolved domains ---
+
+// domainCache remembers which domain the DNS forwarder resolved to each
+// address, so domain rules also apply to connections made by IP.
+type domainCache struct {
+	mu      sync.Mutex
+	domains map[string]string
+}
+
+const domainCacheSize = 8192
+
+var resolvedDomains = &domainCache{domains: make(map[string]string)}
+
+func (c *domainCache) Record(ip net.IP, domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.domains) >= domainCacheSize {
+		c.domains = make(map[string]string)
+	}
+	c.domains[ip.String()] = domain
+}
+
+func (c *domainCache) Lookup(ip net.IP) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.domains[ip.String()]
+}
+
+// recordDNSAnswers remembers the A records of a response to a query for
+// domain.
+func recordDNSAnswers(domain string, resp []byte) {
+	_, off, _, err := parseDNSMessage(resp)
+	if err != nil {
+		return
+	}
+	answers := int(binary.BigEndian.Uint16(resp[6:]))
+	for i := 0; i < answers; i++ {
+		_, o, err := readDNSName(resp, off)
+		if err != nil || o+10 > len(resp) {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(resp[o+8:]))
+		if binary.BigEndian.Uint16(resp[o:]) == dnsTypeA && length == 4 && o+14 <= len(resp) {
+			resolvedDomains.Record(net.IP(resp[o+10:o+14]), domain)
+		}
+		off = o + 10 + length
+	}
+}
+
+// --- Rule tester ---
+
+// testRules asks for a URL, domain or IP and explains which rule matches it.
+func testRules() {
+	input, err := zenity.Entry(GetText("test_rules_prompt"),
+		zenity.Title(GetText("test_rules")))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	host := strings.TrimSpace(input)
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return
+	}
+
+	mu.RLock()
+	lines := append([]string(nil), appConfig.RoutingRules...)
+	geoipPath := appConfig.GeoIPDatabase
+	fakeIP := activeProfileLocked().FakeIP
+	forwarder := appConfig.DNSForwarder.Enabled || fakeIP.Enabled
+	mu.RUnlock()
+	if geoipPath == "" {
+		geoipPath = defaultGeoIPDatabase
+	}
+	engine, err := compileRules(lines, geoipPath)
+	if err != nil {
+		zenity.Error(err.Error(), zenity.Title(GetText("test_rules")))
+		return
+	}
+	defer engine.Close()
+
+	// A name reaches the dispatcher as it is if fake-IP mode covers it, and
+	// otherwise as the address applications resolve it to. The forwarder,
+	// when on, records which name that address came from, as it would for
+	// the application.
+	target := host
+	if net.ParseIP(host) == nil {
+		byName := false
+		if fakeIP.Enabled {
+			if m, err := newDomainMatcher(fakeIP); err == nil {
+				byName = m.Match(strings.ToLower(host))
+			}
+		}
+		if ips, err := net.LookupIP(host); !byName && err == nil {
+			for _, ip := range ips {
+				if ip.To4() == nil {
+					continue // The forwarder only records A answers
+				}
+				target = ip.String()
+				if forwarder {
+					resolvedDomains.Record(ip, strings.ToLower(host))
+				}
+				break
+			}
+		}
+	}
+
+	r, domain, ip, ok := engine.decide(target)
+	seen := func(v string) string {
+		if v == "" || v == "<nil>" {
+			return "-"
+		}
+		return v
+	}
+	details := fmt.Sprintf(GetText("test_rules_subject"), host, seen(domain), seen(ip.String()), seen(engine.Country(ip)))
+	var result string
+	if ok {
+		result = fmt.Sprintf(GetText("test_rules_matched"), r.Line, r.Target)
+	} else {
+		result = fmt.Sprintf(GetText("test_rules_default"), ruleTargetProxy)
+	}
+	log.Printf(GetText("log_rule_test")+"\n", host, result)
+	zenity.Info(details+"\n\n"+result, zenity.Title(GetText("test_rules")))
+}
+
+// --- Direct routes ---
+
+// directRoutes lists the routes added by applyDirectRoutes.
+var directRoutes []*net.IPNet
+
+// applyDirectRoutes sends cidrs to the default gateway outside the tunnel.
+// They are only a shortcut: the dispatcher sends the same traffic direct.
+func applyDirectRoutes(cidrs []string) {
+	gateway := defaultGateway()
+	if gateway == "" {
+		return
+	}
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil || cidr.IP.To4() == nil {
+			continue
+		}
+		mask := net.IP(cidr.Mask).String()
+		if output, err := hiddenCommand("route", "add", cidr.IP.String(), "mask", mask, gateway, "metric", "1").CombinedOutput(); err != nil {
+			logWarn(GetText("log_direct_route_fail"), c, strings.TrimSpace(string(output)))
+			continue
+		}
+		directRoutes = append(directRoutes, cidr)
+	}
+	if len(directRoutes) > 0 {
+		log.Printf(GetText("log_direct_routes")+"\n", len(directRoutes), gateway)
+	}
+}
+
+// removeDirectRoutes undoes applyDirectRoutes.
+func removeDirectRoutes() {
+	for _, cidr := range directRoutes {
+		hiddenCommand("route", "delete", cidr.IP.String(), "mask", net.IP(cidr.Mask).String()).Run()
+	}
+	directRoutes = nil
+}
+
+// activeRules is the rule engine of the running tunnel, or nil.
+var activeRules *ruleEngine
+
+// closeRuleEngine releases the running rule engine and its direct routes.
+func closeRuleEngine() {
+	removeDirectRoutes()
+	if activeRules != nil {
+		activeRules.Close()
+		activeRules = nil
+	}
+}
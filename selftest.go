@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+// Once the tunnel is up, a self-test checks that traffic actually gets
+// through it: DNS through the server the adapter was given, a TCP connection, an HTTP
+// request and, optionally, the external IP address. Its sockets are bound
+// to the TUN address, so they take the tunnel whatever the routes say. A
+// failure leaves the tunnel up but marks it degraded.
+
+const (
+	selfTestTimeout     = 30 * time.Second // For the whole test
+	selfTestStepTimeout = 10 * time.Second
+)
+
+// SelfTestConfig controls the post-connect self-test.
+type SelfTestConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Host       string `json:"host"`        // Resolved through the adapter's DNS server
+	URL        string `json:"url"`         // Fetched through the tunnel; any status below 400 passes
+	ExternalIP bool   `json:"external_ip"` // Also look up the public address, from ExternalIPConfig.URL
+}
+
+// defaultSelfTest is used for configs written before the self-test existed.
+var defaultSelfTest = SelfTestConfig{Enabled: true, Host: "www.gstatic.com", URL: "http://www.gstatic.com/generate_204"}
+
+// selfTestSteps are the steps in the order they run.
+var selfTestSteps = []string{"dns", "tcp", "http", "external_ip"}
+
+// selfTestStep is the outcome of one step.
+type selfTestStep struct {
+	Name     string
+	Skipped  bool
+	Err      error
+	Detail   string
+	Duration time.Duration
+}
+
+func (s selfTestStep) label() string { return GetText("selftest_" + s.Name) }
+
+// selfTestResult is a completed self-test.
+type selfTestResult struct {
+	session    time.Time // connectedSince() when the test started
+	Steps      []selfTestStep
+	ExternalIP string
+}
+
+// err reports the first failed step, if any.
+func (r *selfTestResult) err() error {
+	for _, s := range r.Steps {
+		if s.Err != nil {
+			return stepFailed(s.label(), fmt.Errorf(GetTextWithFormat("selftest_failed"), s.label(), s.Err))
+		}
+	}
+	return nil
+}
+
+var (
+	selfTestFinished = make(chan *selfTestResult)
+	selfTestRunning  bool            // Owned by the main event loop
+	lastSelfTest     *selfTestResult // Owned by the main event loop
+)
+
+// startSelfTest tests the running tunnel in the background, unless the test
+// is switched off and force is false. It must run on the main event loop,
+// which receives the result.
+func startSelfTest(force bool) {
+	// An operation in progress may be tearing down what would be tested.
+	if s, _ := currentState(); !s.connected() || selfTestRunning || activeOp != nil {
+		return
+	}
+	mu.RLock()
+	config := appConfig.SelfTest
+	endpoint := externalIPEndpointLocked()
+	profile := runningProfile
+	mu.RUnlock()
+	if !config.Enabled && !force {
+		return
+	}
+	dns := configuredDNS(profile)
+
+	selfTestRunning = true
+	session := connectedSince()
+	log.Println(GetText("log_selftest_start"))
+	updateSelfTestMenu()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+		defer cancel()
+		result := runSelfTest(ctx, profile, dns, config, endpoint)
+		result.session = session
+		selfTestFinished <- result
+	}()
+}
+
+// finishSelfTest records result on the main event loop and marks the
+// tunnel degraded, or healthy again, if it is still the session tested.
+func finishSelfTest(result *selfTestResult) {
+	selfTestRunning = false
+	lastSelfTest = result
+	for _, step := range result.Steps {
+		switch {
+		case step.Skipped:
+		case step.Err != nil:
+			logWarn(GetText("log_selftest_step_fail"), step.label(), step.Err)
+		default:
+			log.Printf(GetText("log_selftest_step_ok")+"\n", step.label(), step.Detail, step.Duration.Round(time.Millisecond))
+		}
+	}
+	updateSelfTestMenu()
+
+	s, _ := currentState()
+	if !s.connected() || !result.session.Equal(connectedSince()) {
+		return // The tunnel went down or reconnected meanwhile
+	}
+	if err := result.err(); err != nil {
+		setState(stateDegraded, err)
+	} else if s == stateDegraded {
+		setState(stateConnected, nil)
+	}
+}
+
+// dnsTarget is the DNS server the self-test asks.
+type dnsTarget struct {
+	addr string // host:port; empty uses the system resolver
+	tcp  bool   // Query over TCP even where UDP would be used
+}
+
+// configuredDNS returns the server the TUN adapter was given: the forwarder
+// when it runs, otherwise the profile's first server. Without the
+// forwarder, tun2socks may be using the local SOCKS5 listener, which cannot
+// relay UDP, so the query goes over TCP. It must run on the main event loop
+// while no operation is in progress.
+func configuredDNS(profile Profile) dnsTarget {
+	switch {
+	case dnsServer != nil:
+		return dnsTarget{addr: dnsServer.Addr()}
+	case len(profile.DNS) > 0:
+		return dnsTarget{addr: net.JoinHostPort(profile.DNS[0], "53"), tcp: chainServer != nil}
+	}
+	return dnsTarget{}
+}
+
+// tunnelNet returns a dialer and resolver whose sockets are bound to the
+// TUN address of profile, so they go through the tunnel. The resolver asks
+// dns.
+func tunnelNet(profile Profile, dns dnsTarget) (*net.Dialer, *net.Resolver) {
+	tunIP := net.ParseIP(profile.TunIP)
+	dialer := &net.Dialer{Timeout: selfTestStepTimeout, LocalAddr: &net.TCPAddr{IP: tunIP}}
+	if dns.addr == "" {
+		return dialer, net.DefaultResolver
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: selfTestStepTimeout}
+			if dns.tcp {
+				network = "tcp"
+			}
+			if strings.HasPrefix(network, "udp") {
+				d.LocalAddr = &net.UDPAddr{IP: tunIP}
+			} else {
+				d.LocalAddr = &net.TCPAddr{IP: tunIP}
+			}
+			return d.DialContext(ctx, network, dns.addr)
+		},
+	}
+	return dialer, resolver
+}
+
+// tunnelHTTPClient returns an HTTP client that connects with dialer and
+// resolver.
+func tunnelHTTPClient(dialer *net.Dialer, resolver *net.Resolver) *http.Client {
+	return &http.Client{
+		Timeout: selfTestStepTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				addrs, err := resolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0].IP.String(), port))
+			},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// runSelfTest runs the steps in order, skipping the rest after a failure.
+func runSelfTest(ctx context.Context, profile Profile, dns dnsTarget, config SelfTestConfig, endpoint string) *selfTestResult {
+	dialer, resolver := tunnelNet(profile, dns)
+	client := tunnelHTTPClient(dialer, resolver)
+
+	result := &selfTestResult{}
+	var ip net.IP
+	steps := map[string]func() (string, error){
+		"dns": func() (string, error) {
+			addrs, err := resolver.LookupIPAddr(ctx, config.Host)
+			if err != nil {
+				return "", err
+			}
+			ip = addrs[0].IP
+			return fmt.Sprintf("%s → %s", config.Host, ip), nil
+		},
+		"tcp": func() (string, error) {
+			port := "80"
+			if u, err := url.Parse(config.URL); err == nil {
+				if u.Port() != "" {
+					port = u.Port()
+				} else if u.Scheme == "https" {
+					port = "443"
+				}
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return "", err
+			}
+			conn.Close()
+			return net.JoinHostPort(ip.String(), port), nil
+		},
+		"http": func() (string, error) {
+			status, _, err := httpGet(ctx, client, config.URL)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s: %s", config.URL, status), nil
+		},
+		"external_ip": func() (string, error) {
+			addr, err := lookupExternalIP(ctx, client, endpoint)
+			result.ExternalIP = addr
+			return addr, err
+		},
+	}
+
+	failed := false
+	for _, name := range selfTestSteps {
+		step := selfTestStep{Name: name}
+		if failed || (name == "external_ip" && !config.ExternalIP) {
+			step.Skipped = true
+		} else {
+			start := time.Now()
+			step.Detail, step.Err = steps[name]()
+			step.Duration = time.Since(start)
+			failed = step.Err != nil
+		}
+		result.Steps = append(result.Steps, step)
+	}
+	return result
+}
+
+// httpGet fetches rawURL and returns its status and up to 4 KB of body. A
+// status of 400 or above is an error.
+func httpGet(ctx context.Context, client *http.Client, rawURL string) (string, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return resp.Status, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return resp.Status, body, fmt.Errorf(GetTextWithFormat("selftest_http_status"), resp.Status)
+	}
+	return resp.Status, body, nil
+}
+
+// lookupExternalIP asks endpoint, which answers with a bare address, where
+// client's requests come from.
+func lookupExternalIP(ctx context.Context, client *http.Client, endpoint string) (string, error) {
+	_, body, err := httpGet(ctx, client, endpoint)
+	if err != nil {
+		return "", err
+	}
+	addr := strings.TrimSpace(string(body))
+	if net.ParseIP(addr) == nil {
+		return "", errors.New(GetText("selftest_bad_external_ip"))
+	}
+	return addr, nil
+}
+
+// --- Tray ---
+
+var (
+	mSelfTest     *systray.MenuItem
+	mRunSelfTest  *systray.MenuItem
+	selfTestItems map[string]*systray.MenuItem
+)
+
+// addSelfTestMenu adds the Self-Test submenu, with a line per step.
+func addSelfTestMenu() {
+	mSelfTest = systray.AddMenuItem(GetText("selftest"), GetText("selftest_tooltip"))
+	selfTestItems = make(map[string]*systray.MenuItem)
+	for _, name := range selfTestSteps {
+		item := mSelfTest.AddSubMenuItem("", "")
+		item.Disable()
+		selfTestItems[name] = item
+	}
+	mRunSelfTest = mSelfTest.AddSubMenuItem(GetText("selftest_run"), GetText("selftest_run_tooltip"))
+	updateSelfTestMenu()
+}
+
+// refreshSelfTestMenuTexts relabels the submenu after a language switch.
+func refreshSelfTestMenuTexts() {
+	if mSelfTest == nil {
+		return
+	}
+	mSelfTest.SetTitle(GetText("selftest"))
+	mSelfTest.SetTooltip(GetText("selftest_tooltip"))
+	mRunSelfTest.SetTitle(GetText("selftest_run"))
+	mRunSelfTest.SetTooltip(GetText("selftest_run_tooltip"))
+	updateSelfTestMenu()
+}
+
+// updateSelfTestMenu shows the last result, step by step.
+func updateSelfTestMenu() {
+	if mSelfTest == nil {
+		return
+	}
+	if selfTestRunning {
+		mRunSelfTest.Disable()
+	} else {
+		mRunSelfTest.Enable()
+	}
+	for _, name := range selfTestSteps {
+		step := selfTestStep{Name: name, Skipped: true}
+		if lastSelfTest != nil {
+			for _, s := range lastSelfTest.Steps {
+				if s.Name == name {
+					step = s
+				}
+			}
+		}
+		var status string
+		switch {
+		case selfTestRunning:
+			status = GetText("selftest_running")
+		case lastSelfTest == nil:
+			status = GetText("selftest_not_run")
+		case step.Skipped:
+			status = GetText("selftest_skipped")
+		case step.Err != nil:
+			status = "✗ " + step.Err.Error()
+		default:
+			status = fmt.Sprintf("✓ %s (%s)", step.Detail, step.Duration.Round(time.Millisecond))
+		}
+		selfTestItems[name].SetTitle(step.label() + ": " + status)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/getlantern/systray"
+)
+
+// tunnelState is where the tunnel is in its lifecycle. It only changes
+// through setState, which keeps the tray icon, tooltip and menu in step.
+type tunnelState int
+
+const (
+	stateDisconnected tunnelState = iota
+	stateConnecting
+	stateConnected
+	stateReconnecting
+	stateError
+	stateDegraded // Connected, but the self-test failed
+)
+
+func (s tunnelState) String() string {
+	switch s {
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateReconnecting:
+		return "reconnecting"
+	case stateError:
+		return "error"
+	case stateDegraded:
+		return "degraded"
+	}
+	return "disconnected"
+}
+
+// label is the state's name for display.
+func (s tunnelState) label() string {
+	return GetText("state_" + s.String())
+}
+
+// active reports whether the tunnel is switched on in this state.
+func (s tunnelState) active() bool {
+	return s == stateConnecting || s == stateReconnecting || s.connected()
+}
+
+// connected reports whether the tunnel is up, working or not.
+func (s tunnelState) connected() bool {
+	return s == stateConnected || s == stateDegraded
+}
+
+// stateMu guards the fields below. It is separate from mu because the
+// state is read by code that already holds mu.
+var (
+	stateMu     sync.RWMutex
+	state       tunnelState
+	stateErr    error     // Why the last attempt failed, in stateError or stateDegraded
+	connectedAt time.Time // When the tunnel last came up
+)
+
+// setState moves the tunnel to s, with err explaining stateError.
+func setState(s tunnelState, err error) {
+	stateMu.Lock()
+	prev := state
+	if s.connected() && !prev.connected() {
+		connectedAt = time.Now()
+	}
+	state = s
+	stateErr = err
+	stateMu.Unlock()
+	log.Printf(GetText("log_state_changed")+"\n", s)
+	trafficStateChanged(prev, s)
+	exitStateChanged(prev, s)
+	updateTrayState()
+	notifyStateChange(prev, s, err)
+}
+
+// currentState returns the state and, in stateError or stateDegraded, what
+// went wrong.
+func currentState() (tunnelState, error) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state, stateErr
+}
+
+// tunnelRunning reports whether the user has the tunnel switched on.
+func tunnelRunning() bool {
+	s, _ := currentState()
+	return s.active()
+}
+
+// uptime returns how long the tunnel has been connected, or 0.
+func uptime() time.Duration {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if !state.connected() {
+		return 0
+	}
+	return time.Since(connectedAt)
+}
+
+// connectedSince returns when the tunnel came up, identifying the session.
+func connectedSince() time.Time {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return connectedAt
+}
+
+// updateTrayState shows the current state in the tray icon, tooltip and
+// Start/Stop items. It does nothing when running headless.
+func updateTrayState() {
+	if mStart == nil {
+		return
+	}
+	s, _ := currentState()
+	systray.SetIcon(stateIcon(s))
+	updateTooltip()
+	if s.active() {
+		mStart.Disable()
+	} else {
+		mStart.Enable()
+	}
+	// While connecting, Cancel takes the place of Stop.
+	if s.connected() {
+		mStop.Enable()
+	} else {
+		mStop.Disable()
+	}
+	if s == stateConnecting || s == stateReconnecting {
+		mCancel.Show()
+	} else {
+		mCancel.Hide()
+	}
+}
+
+// updateTooltip shows the current state in the tray tooltip.
+func updateTooltip() {
+	if mStart == nil {
+		return
+	}
+	s, err := currentState()
+	systray.SetTooltip(truncateUTF16(stateTooltip(s, err), maxTooltip))
+}
+
+// maxTooltip is how many UTF-16 code units the tray tooltip holds, leaving
+// room for the terminating NUL of its 128-unit buffer.
+const maxTooltip = 127
+
+// truncateUTF16 shortens s to at most n UTF-16 code units without splitting
+// a character.
+func truncateUTF16(s string, n int) string {
+	units := 0
+	for i, r := range s {
+		units += utf16.RuneLen(r)
+		if units > n {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// stateTooltip describes s for the tray tooltip.
+func stateTooltip(s tunnelState, err error) string {
+	lines := []string{GetText("app_title") + " - " + s.label()}
+	switch s {
+	case stateConnected, stateDegraded, stateConnecting, stateReconnecting:
+		mu.RLock()
+		profile := runningProfile
+		if s == stateConnecting {
+			profile = *activeProfileLocked()
+		}
+		mu.RUnlock()
+		if route := proxyRoute(profile); route != "" {
+			lines = append(lines, route)
+		}
+		if s.connected() {
+			lines = append(lines, fmt.Sprintf(GetText("tooltip_uptime"), formatUptime(uptime())))
+			if traffic := trafficTooltip(); traffic != "" {
+				lines = append(lines, traffic)
+			}
+			if exit := exitTooltip(); exit != "" {
+				lines = append(lines, exit)
+			}
+		}
+		if s == stateDegraded && err != nil {
+			lines = append(lines, failureSummary(err))
+		}
+	case stateError:
+		if err != nil {
+			lines = append(lines, failureSummary(err))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failureSummary says briefly what went wrong for the tooltip: the failed
+// step rather than the full error, which may quote command output.
+func failureSummary(err error) string {
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		return GetText("details_step") + ": " + stepErr.Step
+	}
+	line, _, _ := strings.Cut(redactSecrets(err.Error()), "\n")
+	return line
+}
+
+// proxyRoute names the proxies p goes through, by tag or host:port, so it
+// can be shown without their credentials.
+func proxyRoute(p Profile) string {
+	hops := p.Chain
+	if len(hops) == 0 && p.Proxy != "" {
+		hops = []string{p.Proxy}
+	}
+	return proxyNames(hops)
+}
+
+// proxyNames joins the names of hops, as proxyRoute does.
+func proxyNames(hops []string) string {
+	names := make([]string, len(hops))
+	for i, hop := range hops {
+		names[i] = proxyName(hop)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// proxyName is the tag of a proxy URL, or its host:port when untagged.
+func proxyName(raw string) string {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return redactSecrets(raw)
+	case u.Fragment != "":
+		return u.Fragment
+	case u.Host != "":
+		return u.Host
+	}
+	return redactSecrets(raw)
+}
+
+// formatUptime renders d to the minute, e.g. "2h05m" or "7m".
+func formatUptime(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+// refreshUptime keeps the uptime in the tooltip current.
+func refreshUptime() {
+	for range time.Tick(time.Minute) {
+		if s, _ := currentState(); s.connected() {
+			updateTooltip()
+		}
+	}
+}
+
+// --- Icons ---
+
+var (
+	stateIconsOnce sync.Once
+	stateIcons     map[tunnelState][]byte
+)
+
+// stateIcon returns the tray icon for s: the app icon greyed out when
+// disconnected, and with a coloured status dot otherwise.
+func stateIcon(s tunnelState) []byte {
+	stateIconsOnce.Do(func() {
+		stateIcons = make(map[tunnelState][]byte)
+		base, err := decodeICO(iconData)
+		if err != nil {
+			logWarn(GetText("log_state_icon_fail"), err)
+			return
+		}
+		badges := map[tunnelState]color.RGBA{
+			stateConnecting:   {0xf3, 0x9c, 0x12, 0xff},
+			stateConnected:    {0x2e, 0xcc, 0x71, 0xff},
+			stateReconnecting: {0xf3, 0x9c, 0x12, 0xff},
+			stateError:        {0xe7, 0x4c, 0x3c, 0xff},
+			stateDegraded:     {0xf1, 0xc4, 0x0f, 0xff},
+		}
+		stateIcons[stateDisconnected] = encodeICO(greyscale(base))
+		for state, badge := range badges {
+			stateIcons[state] = encodeICO(withBadge(base, badge))
+		}
+	})
+	if icon, ok := stateIcons[s]; ok {
+		return icon
+	}
+	return iconData
+}
+
+// decodeICO returns the first image of an .ico file whose images are
+// stored as PNG, as in winres/icon.ico.
+func decodeICO(data []byte) (image.Image, error) {
+	if len(data) < 22 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return nil, fmt.Errorf("not an icon")
+	}
+	offset := binary.LittleEndian.Uint32(data[18:])
+	if int(offset) >= len(data) {
+		return nil, fmt.Errorf("bad icon offset %d", offset)
+	}
+	return png.Decode(bytes.NewReader(data[offset:]))
+}
+
+// encodeICO wraps img in a single-image .ico file with a PNG payload.
+func encodeICO(img image.Image) []byte {
+	var payload bytes.Buffer
+	png.Encode(&payload, img)
+	size := img.Bounds().Size()
+	dim := func(n int) byte {
+		if n >= 256 {
+			return 0 // 0 means 256
+		}
+		return byte(n)
+	}
+
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, [3]uint16{0, 1, 1})
+	ico.Write([]byte{dim(size.X), dim(size.Y), 0, 0})
+	binary.Write(&ico, binary.LittleEndian, [2]uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, [2]uint32{uint32(payload.Len()), 22})
+	ico.Write(payload.Bytes())
+	return ico.Bytes()
+}
+
+func greyscale(src image.Image) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			g := color.GrayModel.Convert(color.NRGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+			// Lighten it too, so it reads as inactive next to other icons.
+			v := uint8(0x60 + int(g.Y)*0x9f/0xff)
+			dst.SetNRGBA(x, y, color.NRGBA{v, v, v, c.A})
+		}
+	}
+	return dst
+}
+
+// withBadge draws a dot of colour c, ringed in white, over the bottom
+// right corner of src. It is sized to stay visible at 16x16.
+func withBadge(src image.Image, c color.RGBA) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	size := float64(b.Dx())
+	outer := size * 0.24
+	inner := outer - size*0.05
+	cx := float64(b.Max.X) - outer - 1
+	cy := float64(b.Max.Y) - outer - 1
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	for y := int(cy - outer - 1); y <= int(cy+outer+1); y++ {
+		for x := int(cx - outer - 1); x <= int(cx+outer+1); x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)
+			blend(dst, x, y, white, coverage(outer, d))
+			blend(dst, x, y, c, coverage(inner, d))
+		}
+	}
+	return dst
+}
+
+// coverage approximates how much of the pixel at distance d from a
+// circle's centre lies inside radius r.
+func coverage(r, d float64) float64 {
+	return math.Max(0, math.Min(1, r+0.5-d))
+}
+
+func blend(dst *image.RGBA, x, y int, c color.RGBA, alpha float64) {
+	if alpha <= 0 || !(image.Point{x, y}).In(dst.Bounds()) {
+		return
+	}
+	under := dst.RGBAAt(x, y)
+	mix := func(top, bottom uint8) uint8 {
+		return uint8(float64(top)*alpha + float64(bottom)*(1-alpha))
+	}
+	dst.SetRGBA(x, y, color.RGBA{mix(c.R, under.R), mix(c.G, under.G), mix(c.B, under.B), mix(c.A, under.A)})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/getlantern/systray"
+)
+
+// Traffic is measured from the TUN adapter's own counters, so it covers
+// everything that went through the tunnel whatever tun2socks did with it.
+
+const (
+	statsInterval       = 2 * time.Second
+	sessionsFile        = "sessions.json"
+	maxSessions         = 100 // Kept in sessionsFile
+	maxSessionMenuItems = 10
+)
+
+var procGetIfEntry = iphlpapi.NewProc("GetIfEntry")
+
+// mibIfRow is MIB_IFROW from ifmib.h.
+type mibIfRow struct {
+	Name            [256]uint16
+	Index           uint32
+	Type            uint32
+	Mtu             uint32
+	Speed           uint32
+	PhysAddrLen     uint32
+	PhysAddr        [8]byte
+	AdminStatus     uint32
+	OperStatus      uint32
+	LastChange      uint32
+	InOctets        uint32
+	InUcastPkts     uint32
+	InNUcastPkts    uint32
+	InDiscards      uint32
+	InErrors        uint32
+	InUnknownProtos uint32
+	OutOctets       uint32
+	OutUcastPkts    uint32
+	OutNUcastPkts   uint32
+	OutDiscards     uint32
+	OutErrors       uint32
+	OutQLen         uint32
+	DescrLen        uint32
+	Descr           [256]byte
+}
+
+// readTunCounters returns the octets received and sent by the TUN adapter.
+// The counters are 32 bits wide and wrap around.
+func readTunCounters() (in, out uint32, err error) {
+	iface, err := net.InterfaceByName(tunAlias)
+	if err != nil {
+		return 0, 0, err
+	}
+	row := mibIfRow{Index: uint32(iface.Index)}
+	if ret, _, _ := procGetIfEntry.Call(uintptr(unsafe.Pointer(&row))); ret != 0 {
+		return 0, 0, fmt.Errorf("GetIfEntry: %w", syscall.Errno(ret))
+	}
+	return row.InOctets, row.OutOctets, nil
+}
+
+// trafficMeter turns counter samples into session totals and rates.
+type trafficMeter struct {
+	started          time.Time
+	lastIn, lastOut  uint32
+	lastSample       time.Time
+	received, sent   uint64  // Session totals
+	downRate, upRate float64 // Bytes per second over the last interval
+}
+
+func newTrafficMeter(in, out uint32, now time.Time) *trafficMeter {
+	return &trafficMeter{started: now, lastIn: in, lastOut: out, lastSample: now}
+}
+
+// sample adds the traffic since the previous sample. Unsigned subtraction
+// gets the difference right across a counter wrap.
+func (m *trafficMeter) sample(in, out uint32, now time.Time) {
+	down, up := uint64(in-m.lastIn), uint64(out-m.lastOut)
+	m.received += down
+	m.sent += up
+	if elapsed := now.Sub(m.lastSample).Seconds(); elapsed > 0 {
+		m.downRate = float64(down) / elapsed
+		m.upRate = float64(up) / elapsed
+	}
+	m.lastIn, m.lastOut, m.lastSample = in, out, now
+}
+
+// trafficStats is a snapshot of the current session, as reported by the
+// API and the CLI.
+type trafficStats struct {
+	Received uint64  `json:"received"`
+	Sent     uint64  `json:"sent"`
+	DownRate float64 `json:"down_rate"` // Bytes per second
+	UpRate   float64 `json:"up_rate"`
+}
+
+var (
+	statsMu    sync.Mutex
+	meter      *trafficMeter // Current session, or nil
+	stopStats  chan struct{}
+	sessionLog []sessionRecord
+)
+
+// currentTraffic returns the current session's statistics, if connected.
+func currentTraffic() *trafficStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if meter == nil {
+		return nil
+	}
+	return &trafficStats{Received: meter.received, Sent: meter.sent, DownRate: meter.downRate, UpRate: meter.upRate}
+}
+
+// trafficStateChanged starts a session when the tunnel connects and ends it
+// when the tunnel goes down. It is called by setState.
+func trafficStateChanged(prev, s tunnelState) {
+	if s.connected() && !prev.connected() {
+		startTrafficMonitor()
+	} else if prev.connected() && !s.connected() {
+		stopTrafficMonitor()
+	}
+}
+
+func startTrafficMonitor() {
+	in, out, err := readTunCounters()
+	if err != nil {
+		logWarn(GetText("log_stats_read_fail"), err)
+	}
+	statsMu.Lock()
+	meter = newTrafficMeter(in, out, time.Now())
+	stop := make(chan struct{})
+	stopStats = stop
+	statsMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				in, out, err := readTunCounters()
+				if err != nil {
+					continue // The adapter is going away; the session is about to end
+				}
+				statsMu.Lock()
+				if meter != nil {
+					meter.sample(in, out, now)
+				}
+				statsMu.Unlock()
+				updateTooltip()
+				updateStatisticsMenu()
+				updateConnectionsMenu()
+			}
+		}
+	}()
+}
+
+// stopTrafficMonitor ends the session and records it in the history.
+func stopTrafficMonitor() {
+	statsMu.Lock()
+	ended := meter
+	if stopStats != nil {
+		close(stopStats)
+		stopStats = nil
+	}
+	meter = nil
+	statsMu.Unlock()
+	if ended == nil {
+		return
+	}
+
+	mu.RLock()
+	record := sessionRecord{
+		Start:    ended.started,
+		End:      time.Now(),
+		Profile:  runningProfile.Name,
+		Proxy:    proxyRoute(runningProfile),
+		Received: ended.received,
+		Sent:     ended.sent,
+	}
+	mu.RUnlock()
+	log.Printf(GetText("log_session_ended")+"\n", formatBytes(record.Sent), formatBytes(record.Received), record.End.Sub(record.Start).Round(time.Second))
+	recordSession(record)
+	updateStatisticsMenu()
+	updateConnectionsMenu()
+}
+
+// --- Session history ---
+
+// sessionRecord is one connected period, as kept in sessionsFile.
+type sessionRecord struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Profile  string    `json:"profile"`
+	Proxy    string    `json:"proxy"` // As shown by proxyRoute, without credentials
+	Received uint64    `json:"received"`
+	Sent     uint64    `json:"sent"`
+}
+
+// loadSessions reads the session history.
+func loadSessions() {
+	data, err := os.ReadFile(sessionsFile)
+	if err != nil {
+		return
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if err := json.Unmarshal(data, &sessionLog); err != nil {
+		logWarn(GetText("log_sessions_parse_fail"), err)
+	}
+}
+
+// recordSession appends r to the history and saves it.
+func recordSession(r sessionRecord) {
+	statsMu.Lock()
+	sessionLog = append(sessionLog, r)
+	if len(sessionLog) > maxSessions {
+		sessionLog = sessionLog[len(sessionLog)-maxSessions:]
+	}
+	saveSessionsLocked()
+	statsMu.Unlock()
+}
+
+// clearSessions empties the history.
+func clearSessions() {
+	statsMu.Lock()
+	sessionLog = nil
+	saveSessionsLocked()
+	statsMu.Unlock()
+	updateStatisticsMenu()
+}
+
+// saveSessionsLocked writes the history. Callers must hold statsMu.
+func saveSessionsLocked() {
+	data, err := json.MarshalIndent(sessionLog, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(sessionsFile, data, 0644); err != nil {
+		logWarn(GetText("log_sessions_write_fail"), err)
+	}
+}
+
+// --- Tray ---
+
+var (
+	mStatistics     *systray.MenuItem
+	mStatsRate      *systray.MenuItem
+	mStatsTotal     *systray.MenuItem
+	mSessionHistory *systray.MenuItem
+	mNoSessions     *systray.MenuItem
+	mClearSessions  *systray.MenuItem
+	sessionItems    []*systray.MenuItem
+	statsMenuMu     sync.Mutex // Guards sessionItems; the monitor and the event loop both update the menu
+)
+
+// addStatisticsMenu adds the Statistics submenu.
+func addStatisticsMenu() {
+	mStatistics = systray.AddMenuItem(GetText("statistics"), GetText("statistics_tooltip"))
+	mStatsRate = mStatistics.AddSubMenuItem("", "")
+	mStatsRate.Disable()
+	mStatsTotal = mStatistics.AddSubMenuItem("", "")
+	mStatsTotal.Disable()
+	mSessionHistory = mStatistics.AddSubMenuItem(GetText("session_history"), GetText("session_history_tooltip"))
+	mNoSessions = mSessionHistory.AddSubMenuItem(GetText("no_sessions"), GetText("no_sessions"))
+	mNoSessions.Disable()
+	mClearSessions = mStatistics.AddSubMenuItem(GetText("clear_sessions"), GetText("clear_sessions_tooltip"))
+	updateStatisticsMenu()
+}
+
+// refreshStatisticsMenuTexts relabels the submenu after a language switch.
+func refreshStatisticsMenuTexts() {
+	if mStatistics == nil {
+		return
+	}
+	mStatistics.SetTitle(GetText("statistics"))
+	mStatistics.SetTooltip(GetText("statistics_tooltip"))
+	mSessionHistory.SetTitle(GetText("session_history"))
+	mSessionHistory.SetTooltip(GetText("session_history_tooltip"))
+	mNoSessions.SetTitle(GetText("no_sessions"))
+	mClearSessions.SetTitle(GetText("clear_sessions"))
+	mClearSessions.SetTooltip(GetText("clear_sessions_tooltip"))
+	updateStatisticsMenu()
+}
+
+// updateStatisticsMenu shows the current rates and totals and the most
+// recent sessions, newest first.
+func updateStatisticsMenu() {
+	if mStatistics == nil {
+		return
+	}
+	statsMenuMu.Lock()
+	defer statsMenuMu.Unlock()
+	stats := currentTraffic()
+	if stats == nil {
+		mStatsRate.SetTitle(GetText("stats_not_connected"))
+		mStatsTotal.Hide()
+	} else {
+		mStatsRate.SetTitle(fmt.Sprintf(GetText("stats_rate"), formatBytes(uint64(stats.UpRate)), formatBytes(uint64(stats.DownRate))))
+		mStatsTotal.SetTitle(fmt.Sprintf(GetText("stats_total"), formatBytes(stats.Sent), formatBytes(stats.Received)))
+		mStatsTotal.Show()
+	}
+
+	statsMu.Lock()
+	var recent []sessionRecord
+	for i := len(sessionLog) - 1; i >= 0 && len(recent) < maxSessionMenuItems; i-- {
+		recent = append(recent, sessionLog[i])
+	}
+	statsMu.Unlock()
+
+	if len(recent) == 0 {
+		mNoSessions.Show()
+	} else {
+		mNoSessions.Hide()
+	}
+	for i, r := range recent {
+		title := fmt.Sprintf(GetText("session_entry"), r.Start.Format("01-02 15:04"),
+			r.End.Sub(r.Start).Round(time.Minute), formatBytes(r.Sent), formatBytes(r.Received), r.Profile)
+		if i == len(sessionItems) {
+			item := mSessionHistory.AddSubMenuItem(title, "")
+			item.Disable()
+			sessionItems = append(sessionItems, item)
+		}
+		sessionItems[i].SetTitle(title)
+		// Records from older versions hold the full URL.
+		sessionItems[i].SetTooltip(redactSecrets(r.Proxy))
+		sessionItems[i].Show()
+	}
+	for _, item := range sessionItems[len(recent):] {
+		item.Hide()
+	}
+}
+
+// trafficTooltip is the tooltip line for the current session, if any.
+func trafficTooltip() string {
+	stats := currentTraffic()
+	if stats == nil {
+		return ""
+	}
+	return fmt.Sprintf(GetText("stats_rate"), formatBytes(uint64(stats.UpRate)), formatBytes(uint64(stats.DownRate)))
+}
+
+// formatBytes renders n with a binary unit, e.g. "1.5 MB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
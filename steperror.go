@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ncruces/zenity"
+)
+
+// failureKind classifies why a step failed, so that common failures come
+// with specific advice.
+type failureKind int
+
+const (
+	failureUnknown failureKind = iota
+	failureMissingBinary
+	failureAdapterTimeout
+	failureRouteConflict
+	failurePermission
+)
+
+func (k failureKind) String() string {
+	switch k {
+	case failureMissingBinary:
+		return "missing_binary"
+	case failureAdapterTimeout:
+		return "adapter_timeout"
+	case failureRouteConflict:
+		return "route_conflict"
+	case failurePermission:
+		return "permission"
+	}
+	return "unknown"
+}
+
+// advice suggests a fix for failures of this kind.
+func (k failureKind) advice() string {
+	if k == failureUnknown {
+		return ""
+	}
+	return GetText("advice_" + k.String())
+}
+
+// StepError is a failed step of bringing the tunnel up, with what is needed
+// to diagnose it.
+type StepError struct {
+	Step    string // What was being done
+	Command string // The command that failed, if any
+	Output  string // Its output
+	Kind    failureKind
+	Err     error
+}
+
+func (e *StepError) Error() string { return e.Err.Error() }
+
+func (e *StepError) Unwrap() error { return e.Err }
+
+// Details is the full report offered by "Copy details".
+func (e *StepError) Details() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n", GetText("details_step"), e.Step)
+	fmt.Fprintf(&b, "%s: %s\n", GetText("details_kind"), e.Kind)
+	if e.Command != "" {
+		fmt.Fprintf(&b, "%s: %s\n", GetText("details_command"), e.Command)
+	}
+	if e.Output != "" {
+		fmt.Fprintf(&b, "%s:\n%s\n", GetText("details_output"), strings.TrimSpace(e.Output))
+	}
+	fmt.Fprintf(&b, "%s: %v\n", GetText("details_error"), e.Err)
+	if advice := e.Kind.advice(); advice != "" {
+		fmt.Fprintf(&b, "%s: %s\n", GetText("details_advice"), advice)
+	}
+	return b.String()
+}
+
+// adapterTimeoutError reports that the TUN adapter did not appear in time.
+type adapterTimeoutError struct {
+	alias string
+}
+
+func (e adapterTimeoutError) Error() string {
+	return fmt.Sprintf(GetText("wait_adapter_timeout"), e.alias)
+}
+
+// stepFailed wraps err from the named step.
+func stepFailed(step string, err error) *StepError {
+	return &StepError{Step: step, Kind: classifyFailure(err, ""), Err: err}
+}
+
+// commandFailed reports a helper command such as netsh that exited with an
+// error.
+func commandFailed(step, cmdStr string, output []byte, err error) *StepError {
+	return &StepError{
+		Step:    step,
+		Command: cmdStr,
+		Output:  string(output),
+		Kind:    classifyFailure(err, string(output)),
+		Err:     fmt.Errorf(GetTextWithFormat("command_exec_fail"), cmdStr, string(output), err),
+	}
+}
+
+// classifyFailure recognises common failures from an error and the output
+// of the command that produced it. netsh answers in the system language, so
+// both English and Chinese messages are matched.
+func classifyFailure(err error, output string) failureKind {
+	output = strings.ToLower(output)
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, exec.ErrNotFound),
+		strings.Contains(output, "is not recognized"), strings.Contains(output, "不是内部或外部命令"):
+		return failureMissingBinary
+	case errors.As(err, new(adapterTimeoutError)), errors.Is(err, context.DeadlineExceeded):
+		return failureAdapterTimeout
+	case errors.Is(err, fs.ErrPermission),
+		strings.Contains(output, "access is denied"), strings.Contains(output, "requires elevation"),
+		strings.Contains(output, "拒绝访问"), strings.Contains(output, "需要提升"):
+		return failurePermission
+	case strings.Contains(output, "already exists"), strings.Contains(output, "已存在"):
+		return failureRouteConflict
+	}
+	return failureUnknown
+}
+
+// showStartError tells the user why the tunnel did not start, offering to
+// copy the details or open the log.
+func showStartError(err error) {
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		stepErr = stepFailed(GetText("step_start"), err)
+	}
+	text := fmt.Sprintf(GetText("start_error_msg"), stepErr.Step, stepErr.Error())
+	if advice := stepErr.Kind.advice(); advice != "" {
+		text += "\n\n" + GetText("details_advice") + ": " + advice
+	}
+
+	for {
+		err := zenity.Question(text,
+			zenity.Title(GetText("start_fail")),
+			zenity.ErrorIcon,
+			zenity.OKLabel(GetText("open_log")),
+			zenity.ExtraButton(GetText("copy_details")),
+			zenity.CancelLabel(GetText("close")))
+		switch {
+		case err == nil:
+			openLog()
+			return
+		case errors.Is(err, zenity.ErrExtraButton):
+			if err := writeClipboard(stepErr.Details()); err != nil {
+				logWarn(GetText("copy_details_fail"), err)
+			}
+			// Show the dialog again so the log can still be opened.
+		default:
+			return
+		}
+	}
+}
+
+// openLog opens TUNTray.log in the default text editor.
+func openLog() {
+	if logFile == nil {
+		return
+	}
+	path, err := filepath.Abs(logFile.Name())
+	if err != nil {
+		path = logFile.Name()
+	}
+	if err := hiddenCommand("cmd", "/C", "start", "", path).Run(); err != nil {
+		logWarn(GetText("open_log_fail"), err)
+	}
+}
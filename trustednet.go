@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/ncruces/zenity"
+)
+
+// Actions a NetworkRule can take.
+const (
+	ruleActionConnect    = "connect"
+	ruleActionDisconnect = "disconnect"
+)
+
+// NetworkRule starts or stops the tunnel when the active network matches.
+// Empty fields match anything; all non-empty fields must match.
+type NetworkRule struct {
+	Name       string `json:"name"`
+	GatewayIP  string `json:"gateway_ip,omitempty"`
+	GatewayMAC string `json:"gateway_mac,omitempty"`
+	DNSSuffix  string `json:"dns_suffix,omitempty"`
+	SSID       string `json:"ssid,omitempty"`
+	Interface  string `json:"interface,omitempty"`
+	Action     string `json:"action"`            // ruleActionConnect or ruleActionDisconnect
+	Profile    string `json:"profile,omitempty"` // Profile to use with ruleActionConnect; empty keeps the active one
+}
+
+// networkInfo identifies the network we are currently attached to.
+type networkInfo struct {
+	GatewayIP  string
+	GatewayMAC string
+	DNSSuffix  string
+	SSID       string
+	Interface  string
+}
+
+func (n networkInfo) String() string {
+	return fmt.Sprintf("gateway=%s mac=%s suffix=%s ssid=%s interface=%s",
+		n.GatewayIP, n.GatewayMAC, n.DNSSuffix, n.SSID, n.Interface)
+}
+
+// Matches reports whether the rule applies to network n.
+func (r NetworkRule) Matches(n networkInfo) bool {
+	fields := []struct{ want, have string }{
+		{r.GatewayIP, n.GatewayIP},
+		{normalizeMAC(r.GatewayMAC), n.GatewayMAC},
+		{strings.TrimPrefix(r.DNSSuffix, "."), n.DNSSuffix},
+		{r.SSID, n.SSID},
+		{r.Interface, n.Interface},
+	}
+	matchedAny := false
+	for _, f := range fields {
+		if f.want == "" {
+			continue
+		}
+		if !strings.EqualFold(f.want, f.have) {
+			return false
+		}
+		matchedAny = true
+	}
+	return matchedAny
+}
+
+// normalizeMAC writes a MAC address as lower case, dash separated octets.
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(mac), ":", "-"))
+}
+
+// networkRulesActive reports whether any network rule or default action can
+// apply.
+func networkRulesActive() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return !appConfig.RulesPaused && (len(appConfig.NetworkRules) > 0 || appConfig.DefaultNetworkAction != "")
+}
+
+// currentNetworkInfo collects the attributes rules can match on. It runs
+// several commands, so it must not be called on the main event loop.
+func currentNetworkInfo() networkInfo {
+	info := networkInfo{GatewayIP: defaultGateway()}
+	gateway := net.ParseIP(info.GatewayIP)
+	if gateway == nil {
+		return info
+	}
+
+	// The interface is the one whose subnet contains the gateway.
+	var mac net.HardwareAddr
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, i := range interfaces {
+			addrs, _ := i.Addrs()
+			for _, a := range addrs {
+				if ipNet, ok := a.(*net.IPNet); ok && ipNet.Contains(gateway) {
+					info.Interface, mac = i.Name, i.HardwareAddr
+				}
+			}
+		}
+	}
+
+	// "arp -a <ip>" lines look like: "  192.168.1.1   aa-bb-cc-dd-ee-ff   dynamic"
+	if output, err := hiddenCommand("arp", "-a", info.GatewayIP).Output(); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == info.GatewayIP {
+				info.GatewayMAC = normalizeMAC(fields[1])
+			}
+		}
+	}
+
+	if info.Interface != "" {
+		script := fmt.Sprintf("(Get-DnsClient -InterfaceAlias %s).ConnectionSpecificSuffix", psQuote(info.Interface))
+		if output, err := hiddenCommand("powershell", "-NoProfile", "-Command", script).Output(); err == nil {
+			info.DNSSuffix = strings.TrimSpace(string(output))
+		}
+	}
+
+	if info.Interface != "" {
+		if output, err := hiddenCommand("netsh", "wlan", "show", "interfaces").Output(); err == nil {
+			info.SSID = wlanSSID(string(output), info.Interface, mac)
+		}
+	}
+	return info
+}
+
+// wlanSSID returns the SSID that "netsh wlan show interfaces" reports for
+// the named interface, or "" if it is not a connected wireless interface.
+// The output has a block of "    Key    : Value" lines per interface; the
+// block is found by the interface's name or MAC address, as the keys
+// themselves are translated.
+func wlanSSID(output, name string, mac net.HardwareAddr) string {
+	var ssid string
+	matched := false
+	for _, line := range strings.Split(output+"\n", "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			// A blank line ends the block.
+			if strings.TrimSpace(line) == "" {
+				if matched {
+					return ssid
+				}
+				ssid = ""
+			}
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case key == "SSID":
+			ssid = value
+		case strings.EqualFold(value, name), len(mac) > 0 && strings.EqualFold(value, mac.String()):
+			matched = true
+		}
+	}
+	return ""
+}
+
+// evaluateNetworkRules applies the first rule matching network info, or the
+// default action if none does. It runs on the main event loop and reports
+// whether any rule applied, and whether it started or stopped the tunnel as
+// a result.
+func evaluateNetworkRules(info networkInfo) (applied, changed bool) {
+	mu.RLock()
+	paused := appConfig.RulesPaused
+	rules := append([]NetworkRule(nil), appConfig.NetworkRules...)
+	defaultAction := appConfig.DefaultNetworkAction
+	activeProfile := appConfig.ActiveProfile
+	mu.RUnlock()
+	if paused || (len(rules) == 0 && defaultAction == "") {
+		return false, false
+	}
+
+	log.Printf(GetText("log_network_info")+"\n", info)
+
+	rule := NetworkRule{Name: GetText("rule_default"), Action: defaultAction}
+	for _, r := range rules {
+		if r.Matches(info) {
+			rule = r
+			break
+		}
+	}
+	if rule.Action == "" {
+		return false, false
+	}
+
+	switch rule.Action {
+	case ruleActionDisconnect:
+		if !tunnelRunning() {
+			return true, false
+		}
+		log.Printf(GetText("log_rule_applied")+"\n", rule.Name, rule.Action)
+		handleStop()
+		return true, true
+	case ruleActionConnect:
+		profileChanged := rule.Profile != "" && rule.Profile != activeProfile
+		if tunnelRunning() && !profileChanged {
+			return true, false
+		}
+		log.Printf(GetText("log_rule_applied")+"\n", rule.Name, rule.Action)
+		if tunnelRunning() {
+			handleStop() // The start waits for it
+		}
+		if profileChanged {
+			setProfile(rule.Profile)
+		}
+		handleStart()
+		return true, true
+	}
+	log.Printf(GetText("rule_action_invalid")+"\n", rule.Name, rule.Action)
+	return false, false
+}
+
+// addRuleForCurrentNetwork creates a rule matching the network we are on. It
+// runs on its own goroutine, as collecting the network takes a while.
+func addRuleForCurrentNetwork() {
+	info := currentNetworkInfo()
+	if info.GatewayIP == "" {
+		zenity.Warning(GetText("rule_no_network"), zenity.Title(GetText("add_network_rule")))
+		return
+	}
+
+	actions := []string{GetText("rule_action_connect"), GetText("rule_action_disconnect")}
+	action, err := zenity.List(fmt.Sprintf(GetText("rule_action_prompt"), info), actions,
+		zenity.Title(GetText("add_network_rule")),
+		zenity.DisallowEmpty())
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+
+	rule := NetworkRule{Action: ruleActionDisconnect}
+	if action == actions[0] {
+		rule.Action = ruleActionConnect
+		mu.RLock()
+		var names []string
+		for _, p := range appConfig.Profiles {
+			names = append(names, p.Name)
+		}
+		active := appConfig.ActiveProfile
+		mu.RUnlock()
+		if rule.Profile, err = zenity.List(GetText("rule_profile_prompt"), names,
+			zenity.Title(GetText("add_network_rule")),
+			zenity.DefaultItems(active),
+			zenity.DisallowEmpty()); err != nil {
+			logDialogError(err)
+			return
+		}
+	}
+
+	// Prefer the most specific identifiers available.
+	switch {
+	case info.SSID != "":
+		rule.SSID = info.SSID
+	case info.GatewayMAC != "":
+		rule.GatewayIP, rule.GatewayMAC = info.GatewayIP, info.GatewayMAC
+	default:
+		rule.GatewayIP = info.GatewayIP
+	}
+	rule.DNSSuffix = info.DNSSuffix
+
+	defaultName := info.SSID
+	if defaultName == "" {
+		defaultName = info.Interface
+	}
+	name, err := zenity.Entry(GetText("rule_name_prompt"),
+		zenity.Title(GetText("add_network_rule")),
+		zenity.EntryText(defaultName))
+	if err != nil {
+		logDialogError(err)
+		return
+	}
+	rule.Name = strings.TrimSpace(name)
+
+	mu.Lock()
+	// New rules take precedence over older, possibly broader ones.
+	appConfig.NetworkRules = append([]NetworkRule{rule}, appConfig.NetworkRules...)
+	saveConfig()
+	mu.Unlock()
+
+	log.Printf(GetText("log_rule_added")+"\n", rule.Name, rule.Action)
+	zenity.Info(GetText("rule_added_success"), zenity.Title(GetText("operation_success")))
+}